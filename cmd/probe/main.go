@@ -0,0 +1,70 @@
+// probe sends a binding request to the server of each stun or turn URI given, and prints the
+// reflexive address reported
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sifaserdarozen/stun/stun"
+	"github.com/sifaserdarozen/stun/uri"
+	"github.com/spf13/pflag"
+)
+
+// exit codes
+const (
+	EXIT_OK      = 0
+	EXIT_FAILURE = 1 // a server could not be queried
+	EXIT_USAGE   = 2 // arguments are invalid
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	flags := pflag.NewFlagSet("probe", pflag.ContinueOnError)
+	timeout := flags.Duration("timeout", stun.CLIENT_TIMEOUT, "Timeout of each query")
+	insecure := flags.Bool("insecure", false, "Skip certificate verification of stuns and turns servers")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: probe [flags] uri...\n\nuri is e.g. stun:stun.example.org, stuns:192.0.2.1:5349 or turn:example.org?transport=tcp")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); nil != err {
+		return EXIT_USAGE
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	var uris []*uri.URI
+	for _, arg := range flags.Args() {
+		u, err := uri.Parse(arg)
+		if nil != err {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+		uris = append(uris, u)
+	}
+
+	code := EXIT_OK
+	for _, u := range uris {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		start := time.Now()
+		ip, port, err := stun.QueryURI(ctx, *u, &tls.Config{InsecureSkipVerify: *insecure})
+		cancel()
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "%s failed: %s\n", u, err)
+			code = EXIT_FAILURE
+			continue
+		}
+		fmt.Printf("%s %s %s\n", u, net.JoinHostPort(ip.String(), strconv.Itoa(port)), time.Since(start).Round(time.Millisecond))
+	}
+	return code
+}
@@ -2,33 +2,162 @@ package main
 
 import (
 	"context"
-	"log"
-	"sync"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
 
 	"github.com/sifaserdarozen/stun/stun"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
 )
 
+const (
+	FLAG_CHECK_CONFIG = "check-config"
+	SHUTDOWN_TIMEOUT  = 5 * time.Second
+	UPGRADE_TIMEOUT   = 30 * time.Second
+)
+
+// exit codes
+const (
+	EXIT_OK       = 0
+	EXIT_CONFIG   = 2 // configuration could not be read or is invalid
+	EXIT_START    = 3 // a listener could not be bound
+	EXIT_FAILURE  = 4 // a listener failed while serving
+	EXIT_SHUTDOWN = 5 // in flight work did not finish in time
+)
+
+// reportConfiguration lists every configuration problem on stderr
+func reportConfiguration(err error) {
+	var confErr *stun.ConfigurationError
+	if !errors.As(err, &confErr) {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Configuration has %d problem(s):\n", len(confErr.Problems))
+	for _, problem := range confErr.Problems {
+		fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+	}
+}
+
+// notify tells state to the service manager, if there is one
+func notify(state string) {
+	if _, err := stun.Notify(state); nil != err {
+		slog.Warn("Service manager notification failed", "state", state, "error", err)
+	}
+}
+
+// upgrade starts the binary at the path of the running one with the same arguments, passing
+// it every listener socket, and returns once it serves
+func upgrade(server *stun.Server) error {
+	path, err := os.Executable()
+	if nil != err {
+		return fmt.Errorf("executable path lookup failed: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), UPGRADE_TIMEOUT)
+	defer cancel()
+	process, err := server.Upgrade(ctx, path, os.Args[1:])
+	if nil != err {
+		return err
+	}
+	slog.Info("New binary is serving", "pid", process.Pid)
+	return nil
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run starts the server and returns the exit code once it stops
+func run() int {
+	flags := pflag.NewFlagSet(os.Args[0], pflag.ExitOnError)
+	checkConfig := flags.Bool(FLAG_CHECK_CONFIG, false, "Validate configuration and exit")
+
 	// read configuration
-	conf, err := stun.GetConfiguration()
+	conf, err := stun.NewConfiguration(viper.New(), flags, os.Args[1:])
 	if nil != err {
-		log.Fatalf("Configuration readup failed with error: %s", err)
+		fmt.Fprintf(os.Stderr, "Configuration readup failed with error: %s\n", err)
+		return EXIT_CONFIG
+	}
+
+	// validate configuration
+	if err := conf.Validate(); nil != err {
+		reportConfiguration(err)
+		return EXIT_CONFIG
+	}
+	if *checkConfig {
+		fmt.Println("Configuration is valid")
+		return EXIT_OK
 	}
 
-	// sync helpers
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
-	var wg sync.WaitGroup
+	// switch to configured structured logging
+	logger, err := stun.NewLogger(conf.Log, os.Stderr)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Logger setup failed with error: %s\n", err)
+		return EXIT_CONFIG
+	}
+	slog.SetDefault(logger)
+
+	// sockets passed by an upgrading binary or by systemd socket activation are used instead
+	// of binding ports
+	upgraded := stun.Upgraded()
+	sockets, err := stun.InheritedSockets()
+	if nil != err {
+		slog.Error("Reading inherited sockets failed", "error", err)
+		return EXIT_START
+	}
 
 	// start stun service
-	stun.Start(conf, ctx, &wg)
+	server := stun.New(conf)
+	server.Sockets = sockets
+	if err := server.Start(); nil != err {
+		slog.Error("Starting stun server failed", "error", err)
+		return EXIT_START
+	}
+	slog.Info("Listening", "addrs", server.Addrs().String())
+	if upgraded {
+		// the service manager tracks this process from now on, the old binary stops
+		notify(fmt.Sprintf("MAINPID=%d", os.Getpid()))
+		if err := stun.UpgradeReady(); nil != err {
+			slog.Warn("Reporting ready to the old binary failed", "error", err)
+		}
+	}
+	notify(stun.SD_READY)
 
-	// wait till softkill
-	stun.WaitTillInterrupt()
+	interval, err := stun.WatchdogInterval()
+	if nil != err {
+		slog.Warn("Watchdog is not used", "error", err)
+	}
+	go stun.Watchdog(server.Done(), interval, server.Serving)
 
-	// cancel context
-	cancel()
+	// wait till softkill, upgrade or till server fails
+	replaced := false
+	stun.WaitTillInterrupt(server.Done(), func() error {
+		if err := upgrade(server); nil != err {
+			return err
+		}
+		replaced = true
+		return nil
+	})
+	// the upgraded binary is the main process of the service now, which is not stopping
+	if !replaced {
+		notify(stun.SD_STOPPING)
+	}
+
+	// drain, stop listeners and wait for in flight work to finish
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Shutdown.GracePeriod+conf.Shutdown.Deadline+SHUTDOWN_TIMEOUT)
+	defer cancel()
+	shutdownErr := server.Shutdown(ctx)
 
-	// wait for threads to finish
-	wg.Wait()
+	if err := server.Err(); nil != err {
+		slog.Error("Stun server failed", "error", err)
+		return EXIT_FAILURE
+	}
+	if nil != shutdownErr {
+		slog.Warn("Shutdown did not complete", "error", shutdownErr)
+		return EXIT_SHUTDOWN
+	}
+	return EXIT_OK
 }
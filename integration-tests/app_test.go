@@ -76,7 +76,7 @@ func TestWithPion(t *testing.T) {
 			}
 			exposedPortRequest := fmt.Sprintf("127.0.0.1::%s/%s", exposedPort.Port(), exposedPort.Proto())
 
-			expectedStartLog := fmt.Sprintf("Starting Stun server, listening port at %s/%s", stunPort, test.proto)
+			expectedStartLog := fmt.Sprintf(`msg="Starting Stun server" transport=%s port=%s`, test.proto, stunPort)
 			req := testcontainers.ContainerRequest{
 				Image:        "stun:latest",
 				ExposedPorts: []string{exposedPortRequest},
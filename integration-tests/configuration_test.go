@@ -69,7 +69,7 @@ func TestConfiguration(t *testing.T) {
 			}
 			exposedPortRequest := fmt.Sprintf("127.0.0.1::%s/%s", exposedPort.Port(), exposedPort.Proto())
 
-			expectedStartLog := fmt.Sprintf("Starting Stun server, listening port at %s/%s", test.port, udpProto)
+			expectedStartLog := fmt.Sprintf(`msg="Starting Stun server" transport=%s port=%s`, udpProto, test.port)
 			req := testcontainers.ContainerRequest{
 				Image:        "stun:latest",
 				ExposedPorts: []string{exposedPortRequest},
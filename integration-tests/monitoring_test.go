@@ -39,7 +39,7 @@ func TestMonitoring(t *testing.T) {
 	}
 	exposedPortRequest := fmt.Sprintf("127.0.0.1::%s/%s", exposedPort.Port(), exposedPort.Proto())
 
-	expectedStartLog := fmt.Sprintf("Starting Stun server, listening port at %s/%s", stunPort, tcpProto)
+	expectedStartLog := fmt.Sprintf(`msg="Starting Stun server" transport=%s port=%s`, tcpProto, stunPort)
 	expectedEnv := "test"
 	req := testcontainers.ContainerRequest{
 		Image:        "stun:latest",
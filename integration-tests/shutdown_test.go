@@ -26,7 +26,7 @@ func TestGracefulShutdown(t *testing.T) {
 	}
 	exposedPortRequest := fmt.Sprintf("127.0.0.1::%s/%s", exposedPort.Port(), exposedPort.Proto())
 
-	expectedStartLog := fmt.Sprintf("Starting Stun server, listening port at %s/%s", stunPort, tcpProto)
+	expectedStartLog := fmt.Sprintf(`msg="Starting Stun server" transport=%s port=%s`, tcpProto, stunPort)
 	req := testcontainers.ContainerRequest{
 		Image:        "stun:latest",
 		ExposedPorts: []string{exposedPortRequest},
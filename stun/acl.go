@@ -0,0 +1,163 @@
+package stun
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// acl lists
+const (
+	ACL_ALLOW = "allow"
+	ACL_DENY  = "deny"
+)
+
+type AclConf struct {
+	// Allow lists client networks that are served, empty allows every client not denied
+	Allow []string
+	// Deny lists client networks that are never served, it takes precedence over Allow
+	Deny []string
+}
+
+func (self AclConf) String() string {
+	return fmt.Sprintf("{Allow: %v, Deny: %v}", self.Allow, self.Deny)
+}
+
+// ACL filters requests by client address. Entries can be changed while serving.
+type ACL struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if nil != err {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewACL creates an ACL holding the configured entries
+func NewACL(conf AclConf) (*ACL, error) {
+	allow, err := parseNets(conf.Allow)
+	if nil != err {
+		return nil, err
+	}
+	deny, err := parseNets(conf.Deny)
+	if nil != err {
+		return nil, err
+	}
+	return &ACL{allow: allow, deny: deny}, nil
+}
+
+// Allowed reports whether requests of ip should be served
+func (self *ACL) Allowed(ip net.IP) bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	if containsIP(self.deny, ip) {
+		return false
+	}
+	return len(self.allow) == 0 || containsIP(self.allow, ip)
+}
+
+// list returns the entries of the named list, called with lock held
+func (self *ACL) list(name string) (*[]*net.IPNet, error) {
+	switch name {
+	case ACL_ALLOW:
+		return &self.allow, nil
+	case ACL_DENY:
+		return &self.deny, nil
+	}
+	return nil, fmt.Errorf("unknown acl list %q, should be %s or %s", name, ACL_ALLOW, ACL_DENY)
+}
+
+// Add appends cidr to the named list, adding an existing entry is a no-op
+func (self *ACL) Add(name string, cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if nil != err {
+		return err
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	list, err := self.list(name)
+	if nil != err {
+		return err
+	}
+	for _, e := range *list {
+		if e.String() == n.String() {
+			return nil
+		}
+	}
+	*list = append(*list, n)
+	return nil
+}
+
+// Remove deletes cidr from the named list, it returns an error if there is no such entry
+func (self *ACL) Remove(name string, cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if nil != err {
+		return err
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	list, err := self.list(name)
+	if nil != err {
+		return err
+	}
+	for i, e := range *list {
+		if e.String() == n.String() {
+			*list = append((*list)[:i:i], (*list)[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in %s list", n, name)
+}
+
+// Conf returns the current entries
+func (self *ACL) Conf() AclConf {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	conf := AclConf{Allow: []string{}, Deny: []string{}}
+	for _, n := range self.allow {
+		conf.Allow = append(conf.Allow, n.String())
+	}
+	for _, n := range self.deny {
+		conf.Deny = append(conf.Deny, n.String())
+	}
+	return conf
+}
+
+// Middleware drops requests of clients that are not allowed, without any response
+func (self *ACL) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			ip, _ := r.RemoteIP()
+			if !self.Allowed(ip) {
+				slog.Debug("Request dropped by acl", "transport", r.Transport, "remote_addr", r.RemoteAddr)
+				return
+			}
+			next.ServeSTUN(w, r)
+		})
+	}
+}
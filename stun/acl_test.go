@@ -0,0 +1,69 @@
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL(AclConf{Allow: []string{"10.0.0.0/8", "2001:db8::/32"}, Deny: []string{"10.1.0.0/16"}})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		ip      string
+		allowed bool
+	}{
+		"allowed ipv4 network should be served":       {ip: "10.2.3.4", allowed: true},
+		"allowed ipv6 network should be served":       {ip: "2001:db8::1", allowed: true},
+		"deny should take precedence over allow":      {ip: "10.1.2.3", allowed: false},
+		"address out of allow list should be dropped": {ip: "192.0.2.1", allowed: false},
+	}
+	for name, test := range testCases {
+		if allowed := acl.Allowed(net.ParseIP(test.ip)); allowed != test.allowed {
+			t.Errorf("%s: %s allowed is %t, expected %t", name, test.ip, allowed, test.allowed)
+		}
+	}
+}
+
+func TestACLChange(t *testing.T) {
+	acl, err := NewACL(AclConf{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	if !acl.Allowed(ip) {
+		t.Fatal("Empty acl should allow every client")
+	}
+
+	if err := acl.Add(ACL_DENY, "192.0.2.0/24"); nil != err {
+		t.Fatal(err)
+	}
+	if err := acl.Add(ACL_DENY, "192.0.2.0/24"); nil != err {
+		t.Errorf("Adding an existing entry failed: %s", err)
+	}
+	if acl.Allowed(ip) {
+		t.Error("Denied client is allowed")
+	}
+	if conf := acl.Conf(); len(conf.Deny) != 1 {
+		t.Errorf("Deny list %v should have 1 entry", conf.Deny)
+	}
+
+	if err := acl.Remove(ACL_DENY, "192.0.2.0/24"); nil != err {
+		t.Fatal(err)
+	}
+	if !acl.Allowed(ip) {
+		t.Error("Removed deny entry still applies")
+	}
+
+	if err := acl.Remove(ACL_DENY, "192.0.2.0/24"); nil == err {
+		t.Error("Removing a missing entry should fail")
+	}
+	if err := acl.Add("block", "192.0.2.0/24"); nil == err {
+		t.Error("Adding to an unknown list should fail")
+	}
+	if err := acl.Add(ACL_ALLOW, "192.0.2.1"); nil == err {
+		t.Error("Adding an address without prefix length should fail")
+	}
+}
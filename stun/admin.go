@@ -0,0 +1,192 @@
+package stun
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	REDACTED = "<redacted>"
+)
+
+type AdminConf struct {
+	Enabled bool
+	Port    int
+	// Token is the bearer token admin requests should carry
+	Token string
+}
+
+func (self AdminConf) String() string {
+	token := ""
+	if self.Token != "" {
+		token = REDACTED
+	}
+	return fmt.Sprintf("{enabled: %t, Port: %d, Token: %s}", self.Enabled, self.Port, token)
+}
+
+// BuildInfo is the build and runtime information reported by the admin api
+type BuildInfo struct {
+	Version   string    `json:"version"`
+	BuildDate string    `json:"build_date"`
+	Env       string    `json:"env"`
+	StartDate time.Time `json:"start_date"`
+	Uptime    string    `json:"uptime"`
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+type aclEntryBody struct {
+	List string `json:"list"`
+	CIDR string `json:"cidr"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); nil != err {
+		slog.Warn("Admin response write failed", "error", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// adminAuth rejects requests without the bearer token
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminHandler serves the admin api of the server, every endpoint requires the configured token
+func (self *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		conf := self.conf
+		if conf.Admin.Token != "" {
+			conf.Admin.Token = REDACTED
+		}
+		if conf.Cluster.Secret != "" {
+			conf.Cluster.Secret = REDACTED
+		}
+		secrets := make([]string, len(conf.Auth.Rest.Secrets))
+		for i := range secrets {
+			secrets[i] = REDACTED
+		}
+		conf.Auth.Rest.Secrets = secrets
+		if conf.Auth.Http.Token != "" {
+			conf.Auth.Http.Token = REDACTED
+		}
+		writeJSON(w, http.StatusOK, conf)
+	})
+
+	mux.HandleFunc("GET /info", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, BuildInfo{
+			Version:   Version,
+			BuildDate: BuildDate,
+			Env:       Env,
+			StartDate: StartDate,
+			Uptime:    time.Since(StartDate).Round(time.Second).String(),
+		})
+	})
+
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, self.conns.List())
+	})
+
+	mux.HandleFunc("GET /keepalives", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, self.keepalives.List())
+	})
+
+	mux.HandleFunc("GET /loglevel", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, logLevelBody{Level: strings.ToLower(LogLevel.Level().String())})
+	})
+
+	mux.HandleFunc("PUT /loglevel", func(w http.ResponseWriter, r *http.Request) {
+		var body logLevelBody
+		if err := json.NewDecoder(r.Body).Decode(&body); nil != err {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		level, err := ParseLevel(body.Level)
+		if nil != err {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		LogLevel.Set(level)
+		slog.Info("Log level changed", "level", level)
+		writeJSON(w, http.StatusOK, logLevelBody{Level: strings.ToLower(level.String())})
+	})
+
+	mux.HandleFunc("GET /acl", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, self.acl.Conf())
+	})
+
+	aclChange := func(change func(list string, cidr string) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var body aclEntryBody
+			if err := json.NewDecoder(r.Body).Decode(&body); nil != err {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := change(body.List, body.CIDR); nil != err {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			slog.Info("Acl changed", "method", r.Method, "list", body.List, "cidr", body.CIDR)
+			writeJSON(w, http.StatusOK, self.acl.Conf())
+		}
+	}
+	mux.HandleFunc("POST /acl", aclChange(self.acl.Add))
+	mux.HandleFunc("DELETE /acl", aclChange(self.acl.Remove))
+
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		self.Drain()
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "draining"})
+	})
+
+	return adminAuth(self.conf.Admin.Token, mux)
+}
+
+// AdminStart serves admin handler on an already bound listener under sup, till its context is cancelled
+func AdminStart(sup *Supervisor, handler http.Handler, listener net.Listener) {
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	srv := http.Server{Handler: handler}
+	sup.Go("admin", func(ctx context.Context) error {
+		slog.Info("Starting Admin server", "port", port)
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			return err
+		}
+		slog.Info("Stopped Admin server")
+		return nil
+	})
+
+	sup.Go("admin shutdown", func(ctx context.Context) error {
+		<-ctx.Done()
+		slog.Info("Stopping Admin server")
+
+		if err := srv.Shutdown(context.Background()); err != nil {
+			// Error from closing listeners, or context timeout:
+			slog.Warn("Admin server shutdown error", "error", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,221 @@
+package stun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret"
+
+// adminRequest calls admin api of server and decodes json response into v, when not nil
+func adminRequest(t *testing.T, server *Server, method string, path string, body any, v any) int {
+	t.Helper()
+
+	var reader bytes.Buffer
+	if nil != body {
+		if err := json.NewEncoder(&reader).Encode(body); nil != err {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", loopback(server.Addrs().Admin), path), &reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if nil != err {
+		t.Fatalf("Admin request %s %s failed: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if nil != v {
+		if err := json.NewDecoder(resp.Body).Decode(v); nil != err {
+			t.Fatalf("Admin response of %s %s is not json: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func startAdminTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	conf := testConfiguration()
+	conf.Admin = AdminConf{Enabled: true, Port: 0, Token: testAdminToken}
+	// set only to be redacted by /config, the cluster stays disabled
+	conf.Cluster.Secret = "s3cret"
+	return startTestServer(t, conf, nil)
+}
+
+func TestAdminAuth(t *testing.T) {
+	server := startAdminTestServer(t)
+	url := fmt.Sprintf("http://%s/info", loopback(server.Addrs().Admin))
+
+	for name, header := range map[string]string{
+		"missing token should be rejected": "",
+		"wrong token should be rejected":   "Bearer guess",
+		"basic auth should be rejected":    "Basic c2VjcmV0",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, expected %d", name, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	var info BuildInfo
+	if status := adminRequest(t, server, http.MethodGet, "/info", nil, &info); status != http.StatusOK {
+		t.Fatalf("Info status %d, expected %d", status, http.StatusOK)
+	}
+	if info.Version != Version || info.Env != Env {
+		t.Errorf("Info %+v is not same as build info", info)
+	}
+
+	var conf Configuration
+	adminRequest(t, server, http.MethodGet, "/config", nil, &conf)
+	if conf.Admin.Token != REDACTED {
+		t.Errorf("Admin token %q is not redacted", conf.Admin.Token)
+	}
+	if conf.Cluster.Secret != REDACTED {
+		t.Errorf("Cluster secret %q is not redacted", conf.Cluster.Secret)
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	server := startTestServer(t, testConfiguration(), nil)
+	if nil != server.Addrs().Admin {
+		t.Errorf("Admin listener %s is bound while disabled", server.Addrs().Admin)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	server := startAdminTestServer(t)
+	defer LogLevel.Set(slog.LevelInfo)
+
+	var level logLevelBody
+	if status := adminRequest(t, server, http.MethodPut, "/loglevel", logLevelBody{Level: "debug"}, &level); status != http.StatusOK {
+		t.Fatalf("Log level change status %d, expected %d", status, http.StatusOK)
+	}
+	if LogLevel.Level() != slog.LevelDebug || level.Level != "debug" {
+		t.Errorf("Log level is %s, reported %s, expected debug", LogLevel.Level(), level.Level)
+	}
+	if status := adminRequest(t, server, http.MethodPut, "/loglevel", logLevelBody{Level: "verbose"}, nil); status != http.StatusBadRequest {
+		t.Errorf("Unknown log level status %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestAdminACL(t *testing.T) {
+	server := startAdminTestServer(t)
+	addr := loopback(server.Addrs().Udp)
+	entry := aclEntryBody{List: ACL_DENY, CIDR: "127.0.0.0/8"}
+
+	var acl AclConf
+	if status := adminRequest(t, server, http.MethodPost, "/acl", entry, &acl); status != http.StatusOK {
+		t.Fatalf("Acl add status %d, expected %d", status, http.StatusOK)
+	}
+	if len(acl.Deny) != 1 || acl.Deny[0] != entry.CIDR {
+		t.Errorf("Deny list %v does not have %s", acl.Deny, entry.CIDR)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, _, err := QueryMappedAddress(ctx, TRANSPORT_UDP, addr, nil); nil == err {
+		t.Error("Denied client is answered")
+	}
+
+	if status := adminRequest(t, server, http.MethodDelete, "/acl", entry, &acl); status != http.StatusOK {
+		t.Fatalf("Acl remove status %d, expected %d", status, http.StatusOK)
+	}
+	if _, _, err := QueryMappedAddress(context.Background(), TRANSPORT_UDP, addr, nil); nil != err {
+		t.Errorf("Client is not answered after deny entry is removed: %s", err)
+	}
+
+	if status := adminRequest(t, server, http.MethodPost, "/acl", aclEntryBody{List: ACL_DENY, CIDR: "any"}, nil); status != http.StatusBadRequest {
+		t.Errorf("Invalid acl entry status %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestAdminConnections(t *testing.T) {
+	server := startAdminTestServer(t)
+
+	conn, err := net.Dial("tcp", loopback(server.Addrs().Tcp))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// readiness probes may have connections open too
+	var conns []ConnInfo
+	found := false
+	for deadline := time.Now().Add(time.Second); !found && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		adminRequest(t, server, http.MethodGet, "/connections", nil, &conns)
+		for _, c := range conns {
+			found = found || (c.RemoteAddr == conn.LocalAddr().String() && c.Transport == TRANSPORT_TCP)
+		}
+	}
+	if !found {
+		t.Errorf("Connections %+v do not list %s", conns, conn.LocalAddr())
+	}
+}
+
+func TestAdminKeepalives(t *testing.T) {
+	server := startAdminTestServer(t)
+	conn, err := net.Dial("udp", loopback(server.Addrs().Udp))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	indication := &Message{Type: BINDING_INDICATION, Cookie: MESAGE_COOKIE}
+	if _, err := conn.Write(indication.Encode()); nil != err {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		var keepalives []ClientKeepalive
+		if status := adminRequest(t, server, http.MethodGet, "/keepalives", nil, &keepalives); status != http.StatusOK {
+			t.Fatalf("Keepalives status %d, expected %d", status, http.StatusOK)
+		}
+		if len(keepalives) == 1 && keepalives[0].RemoteAddr == conn.LocalAddr().String() && keepalives[0].Indications == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Keepalives %+v do not list the indication of %s", keepalives, conn.LocalAddr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	server := startAdminTestServer(t)
+	waitReady(t, server)
+
+	if status := adminRequest(t, server, http.MethodPost, "/drain", nil, nil); status != http.StatusAccepted {
+		t.Fatalf("Drain status %d, expected %d", status, http.StatusAccepted)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", loopback(server.Addrs().Monitoring), READYZ_PATH))
+	if nil != err {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Readiness status %d while draining, expected %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	// draining server keeps serving
+	bindingRequest(t, TRANSPORT_UDP, loopback(server.Addrs().Udp))
+}
@@ -0,0 +1,79 @@
+package stun
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/sifaserdarozen/stun/uri"
+)
+
+type AdvertiseConf struct {
+	// Host is the name or ip clients reach the server with, the listener ip or the host name
+	// of the machine when empty
+	Host string
+}
+
+func (self AdvertiseConf) String() string {
+	return fmt.Sprintf("{Host: %s}", self.Host)
+}
+
+// advertisedHost returns host if set, or else the ip of addr unless it is unspecified, or else
+// the name of the machine
+func advertisedHost(host string, addr net.Addr) string {
+	if host != "" {
+		return host
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	if nil != ip && !ip.IsUnspecified() {
+		return ip.String()
+	}
+	if name, err := os.Hostname(); nil == err {
+		return name
+	}
+	return "localhost"
+}
+
+func addrPort(addr net.Addr) int {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.Port
+	case *net.TCPAddr:
+		return addr.Port
+	}
+	return 0
+}
+
+// advertisedURIs returns the stun URIs of the stun listeners in addrs, udp and tcp listeners on
+// the same port sharing one
+func advertisedURIs(host string, addrs Addrs) []uri.URI {
+	var uris []uri.URI
+	add := func(u uri.URI) {
+		for _, known := range uris {
+			if known == u {
+				return
+			}
+		}
+		uris = append(uris, u)
+	}
+	for _, addr := range []net.Addr{addrs.Udp, addrs.Tcp} {
+		if nil != addr {
+			add(uri.URI{Scheme: uri.SCHEME_STUN, Host: advertisedHost(host, addr), Port: addrPort(addr)})
+		}
+	}
+	if nil != addrs.Tls {
+		add(uri.URI{Scheme: uri.SCHEME_STUNS, Host: advertisedHost(host, addrs.Tls), Port: addrPort(addrs.Tls)})
+	}
+	return uris
+}
+
+// URIs returns the stun and stuns URIs clients reach the server with, once it is started
+func (self *Server) URIs() []uri.URI {
+	return advertisedURIs(self.conf.Advertise.Host, self.Addrs())
+}
@@ -0,0 +1,90 @@
+package stun
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sifaserdarozen/stun/uri"
+)
+
+func TestAdvertisedURIs(t *testing.T) {
+	hostname, err := os.Hostname()
+	if nil != err {
+		t.Fatal(err)
+	}
+	udp := &net.UDPAddr{IP: net.IPv4zero, Port: 3478}
+	tcp := &net.TCPAddr{IP: net.IPv4zero, Port: 3478}
+	tls := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5349}
+
+	tests := map[string]struct {
+		host  string
+		addrs Addrs
+		uris  []string
+	}{
+		"udp and tcp on same port share a uri": {
+			host:  "stun.example.org",
+			addrs: Addrs{Udp: udp, Tcp: tcp, Tls: tls},
+			uris:  []string{"stun:stun.example.org:3478", "stuns:stun.example.org:5349"},
+		},
+		"udp and tcp on different ports": {
+			host:  "192.0.2.1",
+			addrs: Addrs{Udp: udp, Tcp: &net.TCPAddr{IP: net.IPv4zero, Port: 3479}},
+			uris:  []string{"stun:192.0.2.1:3478", "stun:192.0.2.1:3479"},
+		},
+		"listener ip is advertised without host": {
+			addrs: Addrs{Tls: tls},
+			uris:  []string{"stuns:[2001:db8::1]:5349"},
+		},
+		"machine name is advertised for unspecified ip": {
+			addrs: Addrs{Udp: udp},
+			uris:  []string{fmt.Sprintf("stun:%s:3478", hostname)},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			uris := advertisedURIs(test.host, test.addrs)
+			if len(uris) != len(test.uris) {
+				t.Fatalf("advertised %v, expected %v", uris, test.uris)
+			}
+			for i, u := range uris {
+				if u.String() != test.uris[i] {
+					t.Errorf("advertised %s, expected %s", u, test.uris[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQueryURI(t *testing.T) {
+	conf := testConfiguration()
+	conf.Advertise.Host = "127.0.0.1"
+	server := startTestServer(t, conf, nil)
+
+	uris := server.URIs()
+	if len(uris) != 2 {
+		t.Fatalf("server advertises %v, expected a uri for each of udp and tcp", uris)
+	}
+	tcp := uris[1]
+	tcp.Scheme, tcp.Transport = uri.SCHEME_TURN, uri.TRANSPORT_TCP
+
+	for _, u := range []uri.URI{uris[0], tcp} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		ip, port, err := QueryURI(ctx, u, nil)
+		cancel()
+		if nil != err {
+			t.Fatalf("%s query failed: %s", u, err)
+		}
+		if !ip.IsLoopback() || port == 0 {
+			t.Errorf("%s reported %s:%d", u, ip, port)
+		}
+	}
+
+	dtls := uri.URI{Scheme: uri.SCHEME_TURNS, Host: "127.0.0.1", Port: uris[0].Port, Transport: uri.TRANSPORT_UDP}
+	if _, _, err := QueryURI(context.Background(), dtls, nil); nil == err {
+		t.Errorf("%s query should fail", dtls)
+	}
+}
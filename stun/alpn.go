@@ -0,0 +1,33 @@
+package stun
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// application protocols of stun over tls, RFC 7443 section 6
+const (
+	ALPN_TURN          = "stun.turn"
+	ALPN_NAT_DISCOVERY = "stun.nat-discovery"
+)
+
+var ErrNoAlpn = errors.New("client negotiated no application protocol")
+
+// alpnProtocols are the application protocols the tls listener may advertise
+var alpnProtocols = []string{ALPN_TURN, ALPN_NAT_DISCOVERY}
+
+// tlsConfig serves cert and advertises the configured application protocols. Clients offering
+// none of them fail the handshake, and so do clients offering none at all when ALPN is required,
+// so a tls router sharing the port with other protocols can not send anything else to the server.
+func tlsConfig(conf TlsConf, cert tls.Certificate) *tls.Config {
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: conf.Alpn}
+	if conf.RequireAlpn {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if state.NegotiatedProtocol == "" {
+				return ErrNoAlpn
+			}
+			return nil
+		}
+	}
+	return config
+}
@@ -0,0 +1,172 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sifaserdarozen/stun/uri"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestAlpn(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+
+	var mu sync.Mutex
+	var negotiated []string
+	record := func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			mu.Lock()
+			negotiated = append(negotiated, r.ALPN())
+			mu.Unlock()
+			next.ServeSTUN(w, r)
+		})
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if nil != err {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	conf := TlsConf{Alpn: []string{ALPN_TURN, ALPN_NAT_DISCOVERY}, RequireAlpn: true}
+	metrics := NewMetrics()
+	// served without a Server, whose readiness probes would be counted too
+	ctx, cancel := context.WithCancel(context.Background())
+	sup := NewSupervisor(ctx)
+	TcpStart(sup, tls.NewListener(l, tlsConfig(conf, cert)), TRANSPORT_TLS, Chain(BindingHandler(), record), metrics, NewConnections())
+	defer func() {
+		cancel()
+		sup.Wait()
+	}()
+	addr := l.Addr().String()
+
+	testCases := map[string]struct {
+		offered    []string
+		negotiated string
+		fails      bool
+	}{
+		"turn should be negotiated":          {offered: []string{ALPN_TURN}, negotiated: ALPN_TURN},
+		"nat discovery should be negotiated": {offered: []string{"h2", ALPN_NAT_DISCOVERY}, negotiated: ALPN_NAT_DISCOVERY},
+		"server preference should win":       {offered: []string{ALPN_NAT_DISCOVERY, ALPN_TURN}, negotiated: ALPN_TURN},
+		"other protocols should be rejected": {offered: []string{"h2", "http/1.1"}, fails: true},
+		"no protocol should be rejected":     {fails: true},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			mu.Lock()
+			negotiated = nil
+			mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: test.offered}
+			_, _, err := QueryMappedAddress(ctx, TRANSPORT_TLS, addr, tlsConfig)
+			if test.fails {
+				if nil == err {
+					t.Fatal("Expected the handshake to fail")
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Query failed: %s", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(negotiated) != 1 || negotiated[0] != test.negotiated {
+				t.Errorf("Handler saw protocols %v, expected %s", negotiated, test.negotiated)
+			}
+		})
+	}
+
+	mfs, err := metrics.Registry.Gather()
+	if nil != err {
+		t.Fatal(err)
+	}
+	mf := map[string]*dto.MetricFamily{}
+	for _, f := range mfs {
+		mf[f.GetName()] = f
+	}
+	for labels, expected := range map[[2]string]float64{
+		{ALPN_TURN, "success"}:          2,
+		{ALPN_NAT_DISCOVERY, "success"}: 1,
+		{ALPN_NONE, "failure"}:          2,
+	} {
+		value := counterValue(mf, "lstun_tls_handshakes_total", map[string]string{"protocol": labels[0], "result": labels[1]})
+		if value != expected {
+			t.Errorf("lstun_tls_handshakes_total %v is %v, expected %v", labels, value, expected)
+		}
+	}
+}
+
+func TestAlpnOptional(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	conf := testConfiguration()
+	conf.Tls = TlsConf{Enabled: true, CertFile: certFile, KeyFile: keyFile, Alpn: []string{ALPN_NAT_DISCOVERY}}
+	bound := startTestServer(t, conf, BindingHandler()).Addrs().Tls
+	addr := loopback(bound)
+	port := bound.(*net.TCPAddr).Port
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := QueryMappedAddress(ctx, TRANSPORT_TLS, addr, &tls.Config{InsecureSkipVerify: true}); nil != err {
+		t.Errorf("Client offering no protocol should be served, got %s", err)
+	}
+	// a protocol not advertised is still rejected, RFC 7301 section 3.2
+	_, _, err := QueryMappedAddress(ctx, TRANSPORT_TLS, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPN_TURN}})
+	if nil == err {
+		t.Error("Client offering only turn should be rejected")
+	}
+
+	// uris offer the protocol of their scheme
+	insecure := &tls.Config{InsecureSkipVerify: true}
+	if _, _, err := QueryURI(ctx, uri.URI{Scheme: uri.SCHEME_STUNS, Host: "127.0.0.1", Port: port}, insecure); nil != err {
+		t.Errorf("stuns query should negotiate nat discovery, got %s", err)
+	}
+	if _, _, err := QueryURI(ctx, uri.URI{Scheme: uri.SCHEME_TURNS, Host: "127.0.0.1", Port: port}, insecure); nil == err {
+		t.Error("turns query should offer turn only and be rejected")
+	}
+}
+
+func TestValidateAlpn(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+
+	testCases := map[string]struct {
+		alpn     []string
+		require  bool
+		problems int
+	}{
+		"both protocols should be valid":       {alpn: alpnProtocols, require: true},
+		"no protocol should be valid":          {},
+		"unknown protocol should be rejected":  {alpn: []string{ALPN_TURN, "h2"}, problems: 1},
+		"repeated protocol should be rejected": {alpn: []string{ALPN_TURN, ALPN_TURN}, problems: 1},
+		"requiring no protocol should fail":    {require: true, problems: 1},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			conf := validConfiguration()
+			conf.Tls = TlsConf{Enabled: true, Port: DEFAULT_TLS_PORT, CertFile: certFile, KeyFile: keyFile, Alpn: test.alpn, RequireAlpn: test.require}
+			err := conf.Validate()
+			if test.problems == 0 {
+				if nil != err {
+					t.Errorf("Expected valid configuration, got error: %s", err)
+				}
+				return
+			}
+			var confErr *ConfigurationError
+			if !errors.As(err, &confErr) || len(confErr.Problems) != test.problems {
+				t.Errorf("Expected %d problems, got %v", test.problems, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package stun
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redirect reasons, logged and reported to callers of Redirect
+const (
+	REDIRECT_RULE     = "rule"
+	REDIRECT_DRAINING = "draining"
+	REDIRECT_OVERLOAD = "overload"
+)
+
+// AlternateRule redirects clients in Prefix to Server, and Domain for tls clients
+type AlternateRule struct {
+	Prefix string
+	Server string
+	Domain string
+}
+
+type AlternateConf struct {
+	// Server is the ip:port clients are redirected to when draining or overloaded
+	Server string
+	// Domain is sent as ALTERNATE-DOMAIN to tls clients, for certificate validation of Server
+	Domain string
+	// OnDrain redirects every request while the server is draining
+	OnDrain bool `mapstructure:"on_drain"`
+	// MaxRate is the requests per second served before redirecting the rest, 0 disables it
+	MaxRate int `mapstructure:"max_rate"`
+	// Rules redirect clients by source prefix, first matching rule wins
+	Rules []AlternateRule
+}
+
+func (self AlternateConf) String() string {
+	return fmt.Sprintf("{Server: %s, Domain: %s, OnDrain: %t, MaxRate: %d, Rules: %v}", self.Server, self.Domain, self.OnDrain, self.MaxRate, self.Rules)
+}
+
+// Enabled reports whether any redirection is configured
+func (self AlternateConf) Enabled() bool {
+	return len(self.Rules) > 0 || (self.Server != "" && (self.OnDrain || self.MaxRate > 0))
+}
+
+// parseIPPort parses an ip:port, host names are not allowed as ALTERNATE-SERVER and peers carry addresses
+func parseIPPort(server string) (net.IP, uint16, error) {
+	host, port, err := net.SplitHostPort(server)
+	if nil != err {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	if nil == ip {
+		return nil, 0, fmt.Errorf("%q is not an ip address", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if nil != err || p == 0 {
+		return nil, 0, fmt.Errorf("%q is not a valid port", port)
+	}
+	return ip, uint16(p), nil
+}
+
+// alternateTarget is a parsed redirect destination
+type alternateTarget struct {
+	ip     net.IP
+	port   uint16
+	domain string
+}
+
+func newAlternateTarget(server string, domain string) (*alternateTarget, error) {
+	ip, port, err := parseIPPort(server)
+	if nil != err {
+		return nil, err
+	}
+	return &alternateTarget{ip: ip, port: port, domain: domain}, nil
+}
+
+type alternateRule struct {
+	prefix *net.IPNet
+	target *alternateTarget
+}
+
+// rateMeter counts events in the current second
+type rateMeter struct {
+	mu     sync.Mutex
+	second int64
+	count  int
+}
+
+// add counts an event and returns the number of events in the current second
+func (self *rateMeter) add(now time.Time) int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if second := now.Unix(); second != self.second {
+		self.second = second
+		self.count = 0
+	}
+	self.count++
+	return self.count
+}
+
+// Redirector answers requests with 300 Try Alternate when a rule matches the client, the
+// server is draining or the request rate is above the configured limit
+type Redirector struct {
+	target   *alternateTarget
+	rules    []alternateRule
+	onDrain  bool
+	maxRate  int
+	draining func() bool
+	meter    rateMeter
+}
+
+// NewRedirector creates a redirector as configured, draining reports the drain state of the server
+func NewRedirector(conf AlternateConf, draining func() bool) (*Redirector, error) {
+	self := &Redirector{onDrain: conf.OnDrain, maxRate: conf.MaxRate, draining: draining}
+	if conf.Server != "" {
+		target, err := newAlternateTarget(conf.Server, conf.Domain)
+		if nil != err {
+			return nil, fmt.Errorf("alternate server: %w", err)
+		}
+		self.target = target
+	}
+	for _, rule := range conf.Rules {
+		_, prefix, err := net.ParseCIDR(rule.Prefix)
+		if nil != err {
+			return nil, fmt.Errorf("alternate rule: %w", err)
+		}
+		target, err := newAlternateTarget(rule.Server, rule.Domain)
+		if nil != err {
+			return nil, fmt.Errorf("alternate rule %s: %w", rule.Prefix, err)
+		}
+		self.rules = append(self.rules, alternateRule{prefix: prefix, target: target})
+	}
+	return self, nil
+}
+
+// redirect returns where r should be redirected and why, nil if it should be served
+func (self *Redirector) redirect(r *Request) (*alternateTarget, string) {
+	ip, _ := r.RemoteIP()
+	for _, rule := range self.rules {
+		if rule.prefix.Contains(ip) {
+			return rule.target, REDIRECT_RULE
+		}
+	}
+	if nil == self.target {
+		return nil, ""
+	}
+	if self.onDrain && self.draining() {
+		return self.target, REDIRECT_DRAINING
+	}
+	if self.maxRate > 0 && self.meter.add(time.Now()) > self.maxRate {
+		return self.target, REDIRECT_OVERLOAD
+	}
+	return nil, ""
+}
+
+// Middleware redirects requests, indications are passed through as they get no response
+func (self *Redirector) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			if r.Message.Class() != CLASS_REQUEST {
+				next.ServeSTUN(w, r)
+				return
+			}
+			target, reason := self.redirect(r)
+			if nil == target {
+				next.ServeSTUN(w, r)
+				return
+			}
+
+			res := NewErrorResponse(r.Message, CODE_TRY_ALTERNATE, REASON_TRY_ALTERNATE)
+			value, err := AddressValue(target.ip, target.port)
+			if nil != err {
+				slog.Warn("Alternate server encoding failed", "error", err)
+				next.ServeSTUN(w, r)
+				return
+			}
+			res.Add(ALTERNATE_SERVER, value)
+			// domain is only useful to validate the certificate of the alternate server
+			if target.domain != "" && r.Transport == TRANSPORT_TLS {
+				res.Add(ALTERNATE_DOMAIN, []byte(target.domain))
+			}
+
+			slog.Debug("Request redirected", "reason", reason, "remote_addr", r.RemoteAddr, "alternate", net.JoinHostPort(target.ip.String(), strconv.Itoa(int(target.port))))
+			if err := w.Write(res); nil != err {
+				slog.Debug("Response write failed", "transport", r.Transport, "remote_addr", r.RemoteAddr, "error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedirector(t *testing.T) {
+	req, err := DecodeMessage(rfc5769Request)
+	if nil != err {
+		t.Fatal(err)
+	}
+	indication := &Message{Type: BINDING_INDICATION, Cookie: MESAGE_COOKIE, ID: req.ID}
+
+	conf := AlternateConf{
+		Server:  "192.0.2.10:3478",
+		Domain:  "stun.example.org",
+		OnDrain: true,
+		Rules:   []AlternateRule{{Prefix: "10.0.0.0/8", Server: "192.0.2.20:3478", Domain: "eu.example.org"}},
+	}
+	inside := &net.UDPAddr{IP: net.IPv4(10, 0, 4, 128), Port: 32657}
+	outside := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 32657}
+
+	testCases := map[string]struct {
+		msg       *Message
+		transport string
+		addr      net.Addr
+		draining  bool
+		server    string
+		domain    string
+	}{
+		"client in rule prefix should be redirected":         {msg: req, transport: TRANSPORT_UDP, addr: inside, server: "192.0.2.20:3478"},
+		"client out of rules should be served":               {msg: req, transport: TRANSPORT_UDP, addr: outside},
+		"client should be redirected while draining":         {msg: req, transport: TRANSPORT_UDP, addr: outside, draining: true, server: "192.0.2.10:3478"},
+		"alternate domain should be sent over tls":           {msg: req, transport: TRANSPORT_TLS, addr: outside, draining: true, server: "192.0.2.10:3478", domain: "stun.example.org"},
+		"indication should be passed through while draining": {msg: indication, transport: TRANSPORT_UDP, addr: outside, draining: true},
+	}
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			redirector, err := NewRedirector(conf, func() bool { return test.draining })
+			if nil != err {
+				t.Fatal(err)
+			}
+			served := false
+			handler := Chain(HandlerFunc(func(w ResponseWriter, r *Request) { served = true }), redirector.Middleware())
+
+			w := &recordingWriter{}
+			handler.ServeSTUN(w, &Request{Message: test.msg, Transport: test.transport, RemoteAddr: test.addr})
+
+			if test.server == "" {
+				if !served || len(w.messages) != 0 {
+					t.Fatalf("Request should be served, served %t with %d messages", served, len(w.messages))
+				}
+				return
+			}
+			if served || len(w.messages) != 1 {
+				t.Fatalf("Request should be redirected, served %t with %d messages", served, len(w.messages))
+			}
+
+			res := w.messages[0]
+			value, _ := res.Get(ERROR_CODE)
+			if code, _, err := ParseErrorCode(value); nil != err || code != CODE_TRY_ALTERNATE {
+				t.Errorf("Error code is %d (%v), expected %d", code, err, CODE_TRY_ALTERNATE)
+			}
+			value, ok := res.Get(ALTERNATE_SERVER)
+			if !ok {
+				t.Fatal("Alternate server is missing")
+			}
+			ip, port, err := ParseAddress(value)
+			if nil != err {
+				t.Fatal(err)
+			}
+			if server := (&net.UDPAddr{IP: ip, Port: int(port)}).String(); server != test.server {
+				t.Errorf("Alternate server is %s, expected %s", server, test.server)
+			}
+			domain, _ := res.Get(ALTERNATE_DOMAIN)
+			if string(domain) != test.domain {
+				t.Errorf("Alternate domain is %q, expected %q", domain, test.domain)
+			}
+		})
+	}
+}
+
+func TestRedirectorOverload(t *testing.T) {
+	req, err := DecodeMessage(rfc5769Request)
+	if nil != err {
+		t.Fatal(err)
+	}
+	redirector, err := NewRedirector(AlternateConf{Server: "192.0.2.10:3478", MaxRate: 2}, func() bool { return false })
+	if nil != err {
+		t.Fatal(err)
+	}
+	handler := Chain(BindingHandler(), redirector.Middleware())
+	request := &Request{Message: req, Transport: TRANSPORT_UDP, RemoteAddr: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 32657}}
+
+	// the meter restarts every second, retry if the requests straddled a boundary
+	for attempt := 0; attempt < 3; attempt++ {
+		w := &recordingWriter{}
+		second := time.Now().Unix()
+		for i := 0; i < 3; i++ {
+			handler.ServeSTUN(w, request)
+		}
+		if time.Now().Unix() != second {
+			continue
+		}
+
+		if len(w.messages) != 3 {
+			t.Fatalf("%d messages sent, expected 3", len(w.messages))
+		}
+		for i, res := range w.messages {
+			_, redirected := res.Get(ALTERNATE_SERVER)
+			if redirected != (i == 2) {
+				t.Errorf("Request %d redirected is %t, only the one over max rate should be", i, redirected)
+			}
+		}
+		return
+	}
+	t.Fatal("Requests did not fit in a second")
+}
+
+func TestRateMeter(t *testing.T) {
+	var meter rateMeter
+	start := time.Unix(1700000000, 0)
+	if n := meter.add(start); n != 1 {
+		t.Errorf("First event counted as %d", n)
+	}
+	if n := meter.add(start.Add(500 * time.Millisecond)); n != 2 {
+		t.Errorf("Second event in the same second counted as %d", n)
+	}
+	if n := meter.add(start.Add(time.Second)); n != 1 {
+		t.Errorf("Event in the next second counted as %d, expected a restart", n)
+	}
+}
+
+func TestServerRedirectOnDrain(t *testing.T) {
+	conf := testConfiguration()
+	conf.Alternate = AlternateConf{Server: "192.0.2.10:3478", OnDrain: true}
+	server := startTestServer(t, conf, nil)
+	addr := loopback(server.Addrs().Udp)
+
+	if _, _, err := QueryMappedAddress(context.Background(), TRANSPORT_UDP, addr, nil); nil != err {
+		t.Fatalf("Request before drain failed: %s", err)
+	}
+
+	server.Drain()
+	_, _, err := QueryMappedAddress(context.Background(), TRANSPORT_UDP, addr, nil)
+	if nil == err || !strings.Contains(err.Error(), "error 300") {
+		t.Fatalf("Request while draining should be redirected, got %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package stun
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// authentication mechanisms of a request, see Identity
+const (
+	MECHANISM_LONG_TERM  = "long_term"
+	MECHANISM_OAUTH      = "oauth"
+	MECHANISM_SHORT_TERM = "short_term"
+)
+
+// NONCE_MAC_LEN is the length of the nonce authenticator in bytes
+const NONCE_MAC_LEN = 8
+
+type AuthConf struct {
+	// Enabled requires every request to be authenticated with the long-term credential mechanism
+	Enabled bool
+	Realm   string
+	// NonceLifetime is how long a nonce is accepted, after which 438 Stale Nonce is answered
+	NonceLifetime time.Duration `mapstructure:"nonce_lifetime"`
+	OAuth         OAuthConf
+	Rest          RestConf
+	File          FileCredentialsConf
+	Sqlite        SqliteConf
+	Http          CalloutConf
+}
+
+func (self AuthConf) String() string {
+	return fmt.Sprintf("{enabled: %t, Realm: %s, NonceLifetime: %s, OAuth: %s, Rest: %s, File: %s, Sqlite: %s, Http: %s}", self.Enabled, self.Realm, self.NonceLifetime, self.OAuth.String(), self.Rest.String(), self.File.String(), self.Sqlite.String(), self.Http.String())
+}
+
+// nonceIssuer issues nonces carrying their issue time, authenticated with a process secret so
+// that they need not be stored
+type nonceIssuer struct {
+	secret   []byte
+	lifetime time.Duration
+}
+
+func newNonceIssuer(lifetime time.Duration) (*nonceIssuer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); nil != err {
+		return nil, err
+	}
+	return &nonceIssuer{secret: secret, lifetime: lifetime}, nil
+}
+
+func (self *nonceIssuer) mac(issued []byte) []byte {
+	mac := hmac.New(sha256.New, self.secret)
+	mac.Write(issued)
+	return mac.Sum(nil)[:NONCE_MAC_LEN]
+}
+
+func (self *nonceIssuer) issue(now time.Time) string {
+	issued := binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))
+	return hex.EncodeToString(append(issued, self.mac(issued)...))
+}
+
+// check returns whether nonce is issued by this issuer, and whether it is stale
+func (self *nonceIssuer) check(nonce string, now time.Time) (bool, bool) {
+	buf, err := hex.DecodeString(nonce)
+	if nil != err || len(buf) != 8+NONCE_MAC_LEN {
+		return false, false
+	}
+	if !hmac.Equal(buf[8:], self.mac(buf[:8])) {
+		return false, false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(buf[:8])), 0)
+	return true, now.Sub(issued) > self.lifetime
+}
+
+// CredentialStore provides the passwords of users for the long-term credential mechanism
+type CredentialStore interface {
+	// Passwords returns the passwords username may authenticate with, none for unknown users.
+	// More than one is returned e.g. while secrets are rotated.
+	Passwords(ctx context.Context, username string) ([]string, error)
+}
+
+// runner is implemented by credential stores working in the background, e.g. to reload
+type runner interface {
+	run(sup *Supervisor)
+}
+
+// LongTermKey returns the message integrity key of the long-term credential mechanism,
+// MD5(username ":" realm ":" password)
+func LongTermKey(username string, realm string, password string) []byte {
+	key := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return key[:]
+}
+
+// Identity is the authenticated user of a request
+type Identity struct {
+	Username  string
+	Realm     string
+	Mechanism string
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity of an authenticated request, see Request.Context
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+type integrityKey struct{}
+
+// withAuthentication marks a request authenticated as identity, its responses are signed with key
+func withAuthentication(ctx context.Context, identity *Identity, key []byte) context.Context {
+	return context.WithValue(withIdentity(ctx, identity), integrityKey{}, key)
+}
+
+// authenticationFromContext returns the identity and message integrity key of a request
+// authenticated by an Authenticator, here or on the cluster peer that forwarded it
+func authenticationFromContext(ctx context.Context) (*Identity, []byte, bool) {
+	key, ok := ctx.Value(integrityKey{}).([]byte)
+	if !ok {
+		return nil, nil, false
+	}
+	identity, ok := IdentityFromContext(ctx)
+	return identity, key, ok
+}
+
+// integrityWriter adds MESSAGE-INTEGRITY to responses of authenticated requests
+type integrityWriter struct {
+	ResponseWriter
+	key []byte
+}
+
+func (self *integrityWriter) Write(res *Message) error {
+	res.AddMessageIntegrity(self.key)
+	return self.ResponseWriter.Write(res)
+}
+
+// Authenticator applies the long-term credential mechanism of RFC 5389 to requests, with
+// passwords from credential stores or keys from OAuth access tokens of RFC 7635
+type Authenticator struct {
+	realm       string
+	nonces      *nonceIssuer
+	oauth       *OAuth
+	credentials []CredentialStore
+}
+
+// NewAuthenticator creates an authenticator as configured, loading the oauth key file if set.
+// Further credential stores are tried in order after the configured ones.
+func NewAuthenticator(conf AuthConf, stores ...CredentialStore) (*Authenticator, error) {
+	nonces, err := newNonceIssuer(conf.NonceLifetime)
+	if nil != err {
+		return nil, fmt.Errorf("nonce secret generation failed: %w", err)
+	}
+	self := &Authenticator{realm: conf.Realm, nonces: nonces}
+	if conf.OAuth.Enabled() {
+		oauth, err := NewOAuth(conf.OAuth)
+		if nil != err {
+			return nil, err
+		}
+		self.oauth = oauth
+	}
+	if conf.Rest.Enabled() {
+		self.credentials = append(self.credentials, NewRestCredentials(conf.Rest))
+	}
+	if conf.File.Enabled() {
+		file, err := NewFileCredentials(conf.File)
+		if nil != err {
+			return nil, err
+		}
+		self.credentials = append(self.credentials, file)
+	}
+	if conf.Sqlite.Enabled() {
+		db, err := NewSqliteCredentials(conf.Sqlite)
+		if nil != err {
+			return nil, err
+		}
+		self.credentials = append(self.credentials, db)
+	}
+	if conf.Http.Enabled() {
+		self.credentials = append(self.credentials, NewCalloutCredentials(conf.Http, conf.Realm))
+	}
+	self.credentials = append(self.credentials, stores...)
+	return self, nil
+}
+
+// run starts the background work of the credential stores, stopped with sup
+func (self *Authenticator) run(sup *Supervisor) {
+	for _, store := range self.credentials {
+		if runner, ok := store.(runner); ok {
+			runner.run(sup)
+		}
+	}
+}
+
+// Close closes the credential stores holding resources, once no more requests are authenticated
+func (self *Authenticator) Close() error {
+	var errs []error
+	for _, store := range self.credentials {
+		if closer, ok := store.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// challenge answers req with code, giving a fresh nonce and the realm to retry with
+func (self *Authenticator) challenge(w ResponseWriter, req *Message, code int, reason string) {
+	res := NewErrorResponse(req, code, reason)
+	res.Add(REALM, []byte(self.realm))
+	res.Add(NONCE, []byte(self.nonces.issue(time.Now())))
+	if nil != self.oauth && code == CODE_UNAUTHORIZED {
+		res.Add(THIRD_PARTY_AUTH, []byte(self.oauth.authorizationServer))
+	}
+	w.Write(res)
+}
+
+// authenticate returns the message integrity key and identity of a request whose integrity
+// checks with the credentials of username, nil if none does
+func (self *Authenticator) authenticate(ctx context.Context, req *Message, username string) ([]byte, *Identity) {
+	if token, ok := req.Get(ACCESS_TOKEN); ok && nil != self.oauth {
+		// the username of an oauth request is the key id of its token
+		macKey, err := self.oauth.Open(username, token, time.Now())
+		if nil != err {
+			slog.Debug("Access token rejected", "kid", username, "error", err)
+			return nil, nil
+		}
+		if nil != req.CheckMessageIntegrity(macKey) {
+			return nil, nil
+		}
+		return macKey, &Identity{Username: username, Realm: self.realm, Mechanism: MECHANISM_OAUTH}
+	}
+
+	for _, store := range self.credentials {
+		passwords, err := store.Passwords(ctx, username)
+		if nil != err {
+			slog.Warn("Credential lookup failed", "username", username, "error", err)
+			continue
+		}
+		for _, password := range passwords {
+			key := LongTermKey(username, self.realm, password)
+			if nil == req.CheckMessageIntegrity(key) {
+				return key, &Identity{Username: username, Realm: self.realm, Mechanism: MECHANISM_LONG_TERM}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Middleware answers requests that are not authenticated with 401 Unauthorized, and adds
+// MESSAGE-INTEGRITY to responses of authenticated ones. Indications are passed through as
+// they get no response to authenticate. Requests forwarded by a cluster peer are authenticated
+// by the peer already, their responses are only signed.
+func (self *Authenticator) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			req := r.Message
+			if req.Class() != CLASS_REQUEST {
+				next.ServeSTUN(w, r)
+				return
+			}
+			if _, key, ok := authenticationFromContext(r.Context()); ok {
+				next.ServeSTUN(&integrityWriter{ResponseWriter: w, key: key}, r)
+				return
+			}
+			if _, ok := req.Get(MESSAGE_INTEGRITY); !ok {
+				self.challenge(w, req, CODE_UNAUTHORIZED, REASON_UNAUTHORIZED)
+				return
+			}
+
+			username, hasUsername := req.Get(USERNAME)
+			realm, hasRealm := req.Get(REALM)
+			nonce, hasNonce := req.Get(NONCE)
+			if !hasUsername || !hasRealm || !hasNonce {
+				w.Write(NewErrorResponse(req, CODE_BAD_REQUEST, REASON_BAD_REQUEST))
+				return
+			}
+			valid, stale := self.nonces.check(string(nonce), time.Now())
+			if !valid || string(realm) != self.realm {
+				self.challenge(w, req, CODE_UNAUTHORIZED, REASON_UNAUTHORIZED)
+				return
+			}
+			if stale {
+				self.challenge(w, req, CODE_STALE_NONCE, REASON_STALE_NONCE)
+				return
+			}
+
+			key, identity := self.authenticate(r.Context(), req, string(username))
+			if nil == key {
+				self.challenge(w, req, CODE_UNAUTHORIZED, REASON_UNAUTHORIZED)
+				return
+			}
+
+			next.ServeSTUN(&integrityWriter{ResponseWriter: w, key: key}, r.WithContext(withAuthentication(r.Context(), identity, key)))
+		})
+	}
+}
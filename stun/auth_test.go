@@ -0,0 +1,194 @@
+package stun
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNonceIssuer(t *testing.T) {
+	nonces, err := newNonceIssuer(time.Minute)
+	if nil != err {
+		t.Fatal(err)
+	}
+	other, err := newNonceIssuer(time.Minute)
+	if nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := map[string]struct {
+		nonce string
+		valid bool
+		stale bool
+	}{
+		"fresh nonce":            {nonce: nonces.issue(now), valid: true},
+		"stale nonce":            {nonce: nonces.issue(now.Add(-2 * time.Minute)), valid: true, stale: true},
+		"nonce of other issuer":  {nonce: other.issue(now)},
+		"nonce with forged time": {nonce: nonces.issue(now)[:8] + "00000000" + nonces.issue(now)[16:]},
+		"not hex":                {nonce: "nonce"},
+		"short nonce":            {nonce: nonces.issue(now)[:20]},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			valid, stale := nonces.check(test.nonce, now)
+			if valid != test.valid || stale != test.stale {
+				t.Errorf("nonce %s checked as valid %t stale %t, expected %t %t", test.nonce, valid, stale, test.valid, test.stale)
+			}
+		})
+	}
+}
+
+// authRequest returns a binding request signed with key, carrying token when not nil
+func authRequest(t *testing.T, kid string, token []byte, realm string, nonce string, key []byte) *Message {
+	t.Helper()
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [12]byte{1, 2, 3}}
+	req.Add(USERNAME, []byte(kid))
+	req.Add(REALM, []byte(realm))
+	req.Add(NONCE, []byte(nonce))
+	if nil != token {
+		req.Add(ACCESS_TOKEN, token)
+	}
+	req.AddMessageIntegrity(key)
+	decoded, err := DecodeMessage(req.Encode())
+	if nil != err {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestAuthenticator(t *testing.T) {
+	conf := AuthConf{
+		Enabled:       true,
+		Realm:         "lstun",
+		NonceLifetime: time.Minute,
+		OAuth:         OAuthConf{KeyFile: writeOAuthKeys(t, testOAuthKeys), ServerName: "stun.example.org", AuthorizationServer: "https://as.example.org"},
+		Rest:          RestConf{Secrets: []string{"new-secret", "old-secret"}},
+	}
+	auth, err := NewAuthenticator(conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	macKey := bytes.Repeat([]byte{0x5a}, 20)
+	token, err := auth.oauth.Seal("north", AccessToken{MacKey: macKey, Timestamp: now, Lifetime: time.Hour})
+	if nil != err {
+		t.Fatal(err)
+	}
+	expired, err := auth.oauth.Seal("north", AccessToken{MacKey: macKey, Timestamp: now.Add(-2 * time.Hour), Lifetime: time.Hour})
+	if nil != err {
+		t.Fatal(err)
+	}
+	nonce := auth.nonces.issue(now)
+	staleNonce := auth.nonces.issue(now.Add(-2 * time.Minute))
+	rest := fmt.Sprintf("%d:alice", now.Add(time.Hour).Unix())
+	restExpired := fmt.Sprintf("%d:alice", now.Add(-time.Hour).Unix())
+	restKey := func(username string, secret string) []byte {
+		return LongTermKey(username, "lstun", RestPassword([]byte(secret), username))
+	}
+
+	unsigned := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}
+	incomplete := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}
+	incomplete.Add(USERNAME, []byte("north"))
+	incomplete.AddMessageIntegrity(macKey)
+	indication := &Message{Type: BINDING_INDICATION, Cookie: MESAGE_COOKIE}
+
+	tests := map[string]struct {
+		msg    *Message
+		served *Identity
+		key    []byte
+		code   int
+	}{
+		"indication should pass":                   {msg: indication},
+		"unsigned request should be challenged":    {msg: unsigned, code: CODE_UNAUTHORIZED},
+		"request without nonce should be rejected": {msg: incomplete, code: CODE_BAD_REQUEST},
+		"valid token should be served": {
+			msg:    authRequest(t, "north", token, "lstun", nonce, macKey),
+			served: &Identity{Username: "north", Realm: "lstun", Mechanism: MECHANISM_OAUTH},
+			key:    macKey,
+		},
+		"rest credentials should be served": {
+			msg:    authRequest(t, rest, nil, "lstun", nonce, restKey(rest, "new-secret")),
+			served: &Identity{Username: rest, Realm: "lstun", Mechanism: MECHANISM_LONG_TERM},
+			key:    restKey(rest, "new-secret"),
+		},
+		"rest credentials of rotated secret should be served": {
+			msg:    authRequest(t, rest, nil, "lstun", nonce, restKey(rest, "old-secret")),
+			served: &Identity{Username: rest, Realm: "lstun", Mechanism: MECHANISM_LONG_TERM},
+			key:    restKey(rest, "old-secret"),
+		},
+		"expired rest credentials should be challenged":           {msg: authRequest(t, restExpired, nil, "lstun", nonce, restKey(restExpired, "new-secret")), code: CODE_UNAUTHORIZED},
+		"rest credentials of unknown secret should be challenged": {msg: authRequest(t, rest, nil, "lstun", nonce, restKey(rest, "guess")), code: CODE_UNAUTHORIZED},
+		"stale nonce should be renewed":                           {msg: authRequest(t, "north", token, "lstun", staleNonce, macKey), code: CODE_STALE_NONCE},
+		"foreign nonce should be challenged":                      {msg: authRequest(t, "north", token, "lstun", "0011", macKey), code: CODE_UNAUTHORIZED},
+		"other realm should be challenged":                        {msg: authRequest(t, "north", token, "other", nonce, macKey), code: CODE_UNAUTHORIZED},
+		"expired token should be challenged":                      {msg: authRequest(t, "north", expired, "lstun", nonce, macKey), code: CODE_UNAUTHORIZED},
+		"unknown kid should be challenged":                        {msg: authRequest(t, "east", token, "lstun", nonce, macKey), code: CODE_UNAUTHORIZED},
+		"wrong mac key should be challenged":                      {msg: authRequest(t, "north", token, "lstun", nonce, []byte("wrong")), code: CODE_UNAUTHORIZED},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var identity *Identity
+			handler := auth.Middleware()(HandlerFunc(func(w ResponseWriter, r *Request) {
+				identity, _ = IdentityFromContext(r.Context())
+				if r.Message.Class() == CLASS_REQUEST {
+					w.Write(NewResponse(r.Message, CLASS_SUCCESS))
+				}
+			}))
+			w := &recordingWriter{}
+			handler.ServeSTUN(w, &Request{Message: test.msg, Transport: TRANSPORT_UDP, RemoteAddr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}})
+
+			if test.msg.Class() != CLASS_REQUEST {
+				if len(w.messages) != 0 || nil != identity {
+					t.Errorf("indication got %d responses and identity %v", len(w.messages), identity)
+				}
+				return
+			}
+			if len(w.messages) != 1 {
+				t.Fatalf("%d messages sent, expected 1", len(w.messages))
+			}
+			res, err := DecodeMessage(w.messages[0].Encode())
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			if nil != test.served {
+				if res.Class() != CLASS_SUCCESS {
+					t.Fatalf("response %s is not a success", res)
+				}
+				if err := res.CheckMessageIntegrity(test.key); nil != err {
+					t.Errorf("response integrity check failed with error: %s", err)
+				}
+				if nil == identity || *identity != *test.served {
+					t.Errorf("request served with identity %v, expected %v", identity, test.served)
+				}
+				return
+			}
+
+			if nil != identity {
+				t.Errorf("rejected request served with identity %v", identity)
+			}
+			value, _ := res.Get(ERROR_CODE)
+			code, _, err := ParseErrorCode(value)
+			if nil != err || code != test.code {
+				t.Fatalf("error code %d (%v), expected %d", code, err, test.code)
+			}
+			if test.code == CODE_BAD_REQUEST {
+				return
+			}
+			if realm, _ := res.Get(REALM); string(realm) != "lstun" {
+				t.Errorf("challenge realm %q", realm)
+			}
+			fresh, _ := res.Get(NONCE)
+			if valid, stale := auth.nonces.check(string(fresh), time.Now()); !valid || stale {
+				t.Errorf("challenge nonce %q is not fresh", fresh)
+			}
+			as, ok := res.Get(THIRD_PARTY_AUTH)
+			if (test.code == CODE_UNAUTHORIZED) != ok || (ok && string(as) != "https://as.example.org") {
+				t.Errorf("challenge third party authorization %q", as)
+			}
+		})
+	}
+}
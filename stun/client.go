@@ -0,0 +1,154 @@
+package stun
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sifaserdarozen/stun/uri"
+)
+
+const (
+	CLIENT_TIMEOUT = 2 * time.Second
+)
+
+// ResponseError is returned when the server answers with an error response
+type ResponseError struct {
+	Code   int
+	Reason string
+}
+
+func (self *ResponseError) Error() string {
+	return fmt.Sprintf("error %d %s", self.Code, self.Reason)
+}
+
+// QueryURI sends a binding request to the server of a stun or turn URI and returns the reflexive
+// address reported. The URI is resolved with SRV records, and its addresses are tried in order
+// till one answers. tlsConfig is only used for secure URIs, the host of the URI is verified
+// when it has no ServerName, and the application protocol of the scheme is offered when it has no
+// NextProtos.
+func QueryURI(ctx context.Context, u uri.URI, tlsConfig *tls.Config) (net.IP, int, error) {
+	transport := u.Network()
+	if u.Secure() {
+		if transport != uri.TRANSPORT_TCP {
+			return nil, 0, fmt.Errorf("%s needs dtls, which is not supported", u)
+		}
+		transport = TRANSPORT_TLS
+		if nil == tlsConfig {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Host
+		}
+		if len(tlsConfig.NextProtos) == 0 {
+			tlsConfig.NextProtos = []string{ALPN_NAT_DISCOVERY}
+			if u.Turn() {
+				tlsConfig.NextProtos = []string{ALPN_TURN}
+			}
+		}
+	}
+
+	addrs, err := uri.Resolve(ctx, net.DefaultResolver, u)
+	if nil != err {
+		return nil, 0, err
+	}
+	var errs []error
+	for _, addr := range addrs {
+		ip, port, err := QueryMappedAddress(ctx, transport, addr, tlsConfig)
+		var resErr *ResponseError
+		if nil == err || errors.As(err, &resErr) {
+			return ip, port, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+// QueryMappedAddress sends a binding request to addr over udp, tcp or tls and returns the
+// reflexive address reported by the server. tlsConfig is only used for tls.
+func QueryMappedAddress(ctx context.Context, transport string, addr string, tlsConfig *tls.Config) (net.IP, int, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CLIENT_TIMEOUT)
+		defer cancel()
+	}
+
+	var conn net.Conn
+	var err error
+	switch transport {
+	case TRANSPORT_UDP, TRANSPORT_TCP:
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, transport, addr)
+	case TRANSPORT_TLS:
+		dialer := tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	default:
+		return nil, 0, fmt.Errorf("unknown transport %q", transport)
+	}
+	if nil != err {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	// cancellation unblocks a pending read, not only the deadline
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); nil != err {
+		return nil, 0, err
+	}
+
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}
+	if _, err := rand.Read(req.ID[:]); nil != err {
+		return nil, 0, err
+	}
+	req.AddFingerprint()
+	if _, err := conn.Write(req.Encode()); nil != err {
+		return nil, 0, err
+	}
+
+	var buf []byte
+	if transport == TRANSPORT_UDP {
+		buf = make([]byte, UDP_BUFF_SIZE)
+		n, err := conn.Read(buf)
+		if nil != err {
+			return nil, 0, err
+		}
+		buf = buf[:n]
+	} else {
+		buf, err = readStreamMessage(conn)
+		if nil != err {
+			return nil, 0, err
+		}
+	}
+
+	res, err := DecodeMessage(buf)
+	if nil != err {
+		return nil, 0, err
+	}
+	if res.ID != req.ID {
+		return nil, 0, fmt.Errorf("response transaction %x does not match request %x", res.ID, req.ID)
+	}
+	if res.Class() == CLASS_ERROR {
+		resErr := &ResponseError{}
+		if value, ok := res.Get(ERROR_CODE); ok {
+			resErr.Code, resErr.Reason, _ = ParseErrorCode(value)
+		}
+		return nil, 0, resErr
+	}
+	if res.Type != BINDING_SUCCESS_RESPONSE {
+		return nil, 0, fmt.Errorf("unexpected response %s, %s", res, result(res))
+	}
+
+	value, ok := res.Get(XOR_MAPPED_ADDRESS)
+	if !ok {
+		return nil, 0, fmt.Errorf("XOR-MAPPED-ADDRESS is missing in response")
+	}
+	ip, port, err := ParseXorAddress(value, res.Cookie, res.ID)
+	return ip, int(port), err
+}
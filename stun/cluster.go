@@ -0,0 +1,525 @@
+package stun
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CHANGE-REQUEST flags of RFC 5780
+const (
+	CHANGE_IP   = 0x04
+	CHANGE_PORT = 0x02
+)
+
+const (
+	// CLUSTER_REPLICAS is the number of points every peer has on the hash ring
+	CLUSTER_REPLICAS = 64
+	// CLUSTER_MAX_AGE is how long a forwarded request is accepted by a peer
+	CLUSTER_MAX_AGE = 5 * time.Second
+	CLUSTER_VERSION = 2
+)
+
+var (
+	// clusterMagic starts every peer frame, its first byte can not start a stun message
+	clusterMagic = []byte{0xff, 'L', 'S', 'C'}
+
+	ErrBadClusterFrame   = errors.New("malformed cluster frame")
+	ErrClusterFrameAuth  = errors.New("cluster frame authentication failed")
+	ErrClusterFrameStale = errors.New("cluster frame is too old")
+	ErrClusterReplay     = errors.New("cluster frame is replayed")
+)
+
+type ClusterConf struct {
+	Enabled bool
+	// AdvertiseIP is the address clients reach this instance at, the udp port completes it
+	AdvertiseIP string `mapstructure:"advertise_ip"`
+	// Peers are static ip:port udp addresses of sibling instances, this instance may be listed
+	Peers []string
+	// Srv is a DNS SRV name resolving to sibling instances, e.g. _stun._udp.example.org
+	Srv string
+	// Refresh is the interval Srv is resolved at
+	Refresh time.Duration
+	// Secret seals requests forwarded between peers, it must be the same on all of them
+	Secret string
+}
+
+func (self ClusterConf) String() string {
+	secret := ""
+	if self.Secret != "" {
+		secret = REDACTED
+	}
+	return fmt.Sprintf("{enabled: %t, AdvertiseIP: %s, Peers: %v, Srv: %s, Refresh: %s, Secret: %s}", self.Enabled, self.AdvertiseIP, self.Peers, self.Srv, self.Refresh, secret)
+}
+
+// parseChangeRequest returns the flags of a CHANGE-REQUEST value
+func parseChangeRequest(value []byte) (uint32, error) {
+	if len(value) != 4 {
+		return 0, fmt.Errorf("change request length %d is not 4", len(value))
+	}
+	return binary.BigEndian.Uint32(value) & (CHANGE_IP | CHANGE_PORT), nil
+}
+
+// withoutAttribute returns a copy of msg having no attribute of type t
+func withoutAttribute(msg *Message, t uint16) *Message {
+	res := *msg
+	res.Attributes = nil
+	res.signed = nil
+	for _, attr := range msg.Attributes {
+		if attr.Type != t {
+			res.Attributes = append(res.Attributes, attr)
+		}
+	}
+	return &res
+}
+
+// clusterFrame is a request received from client, forwarded so that a peer can answer it
+type clusterFrame struct {
+	client *net.UDPAddr
+	sent   time.Time
+	// identity and key of a request authenticated by the forwarding peer, nil without auth.
+	// The answering peer signs its response with key instead of authenticating again, as the
+	// request lost its CHANGE-REQUEST and the nonce is of the forwarding peer.
+	identity *Identity
+	key      []byte
+	msg      []byte
+	// nonce the frame is sealed with, set by decodeClusterFrame to detect replays
+	nonce []byte
+}
+
+// clusterCipher returns the AEAD sealing frames, keyed by the cluster secret
+func clusterCipher(secret []byte) cipher.AEAD {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("lstun cluster frame"))
+	// a 32 byte key and the standard nonce size can not fail
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// appendClusterField appends a field of up to 64k bytes, prefixed by its length
+func appendClusterField(buf []byte, field []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(field)))
+	return append(buf, field...)
+}
+
+// readClusterField returns the length prefixed field at the start of buf and the rest of buf
+func readClusterField(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 2 {
+		return nil, nil, ErrBadClusterFrame
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return nil, nil, ErrBadClusterFrame
+	}
+	return buf[2 : 2+n], buf[2+n:], nil
+}
+
+// encode returns the frame as the magic, version and a random nonce, followed by the client
+// address, send time, the integrity key, username, realm and mechanism of the request and the
+// request, sealed with aead so that peers only learn the key
+func (self *clusterFrame) encode(aead cipher.AEAD) ([]byte, error) {
+	ip := self.client.IP.To4()
+	family := byte(4)
+	if nil == ip {
+		ip = self.client.IP.To16()
+		family = 6
+	}
+	identity := self.identity
+	if nil == identity {
+		identity = &Identity{}
+	}
+
+	plain := make([]byte, 0, 3+len(ip)+8+8+len(self.key)+len(identity.Username)+len(identity.Realm)+len(identity.Mechanism)+len(self.msg))
+	plain = append(plain, family)
+	plain = binary.BigEndian.AppendUint16(plain, uint16(self.client.Port))
+	plain = append(plain, ip...)
+	plain = binary.BigEndian.AppendUint64(plain, uint64(self.sent.UnixNano()))
+	plain = appendClusterField(plain, self.key)
+	plain = appendClusterField(plain, []byte(identity.Username))
+	plain = appendClusterField(plain, []byte(identity.Realm))
+	plain = appendClusterField(plain, []byte(identity.Mechanism))
+	plain = append(plain, self.msg...)
+
+	header := len(clusterMagic) + 1
+	buf := make([]byte, header+aead.NonceSize(), header+aead.NonceSize()+len(plain)+aead.Overhead())
+	copy(buf, clusterMagic)
+	buf[len(clusterMagic)] = CLUSTER_VERSION
+	if _, err := rand.Read(buf[header:]); nil != err {
+		return nil, err
+	}
+	return aead.Seal(buf, buf[header:], plain, buf[:header]), nil
+}
+
+// decodeClusterFrame opens a frame sealed by a peer and returns the request it carries
+func decodeClusterFrame(aead cipher.AEAD, buf []byte, now time.Time) (*clusterFrame, error) {
+	header := len(clusterMagic) + 1
+	if len(buf) < header+aead.NonceSize()+aead.Overhead() || !bytes.HasPrefix(buf, clusterMagic) || buf[len(clusterMagic)] != CLUSTER_VERSION {
+		return nil, ErrBadClusterFrame
+	}
+
+	nonce := buf[header : header+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, buf[header+aead.NonceSize():], buf[:header])
+	if nil != err {
+		return nil, ErrClusterFrameAuth
+	}
+
+	if len(plain) < 3 {
+		return nil, ErrBadClusterFrame
+	}
+	ipLen := net.IPv4len
+	if plain[0] == 6 {
+		ipLen = net.IPv6len
+	}
+	if len(plain) < 3+ipLen+8 {
+		return nil, ErrBadClusterFrame
+	}
+	frame := &clusterFrame{
+		client: &net.UDPAddr{IP: net.IP(plain[3 : 3+ipLen]), Port: int(binary.BigEndian.Uint16(plain[1:]))},
+		sent:   time.Unix(0, int64(binary.BigEndian.Uint64(plain[3+ipLen:]))),
+		nonce:  bytes.Clone(nonce),
+	}
+	if age := now.Sub(frame.sent); age > CLUSTER_MAX_AGE || age < -CLUSTER_MAX_AGE {
+		return nil, ErrClusterFrameStale
+	}
+
+	rest := plain[3+ipLen+8:]
+	var fields [4][]byte
+	for i := range fields {
+		field, next, err := readClusterField(rest)
+		if nil != err {
+			return nil, err
+		}
+		fields[i], rest = field, next
+	}
+	if len(fields[0]) > 0 {
+		frame.key = fields[0]
+		frame.identity = &Identity{Username: string(fields[1]), Realm: string(fields[2]), Mechanism: string(fields[3])}
+	}
+	frame.msg = rest
+	return frame, nil
+}
+
+// replayGuard remembers the nonces of accepted frames for as long as their send time is
+// accepted, in two generations swapped every other CLUSTER_MAX_AGE
+type replayGuard struct {
+	mu       sync.Mutex
+	current  map[string]bool
+	previous map[string]bool
+	rotated  time.Time
+}
+
+func newReplayGuard(now time.Time) *replayGuard {
+	return &replayGuard{current: map[string]bool{}, previous: map[string]bool{}, rotated: now}
+}
+
+// fresh records nonce and reports whether it was not seen before
+func (self *replayGuard) fresh(nonce []byte, now time.Time) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if now.Sub(self.rotated) >= 2*CLUSTER_MAX_AGE {
+		self.previous, self.current = self.current, map[string]bool{}
+		self.rotated = now
+	}
+	key := string(nonce)
+	if self.current[key] || self.previous[key] {
+		return false
+	}
+	self.current[key] = true
+	return true
+}
+
+type ringPoint struct {
+	hash uint32
+	peer *net.UDPAddr
+}
+
+// hashRing maps keys to peers by consistent hashing, so a peer joining or leaving only moves
+// the keys of its own points
+type hashRing struct {
+	points []ringPoint
+}
+
+func ringHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func newHashRing(peers []*net.UDPAddr) *hashRing {
+	self := &hashRing{}
+	for _, peer := range peers {
+		for i := 0; i < CLUSTER_REPLICAS; i++ {
+			self.points = append(self.points, ringPoint{hash: ringHash(peer.String() + "#" + strconv.Itoa(i)), peer: peer})
+		}
+	}
+	sort.Slice(self.points, func(i, j int) bool { return self.points[i].hash < self.points[j].hash })
+	return self
+}
+
+// pick returns the first eligible peer clockwise from key, nil if there is none
+func (self *hashRing) pick(key string, eligible func(*net.UDPAddr) bool) *net.UDPAddr {
+	if len(self.points) == 0 {
+		return nil
+	}
+	hash := ringHash(key)
+	start := sort.Search(len(self.points), func(i int) bool { return self.points[i].hash >= hash })
+	for i := 0; i < len(self.points); i++ {
+		point := self.points[(start+i)%len(self.points)]
+		if eligible(point.peer) {
+			return point.peer
+		}
+	}
+	return nil
+}
+
+// srvResolver is the part of net.Resolver used for peer discovery
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// resolvePeers resolves every target of the SRV record name to udp addresses
+func resolvePeers(ctx context.Context, resolver srvResolver, name string) ([]*net.UDPAddr, error) {
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	if nil != err {
+		return nil, err
+	}
+	var peers []*net.UDPAddr
+	for _, record := range records {
+		addrs, err := resolver.LookupIPAddr(ctx, record.Target)
+		if nil != err {
+			return nil, fmt.Errorf("resolving %s failed: %w", record.Target, err)
+		}
+		for _, addr := range addrs {
+			peers = append(peers, &net.UDPAddr{IP: addr.IP, Port: int(record.Port)})
+		}
+	}
+	return peers, nil
+}
+
+// Cluster forwards requests carrying CHANGE-REQUEST to a sibling instance, which answers the
+// client directly from its own address, as RFC 5780 NAT behavior discovery needs
+type Cluster struct {
+	conf     ClusterConf
+	self     *net.UDPAddr
+	aead     cipher.AEAD
+	replays  *replayGuard
+	static   []*net.UDPAddr
+	conn     net.PacketConn
+	resolver srvResolver
+
+	mu   sync.RWMutex
+	ring *hashRing
+}
+
+// NewCluster creates a cluster member answering from conn, the udp socket of the server
+func NewCluster(conf ClusterConf, conn net.PacketConn) (*Cluster, error) {
+	ip := net.ParseIP(conf.AdvertiseIP)
+	if nil == ip {
+		return nil, fmt.Errorf("advertise ip %q is not an ip address", conf.AdvertiseIP)
+	}
+	self := &Cluster{
+		conf:     conf,
+		self:     &net.UDPAddr{IP: ip, Port: conn.LocalAddr().(*net.UDPAddr).Port},
+		aead:     clusterCipher([]byte(conf.Secret)),
+		replays:  newReplayGuard(time.Now()),
+		conn:     conn,
+		resolver: net.DefaultResolver,
+	}
+	for _, peer := range conf.Peers {
+		ip, port, err := parseIPPort(peer)
+		if nil != err {
+			return nil, fmt.Errorf("peer %q: %w", peer, err)
+		}
+		self.static = append(self.static, &net.UDPAddr{IP: ip, Port: int(port)})
+	}
+	self.setPeers(nil)
+	return self, nil
+}
+
+// setPeers replaces discovered peers, static peers are always kept
+func (self *Cluster) setPeers(discovered []*net.UDPAddr) {
+	seen := map[string]bool{self.self.String(): true}
+	var peers []*net.UDPAddr
+	for _, peer := range append(append([]*net.UDPAddr{}, self.static...), discovered...) {
+		if !seen[peer.String()] {
+			seen[peer.String()] = true
+			peers = append(peers, peer)
+		}
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.ring = newHashRing(peers)
+}
+
+// Peers returns the known siblings, excluding this instance
+func (self *Cluster) Peers() []*net.UDPAddr {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	seen := map[string]bool{}
+	var peers []*net.UDPAddr
+	for _, point := range self.ring.points {
+		if !seen[point.peer.String()] {
+			seen[point.peer.String()] = true
+			peers = append(peers, point.peer)
+		}
+	}
+	return peers
+}
+
+// discover resolves the SRV record of the cluster every refresh interval under sup, keeping
+// the last known peers when resolving fails
+func (self *Cluster) discover(sup *Supervisor) {
+	if self.conf.Srv == "" {
+		return
+	}
+	refresh := self.conf.Refresh
+	if refresh <= 0 {
+		refresh = DEFAULT_CLUSTER_REFRESH
+	}
+	sup.Go("cluster discovery", func(ctx context.Context) error {
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			peers, err := resolvePeers(ctx, self.resolver, self.conf.Srv)
+			if nil != err {
+				if nil == ctx.Err() {
+					slog.Warn("Cluster peer discovery failed", "srv", self.conf.Srv, "error", err)
+				}
+			} else {
+				self.setPeers(peers)
+				slog.Debug("Cluster peers discovered", "srv", self.conf.Srv, "peers", len(peers))
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// pick chooses the peer to answer r as flags ask, nil if no peer qualifies. The client 5-tuple
+// is hashed, so a client running several tests keeps talking to the same sibling.
+func (self *Cluster) pick(r *Request, flags uint32) *net.UDPAddr {
+	eligible := func(peer *net.UDPAddr) bool {
+		if flags&CHANGE_IP != 0 && peer.IP.Equal(self.self.IP) {
+			return false
+		}
+		if flags&CHANGE_IP == 0 && !peer.IP.Equal(self.self.IP) {
+			return false
+		}
+		if flags&CHANGE_PORT != 0 && peer.Port == self.self.Port {
+			return false
+		}
+		if flags&CHANGE_PORT == 0 && peer.Port != self.self.Port {
+			return false
+		}
+		return true
+	}
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.ring.pick(fmt.Sprintf("%s|%s|%s", r.Transport, r.RemoteAddr, r.LocalAddr), eligible)
+}
+
+// isFrame reports whether a datagram is a peer frame rather than a stun message
+func (self *Cluster) isFrame(buf []byte) bool {
+	return nil != self && bytes.HasPrefix(buf, clusterMagic)
+}
+
+// serve answers a request forwarded by a peer, sending the response straight to the client
+func (self *Cluster) serve(handler Handler, metrics *Metrics, buf []byte, from net.Addr) {
+	now := time.Now()
+	frame, err := decodeClusterFrame(self.aead, buf, now)
+	if nil == err && !self.replays.fresh(frame.nonce, now) {
+		err = ErrClusterReplay
+	}
+	if nil != err {
+		metrics.malformedPacket(TRANSPORT_UDP, from)
+		slog.Debug("Cluster frame dropped", "remote_addr", from, "error", err)
+		return
+	}
+	msg, err := DecodeMessage(frame.msg)
+	if nil != err {
+		metrics.malformedPacket(TRANSPORT_UDP, from)
+		slog.Debug("Malformed forwarded message", "remote_addr", from, "error", err)
+		return
+	}
+
+	// the change was asked from the peer, it is fulfilled by answering from here
+	_, fingerprint := msg.Get(FINGERPRINT)
+	request := &Request{
+		Message:    withoutAttribute(msg, CHANGE_REQUEST),
+		Transport:  TRANSPORT_UDP,
+		LocalAddr:  self.conn.LocalAddr(),
+		RemoteAddr: frame.client,
+	}
+	if nil != frame.identity {
+		request = request.WithContext(withAuthentication(request.Context(), frame.identity, frame.key))
+	}
+	handler.ServeSTUN(&packetResponseWriter{conn: self.conn, addr: frame.client, fingerprint: fingerprint, metrics: metrics}, request)
+}
+
+// Middleware forwards udp requests asking for a changed address to a qualifying peer. Without
+// one the request is passed on, so CHANGE-REQUEST is reported as an unknown attribute.
+func (self *Cluster) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			value, ok := r.Message.Get(CHANGE_REQUEST)
+			if !ok || r.Message.Class() != CLASS_REQUEST || r.Transport != TRANSPORT_UDP {
+				next.ServeSTUN(w, r)
+				return
+			}
+			flags, err := parseChangeRequest(value)
+			if nil != err {
+				w.Write(NewErrorResponse(r.Message, CODE_BAD_REQUEST, REASON_BAD_REQUEST))
+				return
+			}
+			if flags == 0 {
+				request := *r
+				request.Message = withoutAttribute(r.Message, CHANGE_REQUEST)
+				next.ServeSTUN(w, &request)
+				return
+			}
+
+			client, ok := r.RemoteAddr.(*net.UDPAddr)
+			peer := self.pick(r, flags)
+			if !ok || nil == peer {
+				next.ServeSTUN(w, r)
+				return
+			}
+			frame := &clusterFrame{client: client, sent: time.Now(), msg: r.Message.Encode()}
+			frame.identity, frame.key, _ = authenticationFromContext(r.Context())
+			buf, err := frame.encode(self.aead)
+			if nil == err {
+				_, err = self.conn.WriteTo(buf, peer)
+			}
+			if nil != err {
+				slog.Warn("Forwarding to cluster peer failed", "peer", peer, "error", err)
+				w.Write(NewErrorResponse(r.Message, CODE_SERVER_ERROR, REASON_SERVER_ERROR))
+				return
+			}
+			slog.Debug("Request forwarded to cluster peer", "peer", peer, "remote_addr", r.RemoteAddr, "flags", flags)
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package stun
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// sealFrame encodes frame with aead
+func sealFrame(tb testing.TB, aead cipher.AEAD, frame *clusterFrame) []byte {
+	tb.Helper()
+	buf, err := frame.encode(aead)
+	if nil != err {
+		tb.Fatal(err)
+	}
+	return buf
+}
+
+func TestClusterFrame(t *testing.T) {
+	aead := clusterCipher([]byte("s3cret"))
+	now := time.Now()
+	msg := []byte("request")
+
+	identity := &Identity{Username: "user", Realm: "example.org", Mechanism: MECHANISM_LONG_TERM}
+
+	testCases := map[string]struct {
+		client   *net.UDPAddr
+		identity *Identity
+		key      []byte
+		modify   func(frame []byte) []byte
+		secret   []byte
+		at       time.Time
+		err      error
+	}{
+		"ipv4 client should round trip":    {client: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}},
+		"ipv6 client should round trip":    {client: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}},
+		"identity should round trip":       {client: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}, identity: identity, key: LongTermKey("user", "example.org", "secret")},
+		"tampered frame should be denied":  {client: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}, modify: func(f []byte) []byte { f[len(f)-20] ^= 1; return f }, err: ErrClusterFrameAuth},
+		"tampered nonce should be denied":  {client: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}, modify: func(f []byte) []byte { f[8] ^= 1; return f }, err: ErrClusterFrameAuth},
+		"other secret should be denied":    {client: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}, secret: []byte("other"), err: ErrClusterFrameAuth},
+		"stale frame should be denied":     {client: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}, at: now.Add(time.Minute), err: ErrClusterFrameStale},
+		"truncated frame should be denied": {client: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}, modify: func(f []byte) []byte { return f[:10] }, err: ErrBadClusterFrame},
+	}
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			frame := sealFrame(t, aead, &clusterFrame{client: test.client, sent: now, identity: test.identity, key: test.key, msg: msg})
+			if nil != test.key && bytes.Contains(frame, test.key) {
+				t.Errorf("Frame %x carries the integrity key in plain", frame)
+			}
+			if nil != test.modify {
+				frame = test.modify(frame)
+			}
+			opener := aead
+			if nil != test.secret {
+				opener = clusterCipher(test.secret)
+			}
+			at := now
+			if !test.at.IsZero() {
+				at = test.at
+			}
+
+			decoded, err := decodeClusterFrame(opener, frame, at)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Decode error is %v, expected %v", err, test.err)
+			}
+			if nil != test.err {
+				return
+			}
+			if decoded.client.String() != test.client.String() || string(decoded.msg) != string(msg) {
+				t.Errorf("Decoded %s %q, expected %s %q", decoded.client, decoded.msg, test.client, msg)
+			}
+			if (nil == decoded.identity) != (nil == test.identity) || (nil != test.identity && *decoded.identity != *test.identity) || !bytes.Equal(decoded.key, test.key) {
+				t.Errorf("Decoded identity %v with key %x, expected %v with %x", decoded.identity, decoded.key, test.identity, test.key)
+			}
+		})
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Now()
+	guard := newReplayGuard(now)
+	if !guard.fresh([]byte("a"), now) {
+		t.Fatal("First frame should be fresh")
+	}
+	if guard.fresh([]byte("a"), now.Add(CLUSTER_MAX_AGE)) {
+		t.Error("Replay within the accepted age should be rejected")
+	}
+	if guard.fresh([]byte("a"), now.Add(3*CLUSTER_MAX_AGE)) {
+		t.Error("Replay after a rotation should be rejected")
+	}
+	if !guard.fresh([]byte("a"), now.Add(6*CLUSTER_MAX_AGE)) {
+		t.Error("Nonces should be forgotten once their frames are stale")
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	var peers []*net.UDPAddr
+	for i := 1; i <= 4; i++ {
+		peers = append(peers, &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 3478})
+	}
+	all := func(*net.UDPAddr) bool { return true }
+
+	ring := newHashRing(peers)
+	smaller := newHashRing(peers[:3])
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("udp|198.51.100.1:%d|192.0.2.1:3478", 10000+i)
+		peer := ring.pick(key, all)
+		if again := ring.pick(key, all); again != peer {
+			t.Fatalf("Key %s picked %s then %s", key, peer, again)
+		}
+		if after := smaller.pick(key, all); after.String() != peer.String() {
+			if peer != peers[3] {
+				t.Errorf("Key %s moved from %s to %s though its peer stayed", key, peer, after)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 500 {
+		t.Errorf("%d of 1000 keys moved when a peer left", moved)
+	}
+
+	if peer := ring.pick("key", func(p *net.UDPAddr) bool { return p.IP.Equal(peers[2].IP) }); peer != peers[2] {
+		t.Errorf("Only eligible peer is %s, picked %s", peers[2], peer)
+	}
+	if peer := ring.pick("key", func(*net.UDPAddr) bool { return false }); nil != peer {
+		t.Errorf("No peer is eligible, picked %s", peer)
+	}
+}
+
+type fakeResolver struct {
+	srv   []*net.SRV
+	hosts map[string][]net.IPAddr
+}
+
+func (self *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, self.srv, nil
+}
+
+func (self *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := self.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	return addrs, nil
+}
+
+func TestResolvePeers(t *testing.T) {
+	resolver := &fakeResolver{
+		srv: []*net.SRV{{Target: "a.example.org.", Port: 3478}, {Target: "b.example.org.", Port: 3479}},
+		hosts: map[string][]net.IPAddr{
+			"a.example.org.": {{IP: net.IPv4(192, 0, 2, 1)}},
+			"b.example.org.": {{IP: net.IPv4(192, 0, 2, 2)}, {IP: net.ParseIP("2001:db8::2")}},
+		},
+	}
+	peers, err := resolvePeers(context.Background(), resolver, "_stun._udp.example.org")
+	if nil != err {
+		t.Fatal(err)
+	}
+	expected := []string{"192.0.2.1:3478", "192.0.2.2:3479", "[2001:db8::2]:3479"}
+	if len(peers) != len(expected) {
+		t.Fatalf("Resolved %v, expected %v", peers, expected)
+	}
+	for i, peer := range peers {
+		if peer.String() != expected[i] {
+			t.Errorf("Peer %d is %s, expected %s", i, peer, expected[i])
+		}
+	}
+
+	resolver.srv = append(resolver.srv, &net.SRV{Target: "missing.example.org.", Port: 3478})
+	if _, err := resolvePeers(context.Background(), resolver, "_stun._udp.example.org"); nil == err {
+		t.Error("Unresolvable target should fail discovery")
+	}
+}
+
+// changeRequest sends a binding request with CHANGE-REQUEST flags to addr over conn, and
+// returns the response together with the address it came from
+func changeRequest(t *testing.T, conn net.PacketConn, addr string, flags byte) (*Message, net.Addr) {
+	t.Helper()
+
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{1, 2, 3, flags}}
+	req.Add(CHANGE_REQUEST, []byte{0, 0, 0, flags})
+	return sendRequest(t, conn, addr, req)
+}
+
+// sendRequest sends req to addr over conn, and returns the response together with the address it
+// came from
+func sendRequest(t *testing.T, conn net.PacketConn, addr string, req *Message) (*Message, net.Addr) {
+	t.Helper()
+
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(req.Encode(), to); nil != err {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, UDP_BUFF_SIZE)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := conn.ReadFrom(buf)
+	if nil != err {
+		t.Fatalf("No response: %s", err)
+	}
+	res, err := DecodeMessage(buf[:n])
+	if nil != err {
+		t.Fatal(err)
+	}
+	return res, from
+}
+
+func TestServerCluster(t *testing.T) {
+	clusterConf := ClusterConf{Enabled: true, AdvertiseIP: "127.0.0.1", Secret: "s3cret"}
+
+	// the sibling only answers forwarded requests, its own peers are not used
+	siblingConf := testConfiguration()
+	siblingConf.Cluster = clusterConf
+	siblingConf.Cluster.Peers = []string{"127.0.0.1:9"}
+	sibling := startTestServer(t, siblingConf, nil)
+	siblingAddr := loopback(sibling.Addrs().Udp)
+
+	conf := testConfiguration()
+	conf.Cluster = clusterConf
+	conf.Cluster.Peers = []string{siblingAddr}
+	server := startTestServer(t, conf, nil)
+	addr := loopback(server.Addrs().Udp)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	res, from := changeRequest(t, conn, addr, CHANGE_PORT)
+	if from.String() != siblingAddr {
+		t.Errorf("Change port response came from %s, expected sibling %s", from, siblingAddr)
+	}
+	if res.Type != BINDING_SUCCESS_RESPONSE {
+		t.Fatalf("Change port response is %s", res)
+	}
+	value, _ := res.Get(XOR_MAPPED_ADDRESS)
+	ip, port, err := ParseXorAddress(value, res.Cookie, res.ID)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if mapped := (&net.UDPAddr{IP: ip, Port: int(port)}).String(); mapped != conn.LocalAddr().String() {
+		t.Errorf("Mapped address is %s, expected %s", mapped, conn.LocalAddr())
+	}
+
+	// no sibling has another ip, so the change is reported as not understood
+	res, from = changeRequest(t, conn, addr, CHANGE_IP)
+	if from.String() != addr || res.Type != BINDING_ERROR_RESPONSE {
+		t.Errorf("Change ip response is %s from %s, expected an error from %s", res, from, addr)
+	}
+
+	res, from = changeRequest(t, conn, addr, 0)
+	if from.String() != addr || res.Type != BINDING_SUCCESS_RESPONSE {
+		t.Errorf("Response without change is %s from %s, expected success from %s", res, from, addr)
+	}
+}
+
+func TestServerClusterAuth(t *testing.T) {
+	clusterConf := ClusterConf{Enabled: true, AdvertiseIP: "127.0.0.1", Secret: "s3cret"}
+	authConf := AuthConf{Enabled: true, Realm: "lstun", NonceLifetime: time.Minute, Rest: RestConf{Secrets: []string{"rest-secret"}}}
+
+	siblingConf := testConfiguration()
+	siblingConf.Cluster = clusterConf
+	siblingConf.Cluster.Peers = []string{"127.0.0.1:9"}
+	siblingConf.Auth = authConf
+	sibling := startTestServer(t, siblingConf, nil)
+	siblingAddr := loopback(sibling.Addrs().Udp)
+
+	conf := testConfiguration()
+	conf.Cluster = clusterConf
+	conf.Cluster.Peers = []string{siblingAddr}
+	conf.Auth = authConf
+	server := startTestServer(t, conf, nil)
+	addr := loopback(server.Addrs().Udp)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	res, _ := changeRequest(t, conn, addr, CHANGE_PORT)
+	nonce, ok := res.Get(NONCE)
+	if res.Type != BINDING_ERROR_RESPONSE || !ok {
+		t.Fatalf("Unsigned request is answered with %s, expected a challenge", res)
+	}
+
+	// the nonce is of the forwarding server, the sibling trusts its authentication
+	username := fmt.Sprintf("%d:alice", time.Now().Add(time.Hour).Unix())
+	key := LongTermKey(username, "lstun", RestPassword([]byte("rest-secret"), username))
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{4, 5, 6}}
+	req.Add(CHANGE_REQUEST, []byte{0, 0, 0, CHANGE_PORT})
+	req.Add(USERNAME, []byte(username))
+	req.Add(REALM, []byte("lstun"))
+	req.Add(NONCE, nonce)
+	req.AddMessageIntegrity(key)
+	res, from := sendRequest(t, conn, addr, req)
+	if from.String() != siblingAddr {
+		t.Errorf("Change port response came from %s, expected sibling %s", from, siblingAddr)
+	}
+	if res.Type != BINDING_SUCCESS_RESPONSE {
+		t.Fatalf("Change port response is %s", res)
+	}
+	if err := res.CheckMessageIntegrity(key); nil != err {
+		t.Errorf("Response of sibling is not signed with the key of the client: %s", err)
+	}
+}
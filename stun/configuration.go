@@ -1,11 +1,19 @@
 package stun
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/sifaserdarozen/stun/uri"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -13,20 +21,117 @@ import (
 // viper keys
 const (
 	ENV_PREFIX          = "LSTN"
+	KEY_UDP_ENABLED     = "udp.enabled"
 	KEY_UDP_PORT        = "udp.port"
+	KEY_TCP_ENABLED     = "tcp.enabled"
 	KEY_TCP_PORT        = "tcp.port"
+	KEY_TLS_ENABLED     = "tls.enabled"
+	KEY_TLS_PORT        = "tls.port"
+	KEY_TLS_CERT_FILE   = "tls.cert_file"
+	KEY_TLS_KEY_FILE    = "tls.key_file"
+	KEY_TLS_ALPN        = "tls.alpn"
+	KEY_REQUIRE_ALPN    = "tls.require_alpn"
 	KEY_MONITORING_PORT = "monitoring.port"
 	KEY_MONITORING_PATH = "monitoring.path"
+	KEY_PROBE_INTERVAL  = "monitoring.probe_interval"
+	KEY_ADMIN_ENABLED   = "admin.enabled"
+	KEY_ADMIN_PORT      = "admin.port"
+	KEY_ADMIN_TOKEN     = "admin.token"
+	KEY_ACL_ALLOW       = "acl.allow"
+	KEY_ACL_DENY        = "acl.deny"
+	KEY_SHUTDOWN_GRACE  = "shutdown.grace_period"
+	KEY_SHUTDOWN_LIMIT  = "shutdown.deadline"
+	KEY_BIND_POLICY     = "bind.policy"
+	KEY_BIND_ATTEMPTS   = "bind.attempts"
+	KEY_BIND_BACKOFF    = "bind.backoff"
+	KEY_BIND_MAX        = "bind.max_backoff"
+	KEY_OTEL_ENABLED    = "telemetry.enabled"
+	KEY_OTEL_ENDPOINT   = "telemetry.endpoint"
+	KEY_OTEL_INSECURE   = "telemetry.insecure"
+	KEY_OTEL_SERVICE    = "telemetry.service_name"
+	KEY_OTEL_SAMPLE     = "telemetry.sample_ratio"
+	KEY_OTEL_INTERVAL   = "telemetry.export_interval"
+	KEY_PROXY_TCP       = "proxy.tcp"
+	KEY_PROXY_UDP       = "proxy.udp"
+	KEY_PROXY_TRUSTED   = "proxy.trusted"
+	KEY_ALT_SERVER      = "alternate.server"
+	KEY_ALT_DOMAIN      = "alternate.domain"
+	KEY_ALT_ON_DRAIN    = "alternate.on_drain"
+	KEY_ALT_MAX_RATE    = "alternate.max_rate"
+	KEY_ALT_RULES       = "alternate.rules"
+	KEY_CLUSTER_ENABLED = "cluster.enabled"
+	KEY_CLUSTER_IP      = "cluster.advertise_ip"
+	KEY_CLUSTER_PEERS   = "cluster.peers"
+	KEY_CLUSTER_SRV     = "cluster.srv"
+	KEY_CLUSTER_REFRESH = "cluster.refresh"
+	KEY_CLUSTER_SECRET  = "cluster.secret"
+	KEY_AUTH_ENABLED    = "auth.enabled"
+	KEY_AUTH_REALM      = "auth.realm"
+	KEY_AUTH_NONCE      = "auth.nonce_lifetime"
+	KEY_OAUTH_KEY_FILE  = "auth.oauth.key_file"
+	KEY_OAUTH_SERVER    = "auth.oauth.server_name"
+	KEY_OAUTH_AS        = "auth.oauth.authorization_server"
+	KEY_REST_SECRETS    = "auth.rest.secrets"
+	KEY_AUTH_FILE       = "auth.file.path"
+	KEY_AUTH_RELOAD     = "auth.file.reload"
+	KEY_SQLITE_PATH     = "auth.sqlite.path"
+	KEY_SQLITE_QUERY    = "auth.sqlite.query"
+	KEY_CALLOUT_URL     = "auth.http.url"
+	KEY_CALLOUT_TOKEN   = "auth.http.token"
+	KEY_CALLOUT_TIMEOUT = "auth.http.timeout"
+	KEY_CALLOUT_TTL     = "auth.http.cache_ttl"
+	KEY_ADVERTISE_HOST  = "advertise.host"
+	KEY_MUX_DTLS        = "mux.dtls"
+	KEY_MUX_RTP         = "mux.rtp"
+	KEY_MUX_ZRTP        = "mux.zrtp"
+	KEY_MUX_CHANNEL     = "mux.channel_data"
+	KEY_MUX_IDLE        = "mux.idle_timeout"
+	KEY_LIFETIME_ALLOW  = "keepalive.lifetime.allow"
+	KEY_LIFETIME_STEPS  = "keepalive.lifetime.schedule"
+	KEY_LOG_LEVEL       = "log.level"
+	KEY_LOG_FORMAT      = "log.format"
+	KEY_LOG_SAMPLING    = "log.debug_sampling"
 	FLAG_UDP_PORT       = "udp-port"
 	FLAG_TCP_PORT       = "tcp-port"
+	FLAG_LOG_LEVEL      = "log-level"
 )
 
 // default values
 const (
 	DEFAULT_UDP_PORT        = 3478
 	DEFAULT_TCP_PORT        = 3478
+	DEFAULT_TLS_PORT        = 5349
 	DEFAULT_MONITORING_PORT = 8081
 	DEFAULT_MONITORING_PATH = "/metrics"
+	DEFAULT_PROBE_INTERVAL  = 10 * time.Second
+	DEFAULT_ADMIN_PORT      = 8082
+	DEFAULT_SHUTDOWN_GRACE  = 5 * time.Second
+	DEFAULT_SHUTDOWN_LIMIT  = 10 * time.Second
+	DEFAULT_BIND_POLICY     = BIND_FAIL_FAST
+	DEFAULT_BIND_ATTEMPTS   = 5
+	DEFAULT_BIND_BACKOFF    = 200 * time.Millisecond
+	DEFAULT_BIND_MAX        = 5 * time.Second
+	DEFAULT_OTEL_ENDPOINT   = "localhost:4318"
+	DEFAULT_OTEL_SERVICE    = "lstun"
+	DEFAULT_OTEL_SAMPLE     = 1.0
+	DEFAULT_OTEL_INTERVAL   = 30 * time.Second
+	DEFAULT_CLUSTER_REFRESH = 30 * time.Second
+	DEFAULT_AUTH_REALM      = "lstun"
+	DEFAULT_AUTH_NONCE      = 10 * time.Minute
+	DEFAULT_AUTH_RELOAD     = 30 * time.Second
+	DEFAULT_SQLITE_QUERY    = "SELECT password FROM users WHERE username = ?"
+	DEFAULT_CALLOUT_TIMEOUT = 2 * time.Second
+	DEFAULT_CALLOUT_TTL     = time.Minute
+	DEFAULT_MUX_IDLE        = time.Minute
+	DEFAULT_LOG_LEVEL       = "info"
+	DEFAULT_LOG_FORMAT      = LOG_FORMAT_TEXT
+	DEFAULT_LOG_SAMPLING    = 1
+)
+
+// valid port range for listeners
+const (
+	MIN_PORT = 1
+	MAX_PORT = 65535
 )
 
 type ServerConf struct {
@@ -38,85 +143,543 @@ func (self ServerConf) String() string {
 	return fmt.Sprintf("{enabled: %t, Port: %d}", self.Enabled, self.Port)
 }
 
+type TlsConf struct {
+	Enabled  bool
+	Port     int
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// Alpn are the application protocols advertised, none when empty
+	Alpn []string
+	// RequireAlpn fails handshakes of clients negotiating no application protocol
+	RequireAlpn bool `mapstructure:"require_alpn"`
+}
+
+func (self TlsConf) String() string {
+	return fmt.Sprintf("{enabled: %t, Port: %d, CertFile: %s, KeyFile: %s, Alpn: %v, RequireAlpn: %t}", self.Enabled, self.Port, self.CertFile, self.KeyFile, self.Alpn, self.RequireAlpn)
+}
+
 type MonitoringConf struct {
 	Port int
 	Path string
+	// ProbeInterval is the period of readiness self probes over loopback
+	ProbeInterval time.Duration `mapstructure:"probe_interval"`
 }
 
 func (self MonitoringConf) String() string {
-	return fmt.Sprintf("{Port: %d, Path: %s}", self.Port, self.Path)
+	return fmt.Sprintf("{Port: %d, Path: %s, ProbeInterval: %s}", self.Port, self.Path, self.ProbeInterval)
 }
 
 type Configuration struct {
 	Udp        ServerConf
 	Tcp        ServerConf
+	Tls        TlsConf
 	Monitoring MonitoringConf
+	Admin      AdminConf
+	Acl        AclConf
+	Shutdown   ShutdownConf
+	Bind       BindConf
+	Telemetry  TelemetryConf
+	Proxy      ProxyConf
+	Alternate  AlternateConf
+	Cluster    ClusterConf
+	Auth       AuthConf
+	Advertise  AdvertiseConf
+	Mux        MuxConf
+	Keepalive  KeepaliveConf
+	Log        LogConf
 }
 
 func (self Configuration) String() string {
-	return fmt.Sprintf("{Udp: %s, Tcp: %s Monitoring: %s}", self.Udp.String(), self.Tcp.String(), self.Monitoring.String())
+	return fmt.Sprintf("{Udp: %s, Tcp: %s, Tls: %s, Monitoring: %s, Admin: %s, Acl: %s, Shutdown: %s, Bind: %s, Telemetry: %s, Proxy: %s, Alternate: %s, Cluster: %s, Auth: %s, Advertise: %s, Mux: %s, Keepalive: %s, Log: %s}", self.Udp.String(), self.Tcp.String(), self.Tls.String(), self.Monitoring.String(), self.Admin.String(), self.Acl.String(), self.Shutdown.String(), self.Bind.String(), self.Telemetry.String(), self.Proxy.String(), self.Alternate.String(), self.Cluster.String(), self.Auth.String(), self.Advertise.String(), self.Mux.String(), self.Keepalive.String(), self.Log.String())
 }
 
-func GetConfiguration() (*Configuration, error) {
-	// let viper read from configuration file
-	viper.SetConfigName("stun")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath("/etc/stun/")
-	viper.AddConfigPath("./config/")
-	if err := viper.ReadInConfig(); err != nil {
-		log.Printf("Reading config file %s failed with error: %s", viper.ConfigFileUsed(), err)
+// keys that can be overridden by LSTN_* environment variables
+var envKeys = []string{
+	KEY_UDP_ENABLED,
+	KEY_UDP_PORT,
+	KEY_TCP_ENABLED,
+	KEY_TCP_PORT,
+	KEY_TLS_ENABLED,
+	KEY_TLS_PORT,
+	KEY_TLS_CERT_FILE,
+	KEY_TLS_KEY_FILE,
+	KEY_TLS_ALPN,
+	KEY_REQUIRE_ALPN,
+	KEY_MONITORING_PORT,
+	KEY_MONITORING_PATH,
+	KEY_PROBE_INTERVAL,
+	KEY_ADMIN_ENABLED,
+	KEY_ADMIN_PORT,
+	KEY_ADMIN_TOKEN,
+	KEY_ACL_ALLOW,
+	KEY_ACL_DENY,
+	KEY_SHUTDOWN_GRACE,
+	KEY_SHUTDOWN_LIMIT,
+	KEY_BIND_POLICY,
+	KEY_BIND_ATTEMPTS,
+	KEY_BIND_BACKOFF,
+	KEY_BIND_MAX,
+	KEY_OTEL_ENABLED,
+	KEY_OTEL_ENDPOINT,
+	KEY_OTEL_INSECURE,
+	KEY_OTEL_SERVICE,
+	KEY_OTEL_SAMPLE,
+	KEY_OTEL_INTERVAL,
+	KEY_PROXY_TCP,
+	KEY_PROXY_UDP,
+	KEY_PROXY_TRUSTED,
+	KEY_ALT_SERVER,
+	KEY_ALT_DOMAIN,
+	KEY_ALT_ON_DRAIN,
+	KEY_ALT_MAX_RATE,
+	KEY_CLUSTER_ENABLED,
+	KEY_CLUSTER_IP,
+	KEY_CLUSTER_PEERS,
+	KEY_CLUSTER_SRV,
+	KEY_CLUSTER_REFRESH,
+	KEY_CLUSTER_SECRET,
+	KEY_AUTH_ENABLED,
+	KEY_AUTH_REALM,
+	KEY_AUTH_NONCE,
+	KEY_OAUTH_KEY_FILE,
+	KEY_OAUTH_SERVER,
+	KEY_OAUTH_AS,
+	KEY_REST_SECRETS,
+	KEY_AUTH_FILE,
+	KEY_AUTH_RELOAD,
+	KEY_SQLITE_PATH,
+	KEY_SQLITE_QUERY,
+	KEY_CALLOUT_URL,
+	KEY_CALLOUT_TOKEN,
+	KEY_CALLOUT_TIMEOUT,
+	KEY_CALLOUT_TTL,
+	KEY_ADVERTISE_HOST,
+	KEY_MUX_DTLS,
+	KEY_MUX_RTP,
+	KEY_MUX_ZRTP,
+	KEY_MUX_CHANNEL,
+	KEY_MUX_IDLE,
+	KEY_LIFETIME_ALLOW,
+	KEY_LIFETIME_STEPS,
+	KEY_LOG_LEVEL,
+	KEY_LOG_FORMAT,
+	KEY_LOG_SAMPLING,
+}
+
+// registerFlags adds the cli flags to the flag set, skipping already registered ones so that
+// the same flag set can be used for more than one load
+func registerFlags(fs *pflag.FlagSet) {
+	if nil == fs.Lookup(FLAG_UDP_PORT) {
+		fs.Int(FLAG_UDP_PORT, DEFAULT_UDP_PORT, "Stun server udp port")
+	}
+	if nil == fs.Lookup(FLAG_TCP_PORT) {
+		fs.Int(FLAG_TCP_PORT, DEFAULT_TCP_PORT, "Stun server tcp port")
+	}
+	if nil == fs.Lookup(FLAG_LOG_LEVEL) {
+		fs.String(FLAG_LOG_LEVEL, DEFAULT_LOG_LEVEL, "Log level, one of debug, info, warn, error")
+	}
+}
+
+// NewConfiguration loads configuration using the given viper instance, flag set and cli arguments.
+// Precedence is flags > environment > configuration file > defaults. Config file search paths
+// added to v before the call are searched first, and an explicit config file set on v is used as is.
+func NewConfiguration(v *viper.Viper, fs *pflag.FlagSet, args []string) (*Configuration, error) {
+	// let viper read from configuration file, unless an explicit one is already given
+	v.SetConfigType("yaml")
+	if v.ConfigFileUsed() == "" {
+		v.SetConfigName("stun")
+		v.AddConfigPath("/etc/stun/")
+		v.AddConfigPath("./config/")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("reading config file %s failed: %w", v.ConfigFileUsed(), err)
+		}
+		slog.Info("Config file not found, using defaults", "error", err)
 	}
 
 	// let viper set environment variables prefix and register keys to look for
-	viper.SetEnvPrefix(ENV_PREFIX)
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.SetEnvPrefix(ENV_PREFIX)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	for _, key := range envKeys {
+		if err := v.BindEnv(key); nil != err {
+			return nil, fmt.Errorf("bind env failed for key %s: %w", key, err)
+		}
+	}
 
-	err := viper.BindEnv(KEY_UDP_PORT)
-	if nil != err {
-		log.Printf("Bind env failed for key %s with error: %s", KEY_UDP_PORT, err)
+	v.SetDefault(KEY_UDP_ENABLED, true)
+	v.SetDefault(KEY_TCP_ENABLED, true)
+	v.SetDefault(KEY_TLS_PORT, DEFAULT_TLS_PORT)
+	v.SetDefault(KEY_TLS_ALPN, slices.Clone(alpnProtocols))
+	v.SetDefault(KEY_MONITORING_PORT, DEFAULT_MONITORING_PORT)
+	v.SetDefault(KEY_MONITORING_PATH, DEFAULT_MONITORING_PATH)
+	v.SetDefault(KEY_PROBE_INTERVAL, DEFAULT_PROBE_INTERVAL)
+	v.SetDefault(KEY_ADMIN_PORT, DEFAULT_ADMIN_PORT)
+	v.SetDefault(KEY_SHUTDOWN_GRACE, DEFAULT_SHUTDOWN_GRACE)
+	v.SetDefault(KEY_SHUTDOWN_LIMIT, DEFAULT_SHUTDOWN_LIMIT)
+	v.SetDefault(KEY_BIND_POLICY, DEFAULT_BIND_POLICY)
+	v.SetDefault(KEY_BIND_ATTEMPTS, DEFAULT_BIND_ATTEMPTS)
+	v.SetDefault(KEY_BIND_BACKOFF, DEFAULT_BIND_BACKOFF)
+	v.SetDefault(KEY_BIND_MAX, DEFAULT_BIND_MAX)
+	v.SetDefault(KEY_OTEL_ENDPOINT, DEFAULT_OTEL_ENDPOINT)
+	v.SetDefault(KEY_OTEL_SERVICE, DEFAULT_OTEL_SERVICE)
+	v.SetDefault(KEY_OTEL_SAMPLE, DEFAULT_OTEL_SAMPLE)
+	v.SetDefault(KEY_OTEL_INTERVAL, DEFAULT_OTEL_INTERVAL)
+	v.SetDefault(KEY_CLUSTER_REFRESH, DEFAULT_CLUSTER_REFRESH)
+	v.SetDefault(KEY_AUTH_REALM, DEFAULT_AUTH_REALM)
+	v.SetDefault(KEY_AUTH_NONCE, DEFAULT_AUTH_NONCE)
+	v.SetDefault(KEY_AUTH_RELOAD, DEFAULT_AUTH_RELOAD)
+	v.SetDefault(KEY_SQLITE_QUERY, DEFAULT_SQLITE_QUERY)
+	v.SetDefault(KEY_CALLOUT_TIMEOUT, DEFAULT_CALLOUT_TIMEOUT)
+	v.SetDefault(KEY_CALLOUT_TTL, DEFAULT_CALLOUT_TTL)
+	v.SetDefault(KEY_MUX_IDLE, DEFAULT_MUX_IDLE)
+	v.SetDefault(KEY_LIFETIME_STEPS, []time.Duration{15 * time.Second, 30 * time.Second, time.Minute, 2 * time.Minute, 5 * time.Minute})
+	v.SetDefault(KEY_LOG_FORMAT, DEFAULT_LOG_FORMAT)
+	v.SetDefault(KEY_LOG_SAMPLING, DEFAULT_LOG_SAMPLING)
+
+	// parse cli arguments
+	registerFlags(fs)
+	if err := fs.Parse(args); nil != err {
+		return nil, err
 	}
-	err = viper.BindEnv(KEY_TCP_PORT)
-	if nil != err {
-		log.Printf("Bind env failed for key %s with error: %s", KEY_TCP_PORT, err)
+
+	// let viper read from flags (CLI)
+	if err := v.BindPFlag(KEY_UDP_PORT, fs.Lookup(FLAG_UDP_PORT)); nil != err {
+		return nil, fmt.Errorf("bind flag failed for key %s: %w", KEY_UDP_PORT, err)
 	}
-	err = viper.BindEnv(KEY_MONITORING_PORT)
-	if nil != err {
-		log.Printf("Bind env failed for key %s with error: %s", KEY_MONITORING_PORT, err)
+	if err := v.BindPFlag(KEY_TCP_PORT, fs.Lookup(FLAG_TCP_PORT)); nil != err {
+		return nil, fmt.Errorf("bind flag failed for key %s: %w", KEY_TCP_PORT, err)
 	}
-	err = viper.BindEnv(KEY_MONITORING_PATH)
-	if nil != err {
-		log.Printf("Bind env failed for key %s with error: %s", KEY_MONITORING_PATH, err)
+	if err := v.BindPFlag(KEY_LOG_LEVEL, fs.Lookup(FLAG_LOG_LEVEL)); nil != err {
+		return nil, fmt.Errorf("bind flag failed for key %s: %w", KEY_LOG_LEVEL, err)
+	}
+
+	config := Configuration{}
+	if err := v.Unmarshal(&config); err != nil {
+		return nil, fmt.Errorf("unmarshalling configuration failed: %w", err)
 	}
 
-	viper.SetDefault(KEY_MONITORING_PORT, DEFAULT_MONITORING_PORT)
-	viper.SetDefault(KEY_MONITORING_PATH, DEFAULT_MONITORING_PATH)
+	slog.Info("Using configuration", "configuration", config.String())
 
-	// use golang flag to get cli argumenst
-	flag.Int(FLAG_UDP_PORT, DEFAULT_UDP_PORT, "Stun server udp port")
-	flag.Int(FLAG_TCP_PORT, DEFAULT_TCP_PORT, "Stun server tcp port")
+	return &config, nil
+}
 
+// GetConfiguration loads configuration from the process wide viper instance, go and pflag
+// command lines and os.Args
+func GetConfiguration() (*Configuration, error) {
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
-	pflag.Parse()
+	return NewConfiguration(viper.GetViper(), pflag.CommandLine, os.Args[1:])
+}
 
-	// let viper read from flags (CLI)
-	err = viper.BindPFlag(KEY_UDP_PORT, pflag.Lookup(FLAG_UDP_PORT))
+// ConfigurationError lists every problem found while validating a configuration
+type ConfigurationError struct {
+	Problems []string
+}
+
+func (self *ConfigurationError) Error() string {
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(self.Problems, "; "))
+}
+
+func (self *ConfigurationError) add(format string, args ...any) {
+	self.Problems = append(self.Problems, fmt.Sprintf(format, args...))
+}
+
+func (self *ConfigurationError) checkPort(key string, port int) {
+	if port < MIN_PORT || port > MAX_PORT {
+		self.add("%s: port %d is out of range [%d, %d]", key, port, MIN_PORT, MAX_PORT)
+	}
+}
+
+func (self *ConfigurationError) checkPath(key string, path string) {
+	if !strings.HasPrefix(path, "/") {
+		self.add("%s: path %q should start with /", key, path)
+		return
+	}
+	if strings.ContainsAny(path, " \t\n?#") {
+		self.add("%s: path %q should not contain whitespace, query or fragment", key, path)
+	}
+}
+
+func (self *ConfigurationError) checkCIDR(key string, cidr string) {
+	if _, _, err := net.ParseCIDR(cidr); nil != err {
+		self.add("%s: %q is not a valid CIDR", key, cidr)
+	}
+}
+
+func (self *ConfigurationError) checkHostPort(key string, addr string) {
+	host, port, err := net.SplitHostPort(addr)
 	if nil != err {
-		log.Printf("Bind flag failed for key %s with error: %s", KEY_UDP_PORT, err)
+		self.add("%s: %q should be host:port, %s", key, addr, err)
+		return
 	}
-	err = viper.BindPFlag(KEY_TCP_PORT, pflag.Lookup(FLAG_TCP_PORT))
+	if host == "" {
+		self.add("%s: %q has no host", key, addr)
+	}
+	if n, err := strconv.Atoi(port); nil != err || n < MIN_PORT || n > MAX_PORT {
+		self.add("%s: port %q is out of range [%d, %d]", key, port, MIN_PORT, MAX_PORT)
+	}
+}
+
+func (self *ConfigurationError) checkFile(key string, path string) {
+	info, err := os.Stat(path)
 	if nil != err {
-		log.Printf("Bind flag failed for key %s with error: %s", KEY_TCP_PORT, err)
+		self.add("%s: file %q is not accessible: %s", key, path, err)
+		return
+	}
+	if info.IsDir() {
+		self.add("%s: %q is a directory, expected a file", key, path)
 	}
+}
 
-	config := Configuration{}
-	err = viper.Unmarshal(&config)
-	if err != nil {
-		log.Printf("Error in unmarshalling configuration, %s", err)
-		return nil, err
+// Validate checks the configuration and returns a *ConfigurationError holding all problems found, or nil
+func (self Configuration) Validate() error {
+	problems := &ConfigurationError{}
+
+	if !self.Udp.Enabled && !self.Tcp.Enabled {
+		problems.add("%s and %s: at least one stun listener should be enabled", KEY_UDP_ENABLED, KEY_TCP_ENABLED)
+	}
+	if self.Udp.Enabled {
+		problems.checkPort(KEY_UDP_PORT, self.Udp.Port)
+	}
+	if self.Tcp.Enabled {
+		problems.checkPort(KEY_TCP_PORT, self.Tcp.Port)
+	}
+	if self.Tls.Enabled {
+		problems.checkPort(KEY_TLS_PORT, self.Tls.Port)
+		problems.checkFile(KEY_TLS_CERT_FILE, self.Tls.CertFile)
+		problems.checkFile(KEY_TLS_KEY_FILE, self.Tls.KeyFile)
+		seen := map[string]bool{}
+		for _, protocol := range self.Tls.Alpn {
+			if !slices.Contains(alpnProtocols, protocol) {
+				problems.add("%s: %q should be one of %v", KEY_TLS_ALPN, protocol, alpnProtocols)
+			} else if seen[protocol] {
+				problems.add("%s: %q is repeated", KEY_TLS_ALPN, protocol)
+			}
+			seen[protocol] = true
+		}
+		if self.Tls.RequireAlpn && len(self.Tls.Alpn) == 0 {
+			problems.add("%s: no protocol is advertised, while %s is set", KEY_TLS_ALPN, KEY_REQUIRE_ALPN)
+		}
+	}
+	problems.checkPort(KEY_MONITORING_PORT, self.Monitoring.Port)
+	problems.checkPath(KEY_MONITORING_PATH, self.Monitoring.Path)
+	if self.Monitoring.Path == HEALTHZ_PATH || self.Monitoring.Path == READYZ_PATH {
+		problems.add("%s: %s is reserved for health checks", KEY_MONITORING_PATH, self.Monitoring.Path)
+	}
+	if self.Monitoring.ProbeInterval <= 0 {
+		problems.add("%s: %s should be positive", KEY_PROBE_INTERVAL, self.Monitoring.ProbeInterval)
+	}
+	if self.Admin.Enabled {
+		problems.checkPort(KEY_ADMIN_PORT, self.Admin.Port)
+		if self.Admin.Token == "" {
+			problems.add("%s: a token is required when admin api is enabled", KEY_ADMIN_TOKEN)
+		}
+	}
+	for _, cidr := range self.Acl.Allow {
+		problems.checkCIDR(KEY_ACL_ALLOW, cidr)
+	}
+	for _, cidr := range self.Acl.Deny {
+		problems.checkCIDR(KEY_ACL_DENY, cidr)
+	}
+	if self.Shutdown.GracePeriod < 0 {
+		problems.add("%s: %s should not be negative", KEY_SHUTDOWN_GRACE, self.Shutdown.GracePeriod)
+	}
+	if self.Shutdown.Deadline < 0 {
+		problems.add("%s: %s should not be negative", KEY_SHUTDOWN_LIMIT, self.Shutdown.Deadline)
+	}
+	switch self.Bind.Policy {
+	case BIND_FAIL_FAST:
+	case BIND_RETRY:
+		if self.Bind.Attempts < 1 {
+			problems.add("%s: %d should be at least 1", KEY_BIND_ATTEMPTS, self.Bind.Attempts)
+		}
+		if self.Bind.Backoff <= 0 {
+			problems.add("%s: %s should be positive", KEY_BIND_BACKOFF, self.Bind.Backoff)
+		}
+		if self.Bind.MaxBackoff < self.Bind.Backoff {
+			problems.add("%s: %s should not be less than %s", KEY_BIND_MAX, self.Bind.MaxBackoff, KEY_BIND_BACKOFF)
+		}
+	default:
+		problems.add("%s: unknown policy %q, should be %s or %s", KEY_BIND_POLICY, self.Bind.Policy, BIND_FAIL_FAST, BIND_RETRY)
+	}
+	if self.Telemetry.Enabled {
+		if _, _, err := net.SplitHostPort(self.Telemetry.Endpoint); nil != err {
+			problems.add("%s: %q should be host:port", KEY_OTEL_ENDPOINT, self.Telemetry.Endpoint)
+		}
+		if self.Telemetry.ServiceName == "" {
+			problems.add("%s: should not be empty", KEY_OTEL_SERVICE)
+		}
+		if self.Telemetry.SampleRatio < 0 || self.Telemetry.SampleRatio > 1 {
+			problems.add("%s: %g should be in [0, 1]", KEY_OTEL_SAMPLE, self.Telemetry.SampleRatio)
+		}
+		if self.Telemetry.ExportInterval <= 0 {
+			problems.add("%s: %s should be positive", KEY_OTEL_INTERVAL, self.Telemetry.ExportInterval)
+		}
+	}
+	if (self.Proxy.Tcp || self.Proxy.Udp) && len(self.Proxy.Trusted) == 0 {
+		problems.add("%s: trusted sources are required when proxy protocol is enabled", KEY_PROXY_TRUSTED)
+	}
+	for _, cidr := range self.Proxy.Trusted {
+		problems.checkCIDR(KEY_PROXY_TRUSTED, cidr)
+	}
+	if self.Alternate.Server != "" {
+		if _, _, err := parseIPPort(self.Alternate.Server); nil != err {
+			problems.add("%s: %q should be ip:port, %s", KEY_ALT_SERVER, self.Alternate.Server, err)
+		}
+	} else if self.Alternate.OnDrain || self.Alternate.MaxRate > 0 {
+		problems.add("%s: a server is required to redirect when draining or overloaded", KEY_ALT_SERVER)
+	}
+	if self.Alternate.MaxRate < 0 {
+		problems.add("%s: %d should not be negative", KEY_ALT_MAX_RATE, self.Alternate.MaxRate)
+	}
+	for i, rule := range self.Alternate.Rules {
+		key := fmt.Sprintf("%s[%d]", KEY_ALT_RULES, i)
+		problems.checkCIDR(key+".prefix", rule.Prefix)
+		if _, _, err := parseIPPort(rule.Server); nil != err {
+			problems.add("%s.server: %q should be ip:port, %s", key, rule.Server, err)
+		}
+	}
+	if self.Cluster.Enabled {
+		if !self.Udp.Enabled {
+			problems.add("%s: cluster needs the udp listener", KEY_CLUSTER_ENABLED)
+		}
+		if nil == net.ParseIP(self.Cluster.AdvertiseIP) {
+			problems.add("%s: %q is not an ip address", KEY_CLUSTER_IP, self.Cluster.AdvertiseIP)
+		}
+		if self.Cluster.Secret == "" {
+			problems.add("%s: a secret is required when cluster is enabled", KEY_CLUSTER_SECRET)
+		}
+		if len(self.Cluster.Peers) == 0 && self.Cluster.Srv == "" {
+			problems.add("%s: static peers or %s are required when cluster is enabled", KEY_CLUSTER_PEERS, KEY_CLUSTER_SRV)
+		}
+		for _, peer := range self.Cluster.Peers {
+			if _, _, err := parseIPPort(peer); nil != err {
+				problems.add("%s: %q should be ip:port, %s", KEY_CLUSTER_PEERS, peer, err)
+			}
+		}
+		if self.Cluster.Srv != "" && self.Cluster.Refresh <= 0 {
+			problems.add("%s: %s should be positive", KEY_CLUSTER_REFRESH, self.Cluster.Refresh)
+		}
+	}
+	if self.Auth.Enabled {
+		if self.Auth.Realm == "" {
+			problems.add("%s: a realm is required when auth is enabled", KEY_AUTH_REALM)
+		}
+		if self.Auth.NonceLifetime <= 0 {
+			problems.add("%s: %s should be positive", KEY_AUTH_NONCE, self.Auth.NonceLifetime)
+		}
+		if !self.Auth.OAuth.Enabled() && !self.Auth.Rest.Enabled() && !self.Auth.File.Enabled() && !self.Auth.Sqlite.Enabled() && !self.Auth.Http.Enabled() {
+			problems.add("%s: no credential source is configured", KEY_AUTH_ENABLED)
+		}
+	}
+	if self.Auth.OAuth.Enabled() {
+		problems.checkFile(KEY_OAUTH_KEY_FILE, self.Auth.OAuth.KeyFile)
+		if self.Auth.OAuth.ServerName == "" {
+			problems.add("%s: the name tokens are issued for is required", KEY_OAUTH_SERVER)
+		}
+		if self.Auth.OAuth.AuthorizationServer == "" {
+			problems.add("%s: the server clients get tokens from is required", KEY_OAUTH_AS)
+		}
+	}
+	for i, secret := range self.Auth.Rest.Secrets {
+		if secret == "" {
+			problems.add("%s: secret %d is empty", KEY_REST_SECRETS, i)
+		}
+	}
+	if self.Auth.File.Enabled() {
+		problems.checkFile(KEY_AUTH_FILE, self.Auth.File.Path)
+		if self.Auth.File.Reload < 0 {
+			problems.add("%s: %s should not be negative", KEY_AUTH_RELOAD, self.Auth.File.Reload)
+		}
+	}
+	if self.Auth.Sqlite.Enabled() {
+		problems.checkFile(KEY_SQLITE_PATH, self.Auth.Sqlite.Path)
+		if self.Auth.Sqlite.Query == "" {
+			problems.add("%s: a query selecting passwords is required", KEY_SQLITE_QUERY)
+		}
+	}
+	if self.Auth.Http.Enabled() {
+		if u, err := url.Parse(self.Auth.Http.Url); nil != err || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems.add("%s: %q should be an http or https url", KEY_CALLOUT_URL, self.Auth.Http.Url)
+		}
+		if self.Auth.Http.Timeout <= 0 {
+			problems.add("%s: %s should be positive", KEY_CALLOUT_TIMEOUT, self.Auth.Http.Timeout)
+		}
+		if self.Auth.Http.CacheTtl < 0 {
+			problems.add("%s: %s should not be negative", KEY_CALLOUT_TTL, self.Auth.Http.CacheTtl)
+		}
+	}
+	if host := self.Advertise.Host; host != "" && nil == net.ParseIP(host) {
+		if u, err := uri.Parse(uri.SCHEME_STUN + ":" + host); nil != err || u.Port != 0 {
+			problems.add("%s: %q should be a host name or an ip address", KEY_ADVERTISE_HOST, host)
+		}
+	}
+	if upstreams := self.Mux.Upstreams(); len(upstreams) > 0 {
+		if !self.Udp.Enabled {
+			problems.add("%s: forwarding needs the udp listener", KEY_UDP_ENABLED)
+		}
+		for _, mux := range []struct{ key, upstream string }{
+			{KEY_MUX_DTLS, self.Mux.Dtls},
+			{KEY_MUX_RTP, self.Mux.Rtp},
+			{KEY_MUX_ZRTP, self.Mux.Zrtp},
+			{KEY_MUX_CHANNEL, self.Mux.ChannelData},
+		} {
+			if mux.upstream != "" {
+				problems.checkHostPort(mux.key, mux.upstream)
+			}
+		}
+		if self.Mux.IdleTimeout <= 0 {
+			problems.add("%s: %s should be positive", KEY_MUX_IDLE, self.Mux.IdleTimeout)
+		}
+	}
+	if self.Keepalive.Lifetime.Enabled() {
+		if !self.Udp.Enabled {
+			problems.add("%s: the lifetime experiment needs the udp listener", KEY_UDP_ENABLED)
+		}
+		for _, cidr := range self.Keepalive.Lifetime.Allow {
+			problems.checkCIDR(KEY_LIFETIME_ALLOW, cidr)
+		}
+		if len(self.Keepalive.Lifetime.Schedule) == 0 {
+			problems.add("%s: a schedule is required when the lifetime experiment is enabled", KEY_LIFETIME_STEPS)
+		}
+		for i, delay := range self.Keepalive.Lifetime.Schedule {
+			if delay <= 0 || (i > 0 && delay <= self.Keepalive.Lifetime.Schedule[i-1]) {
+				problems.add("%s: delays should be positive and increasing, %s is not", KEY_LIFETIME_STEPS, delay)
+			}
+		}
+	}
+	if _, err := ParseLevel(self.Log.Level); nil != err {
+		problems.add("%s: unknown level %q", KEY_LOG_LEVEL, self.Log.Level)
+	}
+	if self.Log.Format != LOG_FORMAT_TEXT && self.Log.Format != LOG_FORMAT_JSON {
+		problems.add("%s: unknown format %q, should be %s or %s", KEY_LOG_FORMAT, self.Log.Format, LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+	}
+	if self.Log.DebugSampling < 1 {
+		problems.add("%s: %d should be at least 1", KEY_LOG_SAMPLING, self.Log.DebugSampling)
 	}
 
-	log.Println("Using configuration...")
-	log.Println(config)
+	// udp and tcp may share a port number, listeners on tcp may not share among themselves
+	tcpPorts := []struct {
+		key     string
+		port    int
+		enabled bool
+	}{
+		{KEY_TCP_PORT, self.Tcp.Port, self.Tcp.Enabled},
+		{KEY_TLS_PORT, self.Tls.Port, self.Tls.Enabled},
+		{KEY_MONITORING_PORT, self.Monitoring.Port, true},
+		{KEY_ADMIN_PORT, self.Admin.Port, self.Admin.Enabled},
+	}
+	for i, a := range tcpPorts {
+		for _, b := range tcpPorts[i+1:] {
+			if a.enabled && b.enabled && a.port == b.port {
+				problems.add("%s and %s: both use tcp port %d", a.key, b.key, a.port)
+			}
+		}
+	}
 
-	return &config, nil
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
 }
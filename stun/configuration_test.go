@@ -0,0 +1,398 @@
+package stun
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func validConfiguration() Configuration {
+	return Configuration{
+		Udp:        ServerConf{Enabled: true, Port: DEFAULT_UDP_PORT},
+		Tcp:        ServerConf{Enabled: true, Port: DEFAULT_TCP_PORT},
+		Monitoring: MonitoringConf{Port: DEFAULT_MONITORING_PORT, Path: DEFAULT_MONITORING_PATH, ProbeInterval: DEFAULT_PROBE_INTERVAL},
+		Shutdown:   ShutdownConf{GracePeriod: DEFAULT_SHUTDOWN_GRACE, Deadline: DEFAULT_SHUTDOWN_LIMIT},
+		Bind:       BindConf{Policy: DEFAULT_BIND_POLICY, Attempts: DEFAULT_BIND_ATTEMPTS, Backoff: DEFAULT_BIND_BACKOFF, MaxBackoff: DEFAULT_BIND_MAX},
+		Log:        LogConf{Level: DEFAULT_LOG_LEVEL, Format: DEFAULT_LOG_FORMAT, DebugSampling: DEFAULT_LOG_SAMPLING},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := map[string]struct {
+		modify   func(*Configuration)
+		problems int
+	}{
+		"defaults should be valid": {
+			modify:   func(c *Configuration) {},
+			problems: 0,
+		},
+		"port 0 should be rejected": {
+			modify:   func(c *Configuration) { c.Udp.Port = 0 },
+			problems: 1,
+		},
+		"port above 65535 should be rejected": {
+			modify:   func(c *Configuration) { c.Tcp.Port = 70000 },
+			problems: 1,
+		},
+		"tcp and monitoring on same port should conflict": {
+			modify:   func(c *Configuration) { c.Monitoring.Port = c.Tcp.Port },
+			problems: 1,
+		},
+		"admin without token should be rejected": {
+			modify:   func(c *Configuration) { c.Admin = AdminConf{Enabled: true, Port: DEFAULT_ADMIN_PORT} },
+			problems: 1,
+		},
+		"admin and monitoring on same port should conflict": {
+			modify: func(c *Configuration) {
+				c.Admin = AdminConf{Enabled: true, Port: DEFAULT_MONITORING_PORT, Token: "secret"}
+			},
+			problems: 1,
+		},
+		"disabled admin should not be checked": {
+			modify:   func(c *Configuration) { c.Admin = AdminConf{Port: DEFAULT_MONITORING_PORT} },
+			problems: 0,
+		},
+		"invalid acl entries should be rejected": {
+			modify: func(c *Configuration) {
+				c.Acl = AclConf{Allow: []string{"10.0.0.0/8", "10.0.0.1"}, Deny: []string{"any"}}
+			},
+			problems: 2,
+		},
+		"negative grace period and deadline should be rejected": {
+			modify:   func(c *Configuration) { c.Shutdown = ShutdownConf{GracePeriod: -time.Second, Deadline: -time.Second} },
+			problems: 2,
+		},
+		"zero grace period and deadline should be valid": {
+			modify:   func(c *Configuration) { c.Shutdown = ShutdownConf{} },
+			problems: 0,
+		},
+		"unknown bind policy should be rejected": {
+			modify:   func(c *Configuration) { c.Bind.Policy = "ignore" },
+			problems: 1,
+		},
+		"retry policy without backoff should be rejected": {
+			modify:   func(c *Configuration) { c.Bind = BindConf{Policy: BIND_RETRY, Attempts: 3} },
+			problems: 1,
+		},
+		"telemetry should be checked when enabled": {
+			modify: func(c *Configuration) {
+				c.Telemetry = TelemetryConf{Enabled: true, Endpoint: "collector", ServiceName: DEFAULT_OTEL_SERVICE, SampleRatio: 2, ExportInterval: DEFAULT_OTEL_INTERVAL}
+			},
+			problems: 2,
+		},
+		"disabled telemetry should not be checked": {
+			modify:   func(c *Configuration) { c.Telemetry = TelemetryConf{SampleRatio: 2} },
+			problems: 0,
+		},
+		"proxy protocol without trusted sources should be rejected": {
+			modify:   func(c *Configuration) { c.Proxy = ProxyConf{Tcp: true} },
+			problems: 1,
+		},
+		"invalid trusted sources should be rejected": {
+			modify:   func(c *Configuration) { c.Proxy = ProxyConf{Udp: true, Trusted: []string{"10.0.0.0/33"}} },
+			problems: 1,
+		},
+		"redirect on drain without server should be rejected": {
+			modify:   func(c *Configuration) { c.Alternate = AlternateConf{OnDrain: true} },
+			problems: 1,
+		},
+		"alternate host names should be rejected": {
+			modify: func(c *Configuration) {
+				c.Alternate = AlternateConf{Server: "stun.example.org:3478", Rules: []AlternateRule{{Prefix: "10.0.0.0/8", Server: "192.0.2.1"}}}
+			},
+			problems: 2,
+		},
+		"cluster without secret and peers should be rejected": {
+			modify:   func(c *Configuration) { c.Cluster = ClusterConf{Enabled: true, AdvertiseIP: "192.0.2.1"} },
+			problems: 2,
+		},
+		"cluster with srv discovery should be accepted": {
+			modify: func(c *Configuration) {
+				c.Cluster = ClusterConf{Enabled: true, AdvertiseIP: "192.0.2.1", Srv: "_stun._udp.example.org", Refresh: time.Minute, Secret: "s3cret"}
+			},
+			problems: 0,
+		},
+		"auth without realm, nonce lifetime and credential source should be rejected": {
+			modify:   func(c *Configuration) { c.Auth = AuthConf{Enabled: true} },
+			problems: 3,
+		},
+		"oauth without key file and names should be rejected": {
+			modify: func(c *Configuration) {
+				c.Auth = AuthConf{Enabled: true, Realm: "lstun", NonceLifetime: time.Minute, OAuth: OAuthConf{KeyFile: "/nonexistent/keys.json"}}
+			},
+			problems: 3,
+		},
+		"rest credentials should be accepted as credential source": {
+			modify: func(c *Configuration) {
+				c.Auth = AuthConf{Enabled: true, Realm: "lstun", NonceLifetime: time.Minute, Rest: RestConf{Secrets: []string{"new", "old"}}}
+			},
+			problems: 0,
+		},
+		"empty rest secret should be rejected": {
+			modify:   func(c *Configuration) { c.Auth.Rest = RestConf{Secrets: []string{"new", ""}} },
+			problems: 1,
+		},
+		"missing credentials file, database and query should be rejected": {
+			modify: func(c *Configuration) {
+				c.Auth = AuthConf{Enabled: true, Realm: "lstun", NonceLifetime: time.Minute, File: FileCredentialsConf{Path: "/nonexistent/users"}, Sqlite: SqliteConf{Path: "/nonexistent/users.db"}}
+			},
+			problems: 3,
+		},
+		"callout without http url and timeout should be rejected": {
+			modify: func(c *Configuration) {
+				c.Auth = AuthConf{Enabled: true, Realm: "lstun", NonceLifetime: time.Minute, Http: CalloutConf{Url: "auth.example.org/passwords"}}
+			},
+			problems: 2,
+		},
+		"advertised host with port or scheme should be rejected": {
+			modify:   func(c *Configuration) { c.Advertise.Host = "stun:example.org:3478" },
+			problems: 1,
+		},
+		"advertised ipv6 host should be accepted": {
+			modify:   func(c *Configuration) { c.Advertise.Host = "2001:db8::1" },
+			problems: 0,
+		},
+		"mux upstreams should be accepted": {
+			modify: func(c *Configuration) {
+				c.Mux = MuxConf{Dtls: "media.example.org:4443", Rtp: "[2001:db8::1]:5004", IdleTimeout: time.Minute}
+			},
+			problems: 0,
+		},
+		"invalid mux upstreams should be rejected": {
+			modify: func(c *Configuration) {
+				c.Mux = MuxConf{Dtls: "media.example.org", Rtp: ":5004", ChannelData: "turn.example.org:0"}
+			},
+			problems: 4,
+		},
+		"mux without udp listener should be rejected": {
+			modify: func(c *Configuration) {
+				c.Udp.Enabled = false
+				c.Mux = MuxConf{Zrtp: "192.0.2.1:5006", IdleTimeout: time.Minute}
+			},
+			problems: 1,
+		},
+		"lifetime experiment should be accepted": {
+			modify: func(c *Configuration) {
+				c.Keepalive.Lifetime = LifetimeConf{Allow: []string{"192.0.2.0/24"}, Schedule: []time.Duration{time.Second, time.Minute}}
+			},
+			problems: 0,
+		},
+		"invalid lifetime experiment should be rejected": {
+			modify: func(c *Configuration) {
+				c.Keepalive.Lifetime = LifetimeConf{Allow: []string{"192.0.2.1"}, Schedule: []time.Duration{time.Minute, time.Second, 0}}
+			},
+			problems: 3,
+		},
+		"lifetime experiment without schedule should be rejected": {
+			modify: func(c *Configuration) {
+				c.Keepalive.Lifetime = LifetimeConf{Allow: []string{"192.0.2.0/24"}}
+			},
+			problems: 1,
+		},
+		"udp and monitoring on same port should not conflict": {
+			modify:   func(c *Configuration) { c.Monitoring.Port = c.Udp.Port; c.Tcp.Port = 3479 },
+			problems: 0,
+		},
+		"disabled listener port should not be checked": {
+			modify:   func(c *Configuration) { c.Tcp.Enabled = false; c.Tcp.Port = 0 },
+			problems: 0,
+		},
+		"disabling all stun listeners should be rejected": {
+			modify:   func(c *Configuration) { c.Udp.Enabled = false; c.Tcp.Enabled = false },
+			problems: 1,
+		},
+		"health paths should not be used for metrics": {
+			modify:   func(c *Configuration) { c.Monitoring.Path = READYZ_PATH },
+			problems: 1,
+		},
+		"non positive probe interval should be rejected": {
+			modify:   func(c *Configuration) { c.Monitoring.ProbeInterval = 0 },
+			problems: 1,
+		},
+		"relative monitoring path should be rejected": {
+			modify:   func(c *Configuration) { c.Monitoring.Path = "metrics" },
+			problems: 1,
+		},
+		"monitoring path with query should be rejected": {
+			modify:   func(c *Configuration) { c.Monitoring.Path = "/metrics?x=1" },
+			problems: 1,
+		},
+		"unknown log level should be rejected": {
+			modify:   func(c *Configuration) { c.Log.Level = "verbose" },
+			problems: 1,
+		},
+		"unknown log format should be rejected": {
+			modify:   func(c *Configuration) { c.Log.Format = "xml" },
+			problems: 1,
+		},
+		"debug sampling below 1 should be rejected": {
+			modify:   func(c *Configuration) { c.Log.DebugSampling = 0 },
+			problems: 1,
+		},
+		"all problems should be listed": {
+			modify: func(c *Configuration) {
+				c.Udp.Port = -1
+				c.Tcp.Port = 0
+				c.Monitoring.Port = 0
+				c.Monitoring.Path = ""
+			},
+			problems: 5,
+		},
+	}
+
+	for name, test := range testCases {
+		// test := test // NOTE: uncomment for Go < 1.22, see /doc/faq#closures_and_goroutines
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			conf := validConfiguration()
+			test.modify(&conf)
+
+			err := conf.Validate()
+			if test.problems == 0 {
+				if nil != err {
+					t.Errorf("Expected valid configuration, got error: %s", err)
+				}
+				return
+			}
+
+			var confErr *ConfigurationError
+			if !errors.As(err, &confErr) {
+				t.Fatalf("Expected *ConfigurationError, got %v", err)
+			}
+			if len(confErr.Problems) != test.problems {
+				t.Errorf("Expected %d problems, got %d: %v", test.problems, len(confErr.Problems), confErr.Problems)
+			}
+		})
+	}
+}
+
+func TestValidateHelpers(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cert.pem")
+	if err := os.WriteFile(file, []byte("test"), 0o600); nil != err {
+		t.Fatal(err)
+	}
+
+	problems := &ConfigurationError{}
+	problems.checkCIDR("acl", "10.0.0.0/8")
+	problems.checkCIDR("acl", "fd00::/8")
+	problems.checkFile("tls.cert", file)
+	if len(problems.Problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems.Problems)
+	}
+
+	problems.checkCIDR("acl", "10.0.0.0")
+	problems.checkCIDR("acl", "10.0.0.0/33")
+	problems.checkFile("tls.cert", filepath.Join(dir, "missing.pem"))
+	problems.checkFile("tls.cert", dir)
+	if len(problems.Problems) != 4 {
+		t.Errorf("Expected 4 problems, got %v", problems.Problems)
+	}
+}
+
+func TestNewConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "stun.yaml")
+	content := "udp:\n  enabled: true\n  port: 4444\ntcp:\n  enabled: true\n  port: 4444\nmonitoring:\n  port: 9091\n  path: \"/prom\"\n  probe_interval: 30s\n"
+	if err := os.WriteFile(configFile, []byte(content), 0o600); nil != err {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		file       string
+		env        map[string]string
+		args       []string
+		udpPort    int
+		tcpPort    int
+		monitoring MonitoringConf
+	}{
+		"defaults should provide standard stun port 3478": {
+			args:       []string{},
+			udpPort:    DEFAULT_UDP_PORT,
+			tcpPort:    DEFAULT_TCP_PORT,
+			monitoring: MonitoringConf{Port: DEFAULT_MONITORING_PORT, Path: DEFAULT_MONITORING_PATH, ProbeInterval: DEFAULT_PROBE_INTERVAL},
+		},
+		"configuration file should override defaults": {
+			file:       configFile,
+			args:       []string{},
+			udpPort:    4444,
+			tcpPort:    4444,
+			monitoring: MonitoringConf{Port: 9091, Path: "/prom", ProbeInterval: 30 * time.Second},
+		},
+		"environments should override configuration file": {
+			file:       configFile,
+			env:        map[string]string{"LSTN_UDP_PORT": "5555", "LSTN_MONITORING_PATH": "/env", "LSTN_MONITORING_PROBE_INTERVAL": "5s"},
+			args:       []string{},
+			udpPort:    5555,
+			tcpPort:    4444,
+			monitoring: MonitoringConf{Port: 9091, Path: "/env", ProbeInterval: 5 * time.Second},
+		},
+		"cli flags should override all": {
+			file:       configFile,
+			env:        map[string]string{"LSTN_UDP_PORT": "5555"},
+			args:       []string{"--udp-port", "6666", "--tcp-port", "7777"},
+			udpPort:    6666,
+			tcpPort:    7777,
+			monitoring: MonitoringConf{Port: 9091, Path: "/prom", ProbeInterval: 30 * time.Second},
+		},
+	}
+
+	for name, test := range testCases {
+		// environment is process wide, so these cases can not run in parallel
+		t.Run(name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+
+			v := viper.New()
+			if test.file != "" {
+				v.SetConfigFile(test.file)
+			} else {
+				v.AddConfigPath(t.TempDir())
+			}
+			fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+
+			conf, err := NewConfiguration(v, fs, test.args)
+			if nil != err {
+				t.Fatalf("Could not load configuration: %s", err)
+			}
+			if conf.Udp.Port != test.udpPort {
+				t.Errorf("udp port %d is not same as expected %d", conf.Udp.Port, test.udpPort)
+			}
+			if conf.Tcp.Port != test.tcpPort {
+				t.Errorf("tcp port %d is not same as expected %d", conf.Tcp.Port, test.tcpPort)
+			}
+			if conf.Monitoring != test.monitoring {
+				t.Errorf("monitoring %s is not same as expected %s", conf.Monitoring, test.monitoring)
+			}
+		})
+	}
+}
+
+func TestNewConfigurationTwice(t *testing.T) {
+	fs := pflag.NewFlagSet("twice", pflag.ContinueOnError)
+	for i := 0; i < 2; i++ {
+		if _, err := NewConfiguration(viper.New(), fs, []string{"--udp-port", "4000"}); nil != err {
+			t.Fatalf("Load %d failed with error: %s", i, err)
+		}
+	}
+}
+
+func TestNewConfigurationMalformedFile(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "stun.yaml")
+	if err := os.WriteFile(configFile, []byte("udp: [port"), 0o600); nil != err {
+		t.Fatal(err)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(configFile)
+	if _, err := NewConfiguration(v, pflag.NewFlagSet("malformed", pflag.ContinueOnError), nil); nil == err {
+		t.Error("Expected error for malformed configuration file")
+	}
+}
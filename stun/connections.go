@@ -0,0 +1,86 @@
+package stun
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes an open tcp or tls connection
+type ConnInfo struct {
+	Transport  string    `json:"transport"`
+	LocalAddr  string    `json:"local_addr"`
+	RemoteAddr string    `json:"remote_addr"`
+	Since      time.Time `json:"since"`
+}
+
+// Connections tracks open stream connections. Methods are no-op on a nil receiver.
+type Connections struct {
+	mu    sync.Mutex
+	conns map[net.Conn]ConnInfo
+}
+
+func NewConnections() *Connections {
+	return &Connections{conns: map[net.Conn]ConnInfo{}}
+}
+
+func (self *Connections) add(conn net.Conn, transport string) {
+	if nil == self {
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.conns[conn] = ConnInfo{
+		Transport:  transport,
+		LocalAddr:  conn.LocalAddr().String(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Since:      time.Now(),
+	}
+}
+
+func (self *Connections) remove(conn net.Conn) {
+	if nil == self {
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	delete(self.conns, conn)
+}
+
+// closeAll closes every open connection, so that blocked reads return
+func (self *Connections) closeAll() {
+	if nil == self {
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for conn := range self.conns {
+		conn.Close()
+	}
+}
+
+// List returns open connections, oldest first
+func (self *Connections) List() []ConnInfo {
+	list := []ConnInfo{}
+	if nil == self {
+		return list
+	}
+
+	self.mu.Lock()
+	for conn, info := range self.conns {
+		// proxied connections know their client only after the header is read
+		info.RemoteAddr = conn.RemoteAddr().String()
+		list = append(list, info)
+	}
+	self.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+	return list
+}
@@ -0,0 +1,366 @@
+package stun
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// CALLOUT_CACHE_SIZE bounds the number of usernames whose callout answers are cached
+	CALLOUT_CACHE_SIZE = 4096
+	// CALLOUT_MAX_IN_FLIGHT bounds the callouts made at once, further lookups fail at once
+	CALLOUT_MAX_IN_FLIGHT = 64
+)
+
+var ErrCalloutBusy = errors.New("too many credential callouts in flight")
+
+type FileCredentialsConf struct {
+	// Path is a file of username:password lines, no credentials are read from a file when empty
+	Path string
+	// Reload is the interval the file is checked for changes at, 0 disables reloading
+	Reload time.Duration
+}
+
+func (self FileCredentialsConf) String() string {
+	return fmt.Sprintf("{Path: %s, Reload: %s}", self.Path, self.Reload)
+}
+
+func (self FileCredentialsConf) Enabled() bool {
+	return self.Path != ""
+}
+
+type SqliteConf struct {
+	// Path is the database file, opened read only. No credentials are read from a database when empty.
+	Path string
+	// Query selects the passwords of the username given as its only parameter
+	Query string
+}
+
+func (self SqliteConf) String() string {
+	return fmt.Sprintf("{Path: %s, Query: %s}", self.Path, self.Query)
+}
+
+func (self SqliteConf) Enabled() bool {
+	return self.Path != ""
+}
+
+type CalloutConf struct {
+	// Url of the auth service, passwords are not called out for when empty
+	Url string
+	// Token is sent as a bearer token, when set
+	Token   string
+	Timeout time.Duration
+	// CacheTtl is how long answers are reused for, 0 disables caching
+	CacheTtl time.Duration `mapstructure:"cache_ttl"`
+}
+
+func (self CalloutConf) String() string {
+	token := ""
+	if self.Token != "" {
+		token = REDACTED
+	}
+	return fmt.Sprintf("{Url: %s, Token: %s, Timeout: %s, CacheTtl: %s}", self.Url, token, self.Timeout, self.CacheTtl)
+}
+
+func (self CalloutConf) Enabled() bool {
+	return self.Url != ""
+}
+
+// parseCredentials reads username:password lines, skipping empty ones and # comments
+func parseCredentials(buf []byte) (map[string]string, error) {
+	passwords := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, password, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("line %d should be username:password", line)
+		}
+		if _, ok := passwords[username]; ok {
+			return nil, fmt.Errorf("line %d repeats username %q", line, username)
+		}
+		passwords[username] = password
+	}
+	return passwords, scanner.Err()
+}
+
+// FileCredentials is a CredentialStore of a htpasswd like file. Passwords are kept in plain text,
+// as the long-term credential mechanism needs them, so the file should be readable only by the
+// server.
+type FileCredentials struct {
+	conf FileCredentialsConf
+
+	mu        sync.RWMutex
+	passwords map[string]string
+	modified  time.Time
+	size      int64
+}
+
+func NewFileCredentials(conf FileCredentialsConf) (*FileCredentials, error) {
+	self := &FileCredentials{conf: conf}
+	if _, err := self.Reload(); nil != err {
+		return nil, err
+	}
+	return self, nil
+}
+
+// Reload reads the file again if it changed since it was last read, and reports whether it did.
+// The credentials read before are kept when the file is invalid.
+func (self *FileCredentials) Reload() (bool, error) {
+	info, err := os.Stat(self.conf.Path)
+	if nil != err {
+		return false, err
+	}
+	self.mu.RLock()
+	unchanged := info.ModTime().Equal(self.modified) && info.Size() == self.size
+	self.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	buf, err := os.ReadFile(self.conf.Path)
+	if nil != err {
+		return false, err
+	}
+	passwords, err := parseCredentials(buf)
+	if nil != err {
+		return false, fmt.Errorf("credentials file %s is invalid: %w", self.conf.Path, err)
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.passwords = passwords
+	self.modified = info.ModTime()
+	self.size = info.Size()
+	return true, nil
+}
+
+func (self *FileCredentials) Passwords(ctx context.Context, username string) ([]string, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if password, ok := self.passwords[username]; ok {
+		return []string{password}, nil
+	}
+	return nil, nil
+}
+
+func (self *FileCredentials) run(sup *Supervisor) {
+	if self.conf.Reload <= 0 {
+		return
+	}
+	sup.Go("credentials reload", func(ctx context.Context) error {
+		ticker := time.NewTicker(self.conf.Reload)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			reloaded, err := self.Reload()
+			if nil != err {
+				slog.Warn("Credentials reload failed, keeping previous ones", "path", self.conf.Path, "error", err)
+			} else if reloaded {
+				slog.Info("Credentials reloaded", "path", self.conf.Path)
+			}
+		}
+	})
+}
+
+// SqliteCredentials is a CredentialStore of an embedded SQLite database
+type SqliteCredentials struct {
+	db    *sql.DB
+	query string
+}
+
+func NewSqliteCredentials(conf SqliteConf) (*SqliteCredentials, error) {
+	dsn := (&url.URL{Scheme: "file", Opaque: conf.Path, RawQuery: "mode=ro"}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if nil != err {
+		return nil, err
+	}
+	if err := db.Ping(); nil != err {
+		db.Close()
+		return nil, fmt.Errorf("credentials database %s can not be opened: %w", conf.Path, err)
+	}
+	return &SqliteCredentials{db: db, query: conf.Query}, nil
+}
+
+func (self *SqliteCredentials) Passwords(ctx context.Context, username string) ([]string, error) {
+	rows, err := self.db.QueryContext(ctx, self.query, username)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passwords []string
+	for rows.Next() {
+		var password string
+		if err := rows.Scan(&password); nil != err {
+			return nil, err
+		}
+		passwords = append(passwords, password)
+	}
+	return passwords, rows.Err()
+}
+
+func (self *SqliteCredentials) Close() error {
+	return self.db.Close()
+}
+
+// calloutAnswer is the body of a successful callout
+type calloutAnswer struct {
+	Passwords []string `json:"passwords"`
+}
+
+type calloutEntry struct {
+	passwords []string
+	expires   time.Time
+}
+
+// calloutCall is a callout in flight, shared by concurrent lookups of the same username
+type calloutCall struct {
+	done      chan struct{}
+	passwords []string
+	err       error
+}
+
+// CalloutCredentials is a CredentialStore asking an auth service over http. The service is
+// called with GET url?username=&realm= and answers 200 with {"passwords": [...]}, or 404 for
+// unknown users. Both answers are cached. Concurrent lookups of a username share one callout,
+// and at most CALLOUT_MAX_IN_FLIGHT callouts are made at once.
+type CalloutCredentials struct {
+	conf     CalloutConf
+	realm    string
+	client   *http.Client
+	inflight chan struct{}
+
+	mu    sync.Mutex
+	cache map[string]calloutEntry
+	calls map[string]*calloutCall
+}
+
+func NewCalloutCredentials(conf CalloutConf, realm string) *CalloutCredentials {
+	return &CalloutCredentials{
+		conf:     conf,
+		realm:    realm,
+		client:   &http.Client{Timeout: conf.Timeout},
+		inflight: make(chan struct{}, CALLOUT_MAX_IN_FLIGHT),
+		cache:    map[string]calloutEntry{},
+		calls:    map[string]*calloutCall{},
+	}
+}
+
+func (self *CalloutCredentials) cached(username string, now time.Time) ([]string, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	entry, ok := self.cache[username]
+	if !ok || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.passwords, true
+}
+
+func (self *CalloutCredentials) store(username string, passwords []string, now time.Time) {
+	if self.conf.CacheTtl <= 0 {
+		return
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.cache[username]; !ok && len(self.cache) >= CALLOUT_CACHE_SIZE {
+		// expired entries go first, otherwise the oldest one, entries live equally long
+		oldest := ""
+		for cachedUsername, entry := range self.cache {
+			if now.After(entry.expires) {
+				delete(self.cache, cachedUsername)
+			} else if oldest == "" || entry.expires.Before(self.cache[oldest].expires) {
+				oldest = cachedUsername
+			}
+		}
+		if len(self.cache) >= CALLOUT_CACHE_SIZE {
+			delete(self.cache, oldest)
+		}
+	}
+	self.cache[username] = calloutEntry{passwords: passwords, expires: now.Add(self.conf.CacheTtl)}
+}
+
+func (self *CalloutCredentials) Passwords(ctx context.Context, username string) ([]string, error) {
+	if passwords, ok := self.cached(username, time.Now()); ok {
+		return passwords, nil
+	}
+
+	self.mu.Lock()
+	if call, ok := self.calls[username]; ok {
+		self.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.passwords, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	select {
+	case self.inflight <- struct{}{}:
+	default:
+		self.mu.Unlock()
+		return nil, ErrCalloutBusy
+	}
+	call := &calloutCall{done: make(chan struct{})}
+	self.calls[username] = call
+	self.mu.Unlock()
+
+	call.passwords, call.err = self.callout(ctx, username)
+	<-self.inflight
+	self.mu.Lock()
+	delete(self.calls, username)
+	self.mu.Unlock()
+	close(call.done)
+	return call.passwords, call.err
+}
+
+// callout asks the auth service for the passwords of username, caching the answer
+func (self *CalloutCredentials) callout(ctx context.Context, username string) ([]string, error) {
+	query := url.Values{"username": {username}, "realm": {self.realm}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, self.conf.Url+"?"+query.Encode(), nil)
+	if nil != err {
+		return nil, err
+	}
+	if self.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+self.conf.Token)
+	}
+	resp, err := self.client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var answer calloutAnswer
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&answer); nil != err {
+			return nil, fmt.Errorf("callout answer is not json: %w", err)
+		}
+	case http.StatusNotFound:
+	default:
+		return nil, fmt.Errorf("callout answered %s", resp.Status)
+	}
+	self.store(username, answer.Passwords, time.Now())
+	return answer.Passwords, nil
+}
@@ -0,0 +1,288 @@
+package stun
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCredentials(t *testing.T) {
+	passwords, err := parseCredentials([]byte("# users\nalice:wonder:land\n\n  bob:builder  \ncarol:\n"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"alice": "wonder:land", "bob": "builder", "carol": ""}
+	if len(passwords) != len(expected) {
+		t.Fatalf("parsed %v, expected %v", passwords, expected)
+	}
+	for username, password := range expected {
+		if passwords[username] != password {
+			t.Errorf("password of %s is %q, expected %q", username, passwords[username], password)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"missing separator": "alice\n",
+		"empty username":    ":secret\n",
+		"repeated username": "alice:a\nalice:b\n",
+	} {
+		if _, err := parseCredentials([]byte(content)); nil == err {
+			t.Errorf("%s should be rejected", name)
+		}
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	write := func(content string, modified time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); nil != err {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); nil != err {
+			t.Fatal(err)
+		}
+	}
+	passwords := func(store CredentialStore, username string) []string {
+		t.Helper()
+		passwords, err := store.Passwords(context.Background(), username)
+		if nil != err {
+			t.Fatal(err)
+		}
+		return passwords
+	}
+
+	now := time.Now()
+	write("alice:wonderland\n", now.Add(-time.Hour))
+	store, err := NewFileCredentials(FileCredentialsConf{Path: path})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if got := passwords(store, "alice"); !slices.Equal(got, []string{"wonderland"}) {
+		t.Errorf("alice has passwords %v", got)
+	}
+	if got := passwords(store, "bob"); len(got) != 0 {
+		t.Errorf("unknown bob has passwords %v", got)
+	}
+
+	if reloaded, err := store.Reload(); nil != err || reloaded {
+		t.Errorf("unchanged file reloaded %t with error %v", reloaded, err)
+	}
+	write("alice:looking-glass\nbob:builder\n", now)
+	if reloaded, err := store.Reload(); nil != err || !reloaded {
+		t.Fatalf("changed file reloaded %t with error %v", reloaded, err)
+	}
+	if got := passwords(store, "alice"); !slices.Equal(got, []string{"looking-glass"}) {
+		t.Errorf("alice has passwords %v after reload", got)
+	}
+
+	write("bob\n", now.Add(time.Hour))
+	if _, err := store.Reload(); nil == err {
+		t.Error("invalid file should not be reloaded")
+	}
+	if got := passwords(store, "bob"); !slices.Equal(got, []string{"builder"}) {
+		t.Errorf("bob has passwords %v after invalid reload", got)
+	}
+
+	if _, err := NewFileCredentials(FileCredentialsConf{Path: path}); nil == err {
+		t.Error("invalid file should be rejected")
+	}
+}
+
+func TestSqliteCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := sql.Open("sqlite", path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		"CREATE TABLE users (username TEXT NOT NULL, password TEXT NOT NULL)",
+		"INSERT INTO users VALUES ('alice', 'wonderland'), ('alice', 'looking-glass'), ('bob', 'builder')",
+	} {
+		if _, err := db.Exec(statement); nil != err {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store, err := NewSqliteCredentials(SqliteConf{Path: path, Query: DEFAULT_SQLITE_QUERY + " ORDER BY password DESC"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for username, expected := range map[string][]string{
+		"alice":       {"wonderland", "looking-glass"},
+		"bob":         {"builder"},
+		"carol":       nil,
+		"' OR '1'='1": nil,
+	} {
+		passwords, err := store.Passwords(context.Background(), username)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if !slices.Equal(passwords, expected) {
+			t.Errorf("%s has passwords %v, expected %v", username, passwords, expected)
+		}
+	}
+
+	if _, err := store.db.Exec("DELETE FROM users"); nil == err {
+		t.Error("database should be opened read only")
+	}
+
+	bad, err := NewSqliteCredentials(SqliteConf{Path: path, Query: "SELECT password FROM accounts WHERE username = ?"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	if _, err := bad.Passwords(context.Background(), "alice"); nil == err {
+		t.Error("query of missing table should fail")
+	}
+	if _, err := NewSqliteCredentials(SqliteConf{Path: filepath.Join(t.TempDir(), "missing.db"), Query: DEFAULT_SQLITE_QUERY}); nil == err {
+		t.Error("missing database should be rejected")
+	}
+}
+
+func TestCalloutCredentials(t *testing.T) {
+	var calls atomic.Int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer s3cret" || r.URL.Query().Get("realm") != "lstun" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Query().Get("username") {
+		case "alice":
+			w.Write([]byte(`{"passwords": ["wonderland", "looking-glass"]}`))
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`{"passwords": ["late"]}`))
+		case "broken":
+			w.Write([]byte(`passwords`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer service.Close()
+
+	store := NewCalloutCredentials(CalloutConf{Url: service.URL, Token: "s3cret", Timeout: 50 * time.Millisecond, CacheTtl: time.Minute}, "lstun")
+	tests := []struct {
+		username  string
+		passwords []string
+		err       bool
+		calls     int32
+	}{
+		{username: "alice", passwords: []string{"wonderland", "looking-glass"}, calls: 1},
+		{username: "alice", passwords: []string{"wonderland", "looking-glass"}, calls: 1},
+		{username: "bob", calls: 2},
+		{username: "bob", calls: 2},
+		{username: "broken", err: true, calls: 3},
+		{username: "broken", err: true, calls: 4},
+		{username: "slow", err: true, calls: 5},
+	}
+	for _, test := range tests {
+		passwords, err := store.Passwords(context.Background(), test.username)
+		if test.err != (nil != err) {
+			t.Errorf("%s got error %v", test.username, err)
+		}
+		if !slices.Equal(passwords, test.passwords) {
+			t.Errorf("%s has passwords %v, expected %v", test.username, passwords, test.passwords)
+		}
+		if calls.Load() != test.calls {
+			t.Errorf("%s made %d calls, expected %d", test.username, calls.Load(), test.calls)
+		}
+	}
+
+	unauthorized := NewCalloutCredentials(CalloutConf{Url: service.URL, Timeout: time.Second}, "lstun")
+	if _, err := unauthorized.Passwords(context.Background(), "alice"); nil == err {
+		t.Error("forbidden callout should fail")
+	}
+	uncached := NewCalloutCredentials(CalloutConf{Url: service.URL, Token: "s3cret", Timeout: time.Second}, "lstun")
+	before := calls.Load()
+	uncached.Passwords(context.Background(), "alice")
+	uncached.Passwords(context.Background(), "alice")
+	if calls.Load()-before != 2 {
+		t.Errorf("uncached store made %d calls, expected 2", calls.Load()-before)
+	}
+}
+
+func TestCalloutCredentialsLimits(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer service.Close()
+	store := NewCalloutCredentials(CalloutConf{Url: service.URL, Timeout: time.Second, CacheTtl: time.Minute}, "lstun")
+
+	// concurrent lookups of a username share one callout
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Passwords(context.Background(), "mallory"); nil != err {
+				t.Errorf("Shared lookup failed: %s", err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("Concurrent lookups made %d calls, expected 1", calls.Load())
+	}
+
+	// lookups beyond the callouts in flight fail without calling
+	for i := 0; i < cap(store.inflight); i++ {
+		store.inflight <- struct{}{}
+	}
+	if _, err := store.Passwords(context.Background(), "trudy"); !errors.Is(err, ErrCalloutBusy) {
+		t.Errorf("Lookup beyond the limit returned %v, expected %s", err, ErrCalloutBusy)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Lookup beyond the limit called the service, %d calls", calls.Load())
+	}
+}
+
+func TestCalloutCacheEviction(t *testing.T) {
+	store := NewCalloutCredentials(CalloutConf{CacheTtl: time.Minute}, "lstun")
+	now := time.Now()
+	for i := 0; i < CALLOUT_CACHE_SIZE; i++ {
+		store.store(fmt.Sprintf("user%d", i), nil, now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	// a full cache drops its oldest entry only
+	later := now.Add(CALLOUT_CACHE_SIZE * time.Millisecond)
+	store.store("alice", []string{"wonderland"}, later)
+	if _, ok := store.cached("user0", later); ok {
+		t.Error("Oldest entry should be evicted")
+	}
+	for _, username := range []string{"user1", fmt.Sprintf("user%d", CALLOUT_CACHE_SIZE-1), "alice"} {
+		if _, ok := store.cached(username, later); !ok {
+			t.Errorf("Entry of %s should be kept", username)
+		}
+	}
+
+	// expired entries go before live ones
+	expired := later.Add(time.Minute)
+	store.store("bob", nil, expired)
+	if _, ok := store.cached("alice", expired); !ok {
+		t.Error("Live entry should be kept while expired ones are evicted")
+	}
+	if len(store.cache) != 2 {
+		t.Errorf("Cache holds %d entries, expected only the live ones", len(store.cache))
+	}
+}
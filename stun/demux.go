@@ -0,0 +1,259 @@
+package stun
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// protocols sharing a udp port, told apart by the first byte of their datagrams, RFC 7983
+// section 7
+const (
+	PROTOCOL_STUN         = "stun"
+	PROTOCOL_ZRTP         = "zrtp"
+	PROTOCOL_DTLS         = "dtls"
+	PROTOCOL_CHANNEL_DATA = "channel_data"
+	PROTOCOL_RTP          = "rtp"
+)
+
+// FORWARD_MAX_SESSIONS bounds the clients a Forwarder relays for at once, each holds a socket
+const FORWARD_MAX_SESSIONS = 4096
+
+// Classify returns the protocol of a datagram by its first byte, empty when the byte is in an
+// unassigned range. Rtp covers rtcp as well.
+func Classify(packet []byte) string {
+	if len(packet) == 0 {
+		return ""
+	}
+	switch b := packet[0]; {
+	case b <= 3:
+		return PROTOCOL_STUN
+	case 16 <= b && b <= 19:
+		return PROTOCOL_ZRTP
+	case 20 <= b && b <= 63:
+		return PROTOCOL_DTLS
+	case 64 <= b && b <= 79:
+		return PROTOCOL_CHANNEL_DATA
+	case 128 <= b && b <= 191:
+		return PROTOCOL_RTP
+	}
+	return ""
+}
+
+// PacketHandler serves datagrams of a protocol other than stun arriving on the udp listener.
+// packet is only valid during the call. Replies are written to conn, addr is the sender, which is
+// the balancer for datagrams carrying a proxy protocol header.
+type PacketHandler interface {
+	ServePacket(conn net.PacketConn, packet []byte, addr net.Addr)
+}
+
+// PacketHandlerFunc is an adapter to use ordinary functions as PacketHandler
+type PacketHandlerFunc func(conn net.PacketConn, packet []byte, addr net.Addr)
+
+func (self PacketHandlerFunc) ServePacket(conn net.PacketConn, packet []byte, addr net.Addr) {
+	self(conn, packet, addr)
+}
+
+// Demux passes datagrams of other protocols sharing the udp listener to their handlers. Datagrams
+// of protocols without a handler are dropped, as they were before the demux existed.
+type Demux struct {
+	mu       sync.RWMutex
+	handlers map[string]PacketHandler
+}
+
+func NewDemux() *Demux {
+	return &Demux{handlers: map[string]PacketHandler{}}
+}
+
+// Handle registers handler for protocol, one of zrtp, dtls, channel_data and rtp
+func (self *Demux) Handle(protocol string, handler PacketHandler) error {
+	switch protocol {
+	case PROTOCOL_ZRTP, PROTOCOL_DTLS, PROTOCOL_CHANNEL_DATA, PROTOCOL_RTP:
+	default:
+		return fmt.Errorf("protocol %q can not be demultiplexed", protocol)
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.handlers[protocol]; ok {
+		return fmt.Errorf("protocol %q already has a handler", protocol)
+	}
+	self.handlers[protocol] = handler
+	return nil
+}
+
+// serve passes a non-stun datagram to the handler of its protocol, and reports whether there was
+// one. A nil demux has none.
+func (self *Demux) serve(conn net.PacketConn, packet []byte, addr net.Addr, metrics *Metrics) bool {
+	if nil == self {
+		return false
+	}
+	protocol := Classify(packet)
+	self.mu.RLock()
+	handler, ok := self.handlers[protocol]
+	self.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	metrics.demuxed(protocol)
+	handler.ServePacket(conn, packet, addr)
+	return true
+}
+
+type MuxConf struct {
+	// upstreams datagrams of each protocol are forwarded to as host:port, dropped when empty
+	Dtls        string
+	Rtp         string
+	Zrtp        string
+	ChannelData string `mapstructure:"channel_data"`
+	// IdleTimeout ends the forwarding of a client that sent and received nothing for that long
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+}
+
+func (self MuxConf) String() string {
+	return fmt.Sprintf("{Dtls: %s, Rtp: %s, Zrtp: %s, ChannelData: %s, IdleTimeout: %s}", self.Dtls, self.Rtp, self.Zrtp, self.ChannelData, self.IdleTimeout)
+}
+
+// Upstreams returns the configured upstreams by protocol
+func (self MuxConf) Upstreams() map[string]string {
+	upstreams := map[string]string{}
+	for protocol, upstream := range map[string]string{
+		PROTOCOL_DTLS:         self.Dtls,
+		PROTOCOL_RTP:          self.Rtp,
+		PROTOCOL_ZRTP:         self.Zrtp,
+		PROTOCOL_CHANNEL_DATA: self.ChannelData,
+	} {
+		if upstream != "" {
+			upstreams[protocol] = upstream
+		}
+	}
+	return upstreams
+}
+
+// forwardSession relays the datagrams of one client through its own socket, so replies of the
+// upstream can be told apart by the socket they arrive on
+type forwardSession struct {
+	upstream *net.UDPConn
+	// active is the unix nano time of the last datagram in either direction
+	active atomic.Int64
+}
+
+func (self *forwardSession) touch() {
+	self.active.Store(time.Now().UnixNano())
+}
+
+func (self *forwardSession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, self.active.Load()))
+}
+
+// Forwarder is a PacketHandler relaying datagrams to an upstream and its replies back to the
+// senders, like a NAT. Close it to release the sockets of its sessions.
+type Forwarder struct {
+	upstream *net.UDPAddr
+	idle     time.Duration
+
+	mu       sync.Mutex
+	closed   bool
+	sessions map[string]*forwardSession
+	wg       sync.WaitGroup
+}
+
+// NewForwarder resolves upstream, sessions end after idle without traffic
+func NewForwarder(upstream string, idle time.Duration) (*Forwarder, error) {
+	addr, err := net.ResolveUDPAddr("udp", upstream)
+	if nil != err {
+		return nil, fmt.Errorf("upstream %s can not be resolved: %w", upstream, err)
+	}
+	return &Forwarder{upstream: addr, idle: idle, sessions: map[string]*forwardSession{}}, nil
+}
+
+func (self *Forwarder) ServePacket(conn net.PacketConn, packet []byte, addr net.Addr) {
+	session, err := self.session(conn, addr)
+	if nil != err {
+		slog.Debug("Forwarding failed", "remote_addr", addr, "upstream", self.upstream, "error", err)
+		return
+	}
+	session.touch()
+	if _, err := session.upstream.Write(packet); nil != err {
+		slog.Debug("Forwarding failed", "remote_addr", addr, "upstream", self.upstream, "error", err)
+	}
+}
+
+// session returns the session of addr, opening one if it has none
+func (self *Forwarder) session(conn net.PacketConn, addr net.Addr) (*forwardSession, error) {
+	key := addr.String()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return nil, net.ErrClosed
+	}
+	if session, ok := self.sessions[key]; ok {
+		return session, nil
+	}
+	if len(self.sessions) >= FORWARD_MAX_SESSIONS {
+		return nil, fmt.Errorf("%d sessions are open", len(self.sessions))
+	}
+
+	upstream, err := net.DialUDP("udp", nil, self.upstream)
+	if nil != err {
+		return nil, err
+	}
+	session := &forwardSession{upstream: upstream}
+	session.touch()
+	self.sessions[key] = session
+	self.wg.Add(1)
+	go self.relay(key, session, conn, addr)
+	return session, nil
+}
+
+// relay sends the replies of the upstream back to addr till the session is idle or closed
+func (self *Forwarder) relay(key string, session *forwardSession, conn net.PacketConn, addr net.Addr) {
+	defer self.wg.Done()
+	defer func() {
+		self.mu.Lock()
+		delete(self.sessions, key)
+		self.mu.Unlock()
+		session.upstream.Close()
+	}()
+
+	buf := make([]byte, UDP_BUFF_SIZE)
+	for {
+		if err := session.upstream.SetReadDeadline(time.Now().Add(self.idle)); nil != err {
+			return
+		}
+		n, err := session.upstream.Read(buf)
+		if nil != err {
+			if os.IsTimeout(err) && session.idleFor() < self.idle {
+				continue
+			}
+			return
+		}
+		session.touch()
+		if _, err := conn.WriteTo(buf[:n], addr); nil != err {
+			slog.Debug("Forwarded reply failed", "remote_addr", addr, "upstream", self.upstream, "error", err)
+		}
+	}
+}
+
+// Close ends every session and waits for their relays to return
+func (self *Forwarder) Close() error {
+	self.mu.Lock()
+	self.closed = true
+	for _, session := range self.sessions {
+		session.upstream.Close()
+	}
+	self.mu.Unlock()
+	self.wg.Wait()
+	return nil
+}
+
+func (self *Forwarder) run(sup *Supervisor) {
+	sup.Go("forwarder "+self.upstream.String(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return self.Close()
+	})
+}
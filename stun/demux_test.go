@@ -0,0 +1,226 @@
+package stun
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestClassify(t *testing.T) {
+	testCases := map[byte]string{
+		0:   PROTOCOL_STUN,
+		1:   PROTOCOL_STUN,
+		3:   PROTOCOL_STUN,
+		4:   "",
+		15:  "",
+		16:  PROTOCOL_ZRTP,
+		19:  PROTOCOL_ZRTP,
+		20:  PROTOCOL_DTLS,
+		22:  PROTOCOL_DTLS,
+		63:  PROTOCOL_DTLS,
+		64:  PROTOCOL_CHANNEL_DATA,
+		79:  PROTOCOL_CHANNEL_DATA,
+		80:  "",
+		127: "",
+		128: PROTOCOL_RTP,
+		191: PROTOCOL_RTP,
+		192: "",
+		255: "",
+	}
+	for b, expected := range testCases {
+		if protocol := Classify([]byte{b, 0, 0, 0}); protocol != expected {
+			t.Errorf("First byte %d is classified as %q, expected %q", b, protocol, expected)
+		}
+	}
+	if protocol := Classify(nil); protocol != "" {
+		t.Errorf("Empty datagram is classified as %q", protocol)
+	}
+}
+
+func TestDemuxHandle(t *testing.T) {
+	demux := NewDemux()
+	drop := PacketHandlerFunc(func(net.PacketConn, []byte, net.Addr) {})
+	if err := demux.Handle(PROTOCOL_DTLS, drop); nil != err {
+		t.Errorf("dtls handler should be registered, got %s", err)
+	}
+	if err := demux.Handle(PROTOCOL_DTLS, drop); nil == err {
+		t.Error("second dtls handler should be rejected")
+	}
+	for _, protocol := range []string{PROTOCOL_STUN, "sctp"} {
+		if err := demux.Handle(protocol, drop); nil == err {
+			t.Errorf("%s handler should be rejected", protocol)
+		}
+	}
+}
+
+// exchange sends packet from client and returns the datagram answered, nil if none arrives
+func exchange(t *testing.T, client net.Conn, packet []byte) []byte {
+	t.Helper()
+	if _, err := client.Write(packet); nil != err {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, UDP_BUFF_SIZE)
+	n, err := client.Read(buf)
+	if nil != err {
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestDemux(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	demux := NewDemux()
+	err = demux.Handle(PROTOCOL_DTLS, PacketHandlerFunc(func(conn net.PacketConn, packet []byte, addr net.Addr) {
+		conn.WriteTo(append([]byte("dtls:"), packet...), addr)
+	}))
+	if nil != err {
+		t.Fatal(err)
+	}
+	metrics := NewMetrics()
+	ctx, cancel := context.WithCancel(context.Background())
+	sup := NewSupervisor(ctx)
+	UdpStart(sup, conn, BindingHandler(), metrics, nil, nil, demux)
+	defer func() {
+		cancel()
+		sup.Wait()
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// a dtls client hello record, 22 is the handshake content type
+	hello := []byte{22, 0xfe, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	if reply := exchange(t, client, hello); !bytes.Equal(reply, append([]byte("dtls:"), hello...)) {
+		t.Errorf("dtls datagram got %q, expected it echoed by its handler", reply)
+	}
+
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{1}}
+	reply := exchange(t, client, req.Encode())
+	res, err := DecodeMessage(reply)
+	if nil != err || res.Type != BINDING_SUCCESS_RESPONSE {
+		t.Errorf("stun request got %v, %v, expected a binding response", res, err)
+	}
+
+	// rtp has no handler, and the first byte of cluster frames is unassigned
+	for _, packet := range [][]byte{{0x80, 0, 0, 1}, {0xff, 0, 0, 1}} {
+		if reply := exchange(t, client, packet); nil != reply {
+			t.Errorf("datagram %x got %q, expected it dropped", packet, reply)
+		}
+	}
+
+	mfs, err := metrics.Registry.Gather()
+	if nil != err {
+		t.Fatal(err)
+	}
+	mf := map[string]*dto.MetricFamily{}
+	for _, f := range mfs {
+		mf[f.GetName()] = f
+	}
+	if value := counterValue(mf, "lstun_demuxed_packets_total", map[string]string{"protocol": PROTOCOL_DTLS}); value != 1 {
+		t.Errorf("lstun_demuxed_packets_total of dtls is %v, expected 1", value)
+	}
+	if value := counterValue(mf, "lstun_demuxed_packets_total", map[string]string{"protocol": PROTOCOL_RTP}); value != 0 {
+		t.Errorf("lstun_demuxed_packets_total of rtp is %v, expected 0", value)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, UDP_BUFF_SIZE)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if nil != err {
+				return
+			}
+			upstream.WriteTo(append([]byte("rtp:"), buf[:n]...), addr)
+		}
+	}()
+
+	conf := testConfiguration()
+	conf.Tcp.Enabled = false
+	conf.Mux = MuxConf{Rtp: upstream.LocalAddr().String(), IdleTimeout: 100 * time.Millisecond}
+	server := startTestServer(t, conf, nil)
+
+	client, err := net.Dial("udp", loopback(server.Addrs().Udp))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	packet := []byte{0x80, 0x60, 0, 1}
+	if reply := exchange(t, client, packet); !bytes.Equal(reply, append([]byte("rtp:"), packet...)) {
+		t.Errorf("rtp datagram got %q, expected the upstream reply", reply)
+	}
+	// the session ends after the idle timeout, and a new one is opened for the next datagram
+	time.Sleep(300 * time.Millisecond)
+	if reply := exchange(t, client, packet); !bytes.Equal(reply, append([]byte("rtp:"), packet...)) {
+		t.Errorf("rtp datagram after idle got %q, expected the upstream reply", reply)
+	}
+}
+
+func TestForwarderIdle(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	forwarder, err := NewForwarder(upstream.LocalAddr().String(), 50*time.Millisecond)
+	if nil != err {
+		t.Fatal(err)
+	}
+	sessions := func() int {
+		forwarder.mu.Lock()
+		defer forwarder.mu.Unlock()
+		return len(forwarder.sessions)
+	}
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	forwarder.ServePacket(conn, []byte{0x16}, client)
+	forwarder.ServePacket(conn, []byte{0x16}, client)
+	forwarder.ServePacket(conn, []byte{0x16}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001})
+	if n := sessions(); n != 2 {
+		t.Errorf("%d sessions are open, expected one per client", n)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for sessions() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := sessions(); n != 0 {
+		t.Errorf("%d sessions are open after idle timeout", n)
+	}
+
+	forwarder.ServePacket(conn, []byte{0x16}, client)
+	if err := forwarder.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if n := sessions(); n != 0 {
+		t.Errorf("%d sessions are open after close", n)
+	}
+	forwarder.ServePacket(conn, []byte{0x16}, client)
+	if n := sessions(); n != 0 {
+		t.Error("closed forwarder should open no session")
+	}
+}
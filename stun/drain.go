@@ -0,0 +1,28 @@
+package stun
+
+import (
+	"fmt"
+	"time"
+)
+
+// shutdown phases, in order
+const (
+	PHASE_SERVING  = "serving"
+	PHASE_DRAINING = "draining"
+	PHASE_STOPPING = "stopping"
+	PHASE_STOPPED  = "stopped"
+)
+
+var phases = []string{PHASE_SERVING, PHASE_DRAINING, PHASE_STOPPING, PHASE_STOPPED}
+
+type ShutdownConf struct {
+	// GracePeriod is how long a draining server keeps serving before listeners are stopped
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+	// Deadline is how long in flight connections may take to finish once listeners are
+	// stopped, after which they are closed. Zero waits till the shutdown context expires.
+	Deadline time.Duration
+}
+
+func (self ShutdownConf) String() string {
+	return fmt.Sprintf("{GracePeriod: %s, Deadline: %s}", self.GracePeriod, self.Deadline)
+}
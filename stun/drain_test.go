@@ -0,0 +1,200 @@
+package stun
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// currentPhase returns the current shutdown phase exported by server
+func currentPhase(t *testing.T, server *Server) string {
+	t.Helper()
+
+	for _, m := range scrape(t, server)["lstun_shutdown_phase"].GetMetric() {
+		if m.GetGauge().GetValue() == 1 {
+			return m.GetLabel()[0].GetValue()
+		}
+	}
+	return ""
+}
+
+func TestShutdownDrain(t *testing.T) {
+	conf := testConfiguration()
+	conf.Shutdown = ShutdownConf{GracePeriod: 500 * time.Millisecond, Deadline: time.Second}
+	server := startTestServer(t, conf, nil)
+	waitReady(t, server)
+
+	if phase := currentPhase(t, server); phase != PHASE_SERVING {
+		t.Errorf("Phase is %q, expected %s", phase, PHASE_SERVING)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Shutdown(context.Background())
+	}()
+
+	// during grace period server is not ready, yet keeps answering
+	for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if currentPhase(t, server) == PHASE_DRAINING {
+			break
+		}
+	}
+	if phase := currentPhase(t, server); phase != PHASE_DRAINING {
+		t.Errorf("Phase is %q, expected %s", phase, PHASE_DRAINING)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", loopback(server.Addrs().Monitoring), READYZ_PATH))
+	if nil != err {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Readiness status %d while draining, expected %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	bindingRequest(t, TRANSPORT_UDP, loopback(server.Addrs().Udp))
+	bindingRequest(t, TRANSPORT_TCP, loopback(server.Addrs().Tcp))
+
+	select {
+	case err := <-stopped:
+		if nil != err {
+			t.Errorf("Shutdown failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not complete")
+	}
+
+	if _, err := net.Dial("tcp", loopback(server.Addrs().Tcp)); nil == err {
+		t.Error("Tcp connections are accepted after shutdown")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	conf := testConfiguration()
+	conf.Shutdown = ShutdownConf{Deadline: 50 * time.Millisecond}
+	server := startTestServer(t, conf, nil)
+
+	// a connection blocked in a read is closed at deadline, well before the read timeout
+	conn, err := net.Dial("tcp", loopback(server.Addrs().Tcp))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0, 1}); nil != err {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); len(server.conns.List()) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); nil != err {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed >= READ_TIMEOUT {
+		t.Errorf("Shutdown took %s, expected connection to be closed at deadline", elapsed)
+	}
+}
+
+func TestShutdownWithoutDeadline(t *testing.T) {
+	conf := testConfiguration()
+	conf.Shutdown = ShutdownConf{}
+	server := startTestServer(t, conf, nil)
+
+	// without deadline a blocked connection is closed only once the shutdown context expires
+	conn, err := net.Dial("tcp", loopback(server.Addrs().Tcp))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0, 1}); nil != err {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); len(server.conns.List()) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, expected %s", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed >= READ_TIMEOUT {
+		t.Errorf("Shutdown took %s, expected connection to be closed when context expires", elapsed)
+	}
+}
+
+func TestShutdownAuthenticatesMessageInFlight(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := sql.Open("sqlite", path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		"CREATE TABLE users (username TEXT NOT NULL, password TEXT NOT NULL)",
+		"INSERT INTO users VALUES ('alice', 'wonderland')",
+	} {
+		if _, err := db.Exec(statement); nil != err {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	conf := testConfiguration()
+	conf.Auth = AuthConf{Enabled: true, Realm: "lstun", NonceLifetime: time.Minute, Sqlite: SqliteConf{Path: path, Query: DEFAULT_SQLITE_QUERY}}
+	conf.Shutdown = ShutdownConf{Deadline: 5 * time.Second}
+	server := startTestServer(t, conf, nil)
+
+	conn, err := net.Dial("tcp", loopback(server.Addrs().Tcp))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	exchange := func(req []byte) *Message {
+		t.Helper()
+		if _, err := conn.Write(req); nil != err {
+			t.Fatal(err)
+		}
+		buf, err := readStreamMessage(conn)
+		if nil != err {
+			t.Fatal(err)
+		}
+		res, err := DecodeMessage(buf)
+		if nil != err {
+			t.Fatal(err)
+		}
+		return res
+	}
+	challenge := exchange((&Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{1}}).Encode())
+	nonce, _ := challenge.Get(NONCE)
+
+	// the signed request arrives while the server stops, its credentials are still looked up
+	req := authRequest(t, "alice", nil, "lstun", string(nonce), LongTermKey("alice", "lstun", "wonderland")).Encode()
+	if _, err := conn.Write(req[:MIN_STUN_LEN]); nil != err {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Shutdown(context.Background())
+	}()
+	// the listener is closed once stopping, well before the message in flight times out
+	for deadline := time.Now().Add(READ_TIMEOUT / 2); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		probe, err := net.Dial("tcp", loopback(server.Addrs().Tcp))
+		if nil != err {
+			break
+		}
+		probe.Close()
+	}
+	if res := exchange(req[MIN_STUN_LEN:]); res.Class() != CLASS_SUCCESS {
+		t.Errorf("Request in flight at shutdown is answered with %s", res)
+	}
+	if err := <-stopped; nil != err {
+		t.Errorf("Shutdown failed: %s", err)
+	}
+}
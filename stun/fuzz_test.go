@@ -0,0 +1,616 @@
+package stun
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// fuzzAllocsPerAttribute bounds the allocations of decoding per attribute the input could
+	// hold, fuzzAllocsPerMessage those of framing per message read or attempted and
+	// fuzzStreamAllocs those of the readers of a stream
+	fuzzAllocsPerAttribute = 2
+	fuzzAllocsPerMessage   = 2
+	fuzzStreamAllocs       = 4
+	// fuzzAmplification is how much larger than its request a response may be
+	fuzzAmplification = 128
+)
+
+var (
+	fuzzServerAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 3478}
+	fuzzClients    = []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000},
+	}
+	fuzzBalancer = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9000}
+	fuzzTime     = time.Unix(1700000000, 0)
+)
+
+// fuzzMessages are the seeds of the message targets: the RFC 5769 vectors, the messages the
+// server handles and malformed variants of them
+func fuzzMessages() [][]byte {
+	id := [ID_LEN]byte(rfc5769Request[8:MIN_STUN_LEN])
+
+	binding := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: id}
+	fingerprinted := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: id}
+	fingerprinted.AddFingerprint()
+	check := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: id}
+	check.Add(PRIORITY, PriorityValue(0x6e7f1eff))
+	check.Add(USE_CANDIDATE, nil)
+	check.Add(ICE_CONTROLLING, TieBreakerValue(0x932ff9b151263b36))
+	unknown := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: id}
+	unknown.Add(CHANGE_REQUEST, []byte{0, 0, 0, CHANGE_IP | CHANGE_PORT})
+	unknown.Add(0x0030, []byte{1})
+	authenticated := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: id}
+	authenticated.Add(USERNAME, []byte("1700000000:alice"))
+	authenticated.Add(REALM, []byte("lstun"))
+	authenticated.Add(NONCE, []byte("nonce"))
+	authenticated.AddMessageIntegrity(LongTermKey("1700000000:alice", "lstun", "password"))
+	authenticated.AddFingerprint()
+	indication := &Message{Type: BINDING_INDICATION, Cookie: MESAGE_COOKIE, ID: id}
+	allocate := &Message{Type: 0x0003, Cookie: MESAGE_COOKIE, ID: id}
+
+	corrupted := bytes.Clone(rfc5769Request)
+	corrupted[len(corrupted)-1] ^= 1
+	return [][]byte{
+		rfc5769Request,
+		rfc5769IPv4Response,
+		rfc5769IPv6Response,
+		binding.Encode(),
+		fingerprinted.Encode(),
+		check.Encode(),
+		unknown.Encode(),
+		authenticated.Encode(),
+		indication.Encode(),
+		allocate.Encode(),
+		corrupted,
+		rfc5769Request[:MIN_STUN_LEN+10],
+		rfc5769Request[:MIN_STUN_LEN-1],
+	}
+}
+
+// zeroPadding returns a copy of a decodable message with the padding of its attributes zeroed,
+// as Encode writes it
+func zeroPadding(buf []byte) []byte {
+	buf = bytes.Clone(buf)
+	for body := buf[MIN_STUN_LEN:]; len(body) > 0; {
+		l := int(binary.BigEndian.Uint16(body[2:4]))
+		clear(body[ATTR_HEADER_LEN+l : ATTR_HEADER_LEN+l+padding(l)])
+		body = body[ATTR_HEADER_LEN+l+padding(l):]
+	}
+	return buf
+}
+
+// seedCorpus returns the inputs of the seed corpus of a []byte fuzz target in testdata
+func seedCorpus(t *testing.T, target string) [][]byte {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "fuzz", target, "*"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	var inputs [][]byte
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if nil != err {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		literal, ok := strings.CutPrefix(lines[len(lines)-1], "[]byte(")
+		if !ok {
+			t.Fatalf("Seed %s is not a []byte input", file)
+		}
+		input, err := strconv.Unquote(strings.TrimSuffix(literal, ")"))
+		if nil != err {
+			t.Fatalf("Seed %s does not parse: %s", file, err)
+		}
+		inputs = append(inputs, []byte(input))
+	}
+	return inputs
+}
+
+// TestParserAllocations checks the parsers allocate in proportion to their input over the seeds,
+// which the fuzz targets can not do reliably per execution
+func TestParserAllocations(t *testing.T) {
+	for _, buf := range append(fuzzMessages(), seedCorpus(t, "FuzzDecodeMessage")...) {
+		limit := 1.0
+		if len(buf) > MIN_STUN_LEN {
+			limit += float64(fuzzAllocsPerAttribute * ((len(buf) - MIN_STUN_LEN) / ATTR_HEADER_LEN))
+		}
+		if allocs := testing.AllocsPerRun(10, func() { DecodeMessage(buf) }); allocs > limit {
+			t.Errorf("Decoding %x allocated %v times, expected at most %v", buf, allocs, limit)
+		}
+	}
+
+	messages := fuzzMessages()
+	streams := append(seedCorpus(t, "FuzzReadStreamMessage"), bytes.Join(messages, nil))
+	for _, stream := range append(streams, messages...) {
+		frame := func() (n int) {
+			r := bufio.NewReader(bytes.NewReader(stream))
+			for ; ; n++ {
+				if _, err := readStreamMessage(r); nil != err {
+					return n
+				}
+			}
+		}
+		limit := float64(fuzzStreamAllocs + fuzzAllocsPerMessage*(frame()+1))
+		if allocs := testing.AllocsPerRun(10, func() { frame() }); allocs > limit {
+			t.Errorf("Framing %x allocated %v times, expected at most %v", stream, allocs, limit)
+		}
+	}
+}
+
+// fuzzConn is a connection or socket reading the fuzz input and recording what is written to it
+type fuzzConn struct {
+	io.Reader
+	remote  net.Addr
+	written [][]byte
+}
+
+func (self *fuzzConn) Write(b []byte) (int, error) {
+	self.written = append(self.written, bytes.Clone(b))
+	return len(b), nil
+}
+
+func (self *fuzzConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, net.ErrClosed
+}
+
+func (self *fuzzConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return self.Write(b)
+}
+
+func (self *fuzzConn) Close() error                       { return nil }
+func (self *fuzzConn) LocalAddr() net.Addr                { return fuzzServerAddr }
+func (self *fuzzConn) RemoteAddr() net.Addr               { return self.remote }
+func (self *fuzzConn) SetDeadline(t time.Time) error      { return nil }
+func (self *fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (self *fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// fuzzHandler wraps BindingHandler with the middlewares of a server, authenticating requests with
+// REST API credentials when auth is set
+func fuzzHandler(tb testing.TB, metrics *Metrics, auth bool) Handler {
+	tb.Helper()
+	acl, err := NewACL(AclConf{Deny: []string{"203.0.113.0/24"}})
+	if nil != err {
+		tb.Fatal(err)
+	}
+	keepalives, err := NewKeepalives(KeepaliveConf{})
+	if nil != err {
+		tb.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	middlewares := []Middleware{RequestLogger(logger), metrics.Middleware(), acl.Middleware()}
+	if auth {
+		authenticator, err := NewAuthenticator(AuthConf{Enabled: true, Realm: "lstun", NonceLifetime: time.Hour, Rest: RestConf{Secrets: []string{"s3cret"}}})
+		if nil != err {
+			tb.Fatal(err)
+		}
+		middlewares = append(middlewares, authenticator.Middleware())
+	}
+	middlewares = append(middlewares, keepalives.Middleware())
+	return Chain(BindingHandler(), middlewares...)
+}
+
+// checkResponse asserts res is a well formed response to a transaction of req, not much larger
+// than req
+func checkResponse(t *testing.T, req []byte, res []byte) {
+	t.Helper()
+	msg, err := DecodeMessage(res)
+	if nil != err {
+		t.Fatalf("Response %x does not decode: %v", res, err)
+	}
+	if class := msg.Class(); class != CLASS_SUCCESS && class != CLASS_ERROR {
+		t.Fatalf("Response class is %#04x", class)
+	}
+	if !bytes.Contains(req, msg.ID[:]) {
+		t.Fatalf("Response transaction %x is not requested", msg.ID)
+	}
+	if len(res) > len(req)+fuzzAmplification {
+		t.Fatalf("Response is %d bytes for a request of %d", len(res), len(req))
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range fuzzMessages() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		msg, err := DecodeMessage(buf)
+		if nil != err {
+			return
+		}
+		if len(msg.Attributes) > (len(buf)-MIN_STUN_LEN)/ATTR_HEADER_LEN {
+			t.Fatalf("%d attributes decoded from %d bytes", len(msg.Attributes), len(buf))
+		}
+
+		encoded := msg.Encode()
+		if !bytes.Equal(encoded, zeroPadding(buf)) {
+			t.Fatalf("Encoded %x, expected %x", encoded, zeroPadding(buf))
+		}
+		again, err := DecodeMessage(encoded)
+		if nil != err {
+			// a fingerprint covers the padding, which is zeroed by encoding
+			if errors.Is(err, ErrBadFingerprint) && !bytes.Equal(encoded, buf) {
+				return
+			}
+			t.Fatalf("Encoded message does not decode: %v", err)
+		}
+		if !bytes.Equal(again.Encode(), encoded) {
+			t.Fatalf("Encoding is not stable, %x then %x", encoded, again.Encode())
+		}
+	})
+}
+
+func FuzzParseAddress(f *testing.F) {
+	id := [ID_LEN]byte(rfc5769Request[8:MIN_STUN_LEN])
+	for _, client := range fuzzClients {
+		addr := client.(*net.UDPAddr)
+		value, _ := AddressValue(addr.IP, uint16(addr.Port))
+		f.Add(value)
+		xorValue, _ := XorAddressValue(addr.IP, uint16(addr.Port), MESAGE_COOKIE, id)
+		f.Add(xorValue)
+	}
+	for _, vector := range [][]byte{rfc5769IPv4Response, rfc5769IPv6Response} {
+		msg, _ := DecodeMessage(vector)
+		value, _ := msg.Get(XOR_MAPPED_ADDRESS)
+		f.Add(value)
+	}
+	f.Add([]byte{0, IPV4_ATTR, 0x0d})
+
+	f.Fuzz(func(t *testing.T, value []byte) {
+		if ip, port, err := ParseAddress(value); nil == err {
+			encoded, err := AddressValue(ip, port)
+			if nil != err {
+				t.Fatalf("Address %s:%d does not encode: %v", ip, port, err)
+			}
+			again, againPort, err := ParseAddress(encoded)
+			if nil != err || !again.Equal(ip) || againPort != port {
+				t.Fatalf("Address %s:%d decoded as %s:%d, %v", ip, port, again, againPort, err)
+			}
+		}
+
+		if ip, port, err := ParseXorAddress(value, MESAGE_COOKIE, id); nil == err {
+			encoded, err := XorAddressValue(ip, port, MESAGE_COOKIE, id)
+			if nil != err {
+				t.Fatalf("Xor address %s:%d does not encode: %v", ip, port, err)
+			}
+			again, againPort, err := ParseXorAddress(encoded, MESAGE_COOKIE, id)
+			if nil != err || !again.Equal(ip) || againPort != port {
+				t.Fatalf("Xor address %s:%d decoded as %s:%d, %v", ip, port, again, againPort, err)
+			}
+		}
+	})
+}
+
+func FuzzParseErrorCode(f *testing.F) {
+	f.Add(ErrorCodeValue(CODE_UNAUTHORIZED, REASON_UNAUTHORIZED))
+	f.Add(ErrorCodeValue(CODE_ROLE_CONFLICT, REASON_ROLE_CONFLICT))
+	f.Add([]byte{0, 0, 7, 199})
+	f.Add([]byte{0, 0, 4})
+
+	f.Fuzz(func(t *testing.T, value []byte) {
+		code, reason, err := ParseErrorCode(value)
+		if nil != err {
+			return
+		}
+		again, againReason, err := ParseErrorCode(ErrorCodeValue(code, reason))
+		if nil != err || again != code || againReason != reason {
+			t.Fatalf("Error %d %q decoded as %d %q, %v", code, reason, again, againReason, err)
+		}
+	})
+}
+
+func FuzzParseICE(f *testing.F) {
+	for _, seed := range fuzzMessages() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		msg, err := DecodeMessage(buf)
+		if nil != err {
+			return
+		}
+		ice, err := ParseICE(msg)
+		if nil != err || nil == ice {
+			return
+		}
+
+		rebuilt := &Message{Type: msg.Type, Cookie: msg.Cookie, ID: msg.ID}
+		if _, ok := msg.Get(PRIORITY); ok {
+			rebuilt.Add(PRIORITY, PriorityValue(ice.Priority))
+		}
+		if ice.UseCandidate {
+			rebuilt.Add(USE_CANDIDATE, nil)
+		}
+		switch ice.Role {
+		case ICE_ROLE_CONTROLLING:
+			rebuilt.Add(ICE_CONTROLLING, TieBreakerValue(ice.TieBreaker))
+		case ICE_ROLE_CONTROLLED:
+			rebuilt.Add(ICE_CONTROLLED, TieBreakerValue(ice.TieBreaker))
+		}
+		decoded, err := DecodeMessage(rebuilt.Encode())
+		if nil != err {
+			t.Fatal(err)
+		}
+		again, err := ParseICE(decoded)
+		if nil != err || !reflect.DeepEqual(again, ice) {
+			t.Fatalf("ICE attributes %+v decoded as %+v, %v", ice, again, err)
+		}
+	})
+}
+
+func FuzzParseChangeRequest(f *testing.F) {
+	f.Add([]byte{0, 0, 0, CHANGE_IP | CHANGE_PORT})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, value []byte) {
+		flags, err := parseChangeRequest(value)
+		if nil != err {
+			return
+		}
+		if flags&^(CHANGE_IP|CHANGE_PORT) != 0 {
+			t.Fatalf("Flags %#x are not change flags", flags)
+		}
+		again, err := parseChangeRequest(binary.BigEndian.AppendUint32(nil, flags))
+		if nil != err || again != flags {
+			t.Fatalf("Flags %#x decoded as %#x, %v", flags, again, err)
+		}
+	})
+}
+
+func FuzzParseRestUsername(f *testing.F) {
+	for _, seed := range []string{"1700000000:alice", "1700000000", "-1:bob", "1700000000:a:b", ":", "alice:1700000000"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, username string) {
+		expiry, userid, err := parseRestUsername(username)
+		if nil != err {
+			return
+		}
+		formatted := strconv.FormatInt(expiry.Unix(), 10)
+		if strings.Contains(username, REST_SEPARATOR) {
+			formatted += REST_SEPARATOR + userid
+		}
+		again, againUserid, err := parseRestUsername(formatted)
+		if nil != err || !again.Equal(expiry) || againUserid != userid {
+			t.Fatalf("Username %q decoded as %s %q, then %s %q, %v", username, expiry, userid, again, againUserid, err)
+		}
+	})
+}
+
+func FuzzAccessToken(f *testing.F) {
+	oauth := testOAuth(f, "stun.example.org")
+	for _, token := range []AccessToken{
+		{MacKey: bytes.Repeat([]byte{1}, 20), Timestamp: fuzzTime, Lifetime: time.Hour},
+		{MacKey: nil, Timestamp: fuzzTime.Add(-time.Hour), Lifetime: time.Minute},
+	} {
+		value, err := oauth.Seal("north", token)
+		if nil != err {
+			f.Fatal(err)
+		}
+		f.Add(value)
+		f.Add(value[:len(value)-1])
+	}
+	f.Add([]byte{0, 12})
+
+	f.Fuzz(func(t *testing.T, value []byte) {
+		macKey, err := oauth.Open("north", value, fuzzTime)
+		if nil != err {
+			return
+		}
+		if len(macKey) > len(value) {
+			t.Fatalf("Mac key of %d bytes opened from %d", len(macKey), len(value))
+		}
+		sealed, err := oauth.Seal("north", AccessToken{MacKey: macKey, Timestamp: fuzzTime, Lifetime: time.Hour})
+		if nil != err {
+			t.Fatal(err)
+		}
+		again, err := oauth.Open("north", sealed, fuzzTime)
+		if nil != err || !bytes.Equal(again, macKey) {
+			t.Fatalf("Mac key %x opened as %x, %v", macKey, again, err)
+		}
+	})
+}
+
+func FuzzProxyHeader(f *testing.F) {
+	client, balancer := fuzzClients[0].(*net.UDPAddr), fuzzBalancer
+	f.Add(proxyV2Header(PROXY_V2_UDP4, client, balancer))
+	f.Add(proxyV2Header(PROXY_V2_TCP6, fuzzClients[1].(*net.UDPAddr), &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 3478}))
+	f.Add(append(bytes.Clone(proxyV2Signature), PROXY_V2_VERSION|PROXY_V2_LOCAL, 0, 0, 0))
+	f.Add([]byte("PROXY TCP4 198.51.100.1 192.0.2.1 40000 3478\r\n"))
+	f.Add([]byte("PROXY UNKNOWN\r\n"))
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		if header, n, err := ParseProxyHeaderV2(buf); nil == err {
+			if nil == header || n < PROXY_V2_HEADER_LEN || n > len(buf) {
+				t.Fatalf("Header %+v of %d bytes parsed from %d", header, n, len(buf))
+			}
+		}
+		if header, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(buf))); nil == err && nil == header {
+			t.Fatal("No header read without error")
+		}
+	})
+}
+
+func FuzzClusterFrame(f *testing.F) {
+	aead := clusterCipher([]byte("s3cret"))
+	for _, client := range fuzzClients {
+		frame := sealFrame(f, aead, &clusterFrame{client: client.(*net.UDPAddr), sent: fuzzTime, msg: rfc5769Request})
+		f.Add(frame)
+		f.Add(frame[:len(frame)-1])
+		identity := &Identity{Username: "user", Realm: "example.org", Mechanism: MECHANISM_LONG_TERM}
+		f.Add(sealFrame(f, aead, &clusterFrame{client: client.(*net.UDPAddr), sent: fuzzTime, identity: identity, key: LongTermKey("user", "example.org", "secret"), msg: rfc5769Request}))
+	}
+	f.Add(append(bytes.Clone(clusterMagic), CLUSTER_VERSION, 6))
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		frame, err := decodeClusterFrame(aead, buf, fuzzTime)
+		if nil != err {
+			return
+		}
+		if len(frame.msg) > len(buf) {
+			t.Fatalf("Payload of %d bytes decoded from %d", len(frame.msg), len(buf))
+		}
+		again, err := decodeClusterFrame(aead, sealFrame(t, aead, frame), fuzzTime)
+		if nil != err || again.client.String() != frame.client.String() || !bytes.Equal(again.msg, frame.msg) || !bytes.Equal(again.key, frame.key) {
+			t.Fatalf("Frame %+v decoded as %+v, %v", frame, again, err)
+		}
+	})
+}
+
+func FuzzReadStreamMessage(f *testing.F) {
+	messages := fuzzMessages()
+	for _, seed := range messages {
+		f.Add(seed)
+	}
+	f.Add(bytes.Join(messages[:4], nil))
+	f.Add(append(bytes.Clone(rfc5769Request), 0, 1, 0xff, 0xfc))
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		var messages [][]byte
+		r := bufio.NewReader(bytes.NewReader(stream))
+		for {
+			buf, err := readStreamMessage(r)
+			if nil != err {
+				break
+			}
+			messages = append(messages, buf)
+		}
+
+		consumed := 0
+		for _, buf := range messages {
+			if len(buf) != MIN_STUN_LEN+int(binary.BigEndian.Uint16(buf[2:4])) {
+				t.Fatalf("Message of %d bytes has length %d", len(buf), binary.BigEndian.Uint16(buf[2:4]))
+			}
+			if consumed+len(buf) > len(stream) || !bytes.Equal(buf, stream[consumed:consumed+len(buf)]) {
+				t.Fatalf("Message %x is not at offset %d of the stream", buf, consumed)
+			}
+			consumed += len(buf)
+		}
+	})
+}
+
+func FuzzHandler(f *testing.F) {
+	for _, seed := range fuzzMessages() {
+		f.Add(seed)
+	}
+	metrics := NewMetrics()
+	handlers := []Handler{fuzzHandler(f, metrics, false), fuzzHandler(f, metrics, true)}
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		req, err := DecodeMessage(buf)
+		if nil != err {
+			return
+		}
+		for _, handler := range handlers {
+			for _, client := range fuzzClients {
+				w := &recordingWriter{}
+				handler.ServeSTUN(w, &Request{Message: req, Transport: TRANSPORT_UDP, LocalAddr: fuzzServerAddr, RemoteAddr: client})
+				if len(w.messages) > 1 {
+					t.Fatalf("%d responses to one request", len(w.messages))
+				}
+				for _, res := range w.messages {
+					checkResponse(t, buf, res.Encode())
+				}
+			}
+		}
+	})
+}
+
+func FuzzServeDatagram(f *testing.F) {
+	for _, seed := range fuzzMessages() {
+		f.Add(false, seed)
+		f.Add(true, append(proxyV2Header(PROXY_V2_UDP4, fuzzClients[0].(*net.UDPAddr), fuzzServerAddr), seed...))
+	}
+	f.Add(false, append([]byte{22, 0xfe, 0xfd}, make([]byte, 10)...))
+	f.Add(false, sealFrame(f, clusterCipher([]byte("s3cret")), &clusterFrame{client: fuzzClients[1].(*net.UDPAddr), sent: time.Now(), msg: rfc5769Request}))
+
+	metrics := NewMetrics()
+	handler := fuzzHandler(f, metrics, false)
+	proxy, err := NewProxyProtocol([]string{fuzzBalancer.IP.String() + "/32"})
+	if nil != err {
+		f.Fatal(err)
+	}
+	var demuxed []byte
+	demux := NewDemux()
+	if err := demux.Handle(PROTOCOL_DTLS, PacketHandlerFunc(func(conn net.PacketConn, packet []byte, addr net.Addr) {
+		demuxed = bytes.Clone(packet)
+	})); nil != err {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, proxied bool, packet []byte) {
+		sender := fuzzClients[0]
+		if proxied {
+			sender = fuzzBalancer
+		}
+		conn := &fuzzConn{}
+		cluster, err := NewCluster(ClusterConf{Enabled: true, AdvertiseIP: fuzzServerAddr.IP.String(), Secret: "s3cret"}, conn)
+		if nil != err {
+			t.Fatal(err)
+		}
+		demuxed = nil
+
+		serveDatagram(conn, packet, sender, handler, metrics, proxy, cluster, demux)
+		if len(conn.written) > 1 {
+			t.Fatalf("%d datagrams sent for one", len(conn.written))
+		}
+		if nil != demuxed {
+			if Classify(demuxed) != PROTOCOL_DTLS || !bytes.HasSuffix(packet, demuxed) || len(conn.written) > 0 {
+				t.Fatalf("Datagram %x demultiplexed as %x", packet, demuxed)
+			}
+		}
+		// forwarded requests are sealed, their responses answer the request inside
+		req := packet
+		if frame, err := decodeClusterFrame(cluster.aead, packet, time.Now()); nil == err {
+			req = frame.msg
+		}
+		for _, res := range conn.written {
+			checkResponse(t, req, res)
+		}
+	})
+}
+
+func FuzzServeStream(f *testing.F) {
+	messages := fuzzMessages()
+	for _, seed := range messages {
+		f.Add(seed)
+	}
+	f.Add(bytes.Join(messages[:4], nil))
+	f.Add(append(bytes.Clone(rfc5769Request), 0xff, 0xff))
+
+	metrics := NewMetrics()
+	handler := fuzzHandler(f, metrics, false)
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		conn := &fuzzConn{Reader: bytes.NewReader(stream), remote: fuzzClients[1]}
+		serveStream(context.Background(), conn, TRANSPORT_TCP, handler, metrics)
+
+		written := bytes.Join(conn.written, nil)
+		if len(conn.written) > len(stream)/MIN_STUN_LEN || len(written) > len(stream)+len(conn.written)*fuzzAmplification {
+			t.Fatalf("%d responses of %d bytes to a stream of %d", len(conn.written), len(written), len(stream))
+		}
+		r := bytes.NewReader(written)
+		for r.Len() > 0 {
+			res, err := readStreamMessage(r)
+			if nil != err {
+				t.Fatalf("Responses %x are not framed: %v", written, err)
+			}
+			checkResponse(t, stream, res)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// transports a request can arrive on
+const (
+	TRANSPORT_UDP = "udp"
+	TRANSPORT_TCP = "tcp"
+	TRANSPORT_TLS = "tls"
+)
+
+// Request is a decoded stun message together with the transport it arrived on
+type Request struct {
+	Message    *Message
+	Transport  string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// TLS is the connection state for requests arriving on tls, nil otherwise
+	TLS *tls.ConnectionState
+
+	ctx context.Context
+}
+
+// Context returns the context of the request, carrying e.g. its trace span
+func (self *Request) Context() context.Context {
+	if nil == self.ctx {
+		return context.Background()
+	}
+	return self.ctx
+}
+
+// WithContext returns a shallow copy of the request with its context changed to ctx
+func (self *Request) WithContext(ctx context.Context) *Request {
+	r := *self
+	r.ctx = ctx
+	return &r
+}
+
+// RemoteIP returns ip and port of the remote peer for udp and tcp addresses
+func (self *Request) RemoteIP() (net.IP, int) {
+	switch addr := self.RemoteAddr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	}
+	return nil, 0
+}
+
+// ICE returns the ICE attributes of a connectivity check, nil if the request carries none
+func (self *Request) ICE() (*ICE, error) {
+	return ParseICE(self.Message)
+}
+
+// ALPN returns the application protocol negotiated on the tls connection of the request, empty
+// for other transports or when the client offered none
+func (self *Request) ALPN() string {
+	if nil == self.TLS {
+		return ""
+	}
+	return self.TLS.NegotiatedProtocol
+}
+
+// ResponseWriter sends a response back to the peer a request came from
+type ResponseWriter interface {
+	Write(res *Message) error
+}
+
+// Handler responds to a stun request. Not writing a response is valid, e.g. for indications.
+type Handler interface {
+	ServeSTUN(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+func (self HandlerFunc) ServeSTUN(w ResponseWriter, r *Request) {
+	self(w, r)
+}
+
+// Middleware wraps a handler with additional behavior
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with middlewares, first middleware being the outermost
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// attributes understood by BindingHandler, authentication ones are checked by Authenticator and
+// ICE ones are surfaced by Request.ICE
+var bindingKnownAttributes = map[uint16]bool{
+	USERNAME:          true,
+	MESSAGE_INTEGRITY: true,
+	REALM:             true,
+	NONCE:             true,
+	ACCESS_TOKEN:      true,
+	PRIORITY:          true,
+	USE_CANDIDATE:     true,
+}
+
+// BindingHandler answers binding requests with MAPPED-ADDRESS and XOR-MAPPED-ADDRESS
+func BindingHandler() Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		req := r.Message
+		if req.Class() != CLASS_REQUEST {
+			// indications and responses are not answered
+			return
+		}
+		if req.Method() != METHOD_BINDING {
+			w.Write(NewErrorResponse(req, CODE_BAD_REQUEST, REASON_BAD_REQUEST))
+			return
+		}
+		if unknown := req.UnknownAttributes(bindingKnownAttributes); len(unknown) > 0 {
+			res := NewErrorResponse(req, CODE_UNKNOWN_ATTRIBUTE, REASON_UNKNOWN_ATTRIBUTE)
+			res.Add(UNKNOWN_ATTRIBUTES, UnknownAttributesValue(unknown))
+			w.Write(res)
+			return
+		}
+
+		ip, port := r.RemoteIP()
+		mapped, err := AddressValue(ip, uint16(port))
+		if nil != err {
+			w.Write(NewErrorResponse(req, CODE_SERVER_ERROR, REASON_SERVER_ERROR))
+			return
+		}
+		xorMapped, _ := XorAddressValue(ip, uint16(port), req.Cookie, req.ID)
+
+		res := NewResponse(req, CLASS_SUCCESS)
+		res.Add(MAPPED_ADDRESS, mapped)
+		res.Add(XOR_MAPPED_ADDRESS, xorMapped)
+		w.Write(res)
+	})
+}
+
+// DefaultHandler is used by servers that are not given a handler
+var DefaultHandler = BindingHandler()
@@ -0,0 +1,184 @@
+package stun
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self signed certificate and key for localhost to dir
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); nil != err {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); nil != err {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, r *Request) {
+				order = append(order, name)
+				next.ServeSTUN(w, r)
+			})
+		}
+	}
+
+	h := Chain(HandlerFunc(func(w ResponseWriter, r *Request) {
+		order = append(order, "handler")
+	}), tag("first"), tag("second"))
+	h.ServeSTUN(nil, &Request{})
+
+	expected := []string{"first", "second", "handler"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("call order %v is not same as expected %v", order, expected)
+	}
+}
+
+func TestHandlerTransportMetadata(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+
+	var mu sync.Mutex
+	seen := map[string]*Request{}
+	record := func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			mu.Lock()
+			seen[r.Transport] = r
+			mu.Unlock()
+			next.ServeSTUN(w, r)
+		})
+	}
+
+	conf := testConfiguration()
+	conf.Tls = TlsConf{Enabled: true, Port: 0, CertFile: certFile, KeyFile: keyFile}
+	addrs := startTestServer(t, conf, Chain(BindingHandler(), record)).Addrs()
+	bindingRequest(t, TRANSPORT_UDP, loopback(addrs.Udp))
+	bindingRequest(t, TRANSPORT_TCP, loopback(addrs.Tcp))
+	bindingRequest(t, TRANSPORT_TLS, loopback(addrs.Tls))
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, transport := range []string{TRANSPORT_UDP, TRANSPORT_TCP, TRANSPORT_TLS} {
+		r, ok := seen[transport]
+		if !ok {
+			t.Errorf("No request seen on %s", transport)
+			continue
+		}
+		if nil == r.LocalAddr || nil == r.RemoteAddr {
+			t.Errorf("Addresses are missing on %s request", transport)
+		}
+		if (transport == TRANSPORT_TLS) != (nil != r.TLS) {
+			t.Errorf("Unexpected tls state %v on %s request", r.TLS, transport)
+		}
+	}
+}
+
+type recordingWriter struct {
+	messages []*Message
+}
+
+func (self *recordingWriter) Write(res *Message) error {
+	self.messages = append(self.messages, res)
+	return nil
+}
+
+func TestBindingHandler(t *testing.T) {
+	req, err := DecodeMessage(rfc5769Request)
+	if nil != err {
+		t.Fatal(err)
+	}
+	unknown := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: req.ID}
+	unknown.Add(0x0030, []byte{0, 0, 0, 1})
+	check := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: req.ID}
+	check.Add(PRIORITY, PriorityValue(0x6e7f1eff))
+	check.Add(USE_CANDIDATE, nil)
+	indication := &Message{Type: BINDING_INDICATION, Cookie: MESAGE_COOKIE, ID: req.ID}
+	allocate := &Message{Type: 0x0003, Cookie: MESAGE_COOKIE, ID: req.ID}
+
+	testCases := map[string]struct {
+		msg  *Message
+		code int
+		sent int
+	}{
+		"binding request should succeed":             {msg: &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}, code: 0, sent: 1},
+		"unknown comprehension required attribute":   {msg: unknown, code: CODE_UNKNOWN_ATTRIBUTE, sent: 1},
+		"ice attributes should be understood":        {msg: check, code: 0, sent: 1},
+		"indication should not be answered":          {msg: indication, sent: 0},
+		"unsupported method should be a bad request": {msg: allocate, code: CODE_BAD_REQUEST, sent: 1},
+	}
+
+	for name, test := range testCases {
+		// test := test // NOTE: uncomment for Go < 1.22, see /doc/faq#closures_and_goroutines
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			w := &recordingWriter{}
+			BindingHandler().ServeSTUN(w, &Request{
+				Message:    test.msg,
+				Transport:  TRANSPORT_UDP,
+				RemoteAddr: &net.UDPAddr{IP: net.IPv4(10, 0, 4, 128), Port: 32657},
+			})
+			if len(w.messages) != test.sent {
+				t.Fatalf("%d messages sent, expected %d", len(w.messages), test.sent)
+			}
+			if test.sent == 0 {
+				return
+			}
+
+			res := w.messages[0]
+			if 0 == test.code {
+				if res.Type != BINDING_SUCCESS_RESPONSE {
+					t.Errorf("Unexpected response type %#04x", res.Type)
+				}
+				return
+			}
+			value, ok := res.Get(ERROR_CODE)
+			if !ok {
+				t.Fatal("ERROR-CODE is missing")
+			}
+			code, _, _ := ParseErrorCode(value)
+			if code != test.code {
+				t.Errorf("error code %d is not same as expected %d", code, test.code)
+			}
+		})
+	}
+}
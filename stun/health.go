@@ -0,0 +1,158 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTHZ_PATH = "/healthz"
+	READYZ_PATH  = "/readyz"
+)
+
+// Health tracks readiness of a server. A server is ready once every enabled listener is bound
+// and the last self issued binding request over loopback round tripped on each of them.
+type Health struct {
+	mu       sync.Mutex
+	bound    bool
+	draining bool
+	probeErr error
+}
+
+func NewHealth() *Health {
+	return &Health{probeErr: errors.New("not probed yet")}
+}
+
+// Ready returns nil when ready, otherwise the reason of not being ready
+func (self *Health) Ready() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if !self.bound {
+		return errors.New("listeners are not bound")
+	}
+	if self.draining {
+		return errors.New("server is draining")
+	}
+	return self.probeErr
+}
+
+// Serving returns nil while listeners are bound and answer probes, draining or not, otherwise
+// the reason of not serving
+func (self *Health) Serving() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if !self.bound {
+		return errors.New("listeners are not bound")
+	}
+	return self.probeErr
+}
+
+func (self *Health) setBound(bound bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.bound = bound
+}
+
+// Draining reports whether the server is draining
+func (self *Health) Draining() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.draining
+}
+
+// setDraining marks health as draining, it returns false if it already was
+func (self *Health) setDraining() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	changed := !self.draining
+	self.draining = true
+	return changed
+}
+
+func (self *Health) setProbe(err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.probeErr = err
+}
+
+// loopbackAddr maps a bound listener address to loopback with the same port
+func loopbackAddr(addr net.Addr) string {
+	_, port, err := net.SplitHostPort(addr.String())
+	if nil != err {
+		return addr.String()
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// probe sends a binding request to every listener in addrs over loopback
+func (self *Health) probe(ctx context.Context, addrs Addrs) {
+	targets := map[string]net.Addr{TRANSPORT_UDP: addrs.Udp, TRANSPORT_TCP: addrs.Tcp, TRANSPORT_TLS: addrs.Tls}
+
+	var errs []error
+	for transport, addr := range targets {
+		if nil == addr {
+			continue
+		}
+		// the certificate is issued for the public name, not loopback, and any advertised protocol
+		// is negotiated
+		tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: alpnProtocols}
+		// an error response, e.g. when authentication is required, still round tripped
+		var resErr *ResponseError
+		if _, _, err := QueryMappedAddress(ctx, transport, loopbackAddr(addr), tlsConfig); nil != err && !errors.As(err, &resErr) {
+			errs = append(errs, fmt.Errorf("%s probe failed: %w", transport, err))
+		}
+	}
+
+	err := errors.Join(errs...)
+	if nil != err {
+		slog.Warn("Readiness probe failed", "error", err)
+	}
+	self.setProbe(err)
+}
+
+// probeLoop probes listeners at every interval under sup, till its context is cancelled.
+// A non positive interval falls back to DEFAULT_PROBE_INTERVAL.
+func (self *Health) probeLoop(sup *Supervisor, addrs Addrs, interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_PROBE_INTERVAL
+	}
+	sup.Go("readiness probe", func(ctx context.Context) error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			self.probe(ctx, addrs)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// Handlers registers liveness and readiness endpoints on mux
+func (self *Health) Handlers(mux *http.ServeMux) {
+	mux.HandleFunc(HEALTHZ_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc(READYZ_PATH, func(w http.ResponseWriter, r *http.Request) {
+		if err := self.Ready(); nil != err {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -0,0 +1,114 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitReady polls readiness endpoint of server till it reports ready
+func waitReady(t *testing.T, server *Server) {
+	t.Helper()
+
+	url := fmt.Sprintf("http://%s%s", loopback(server.Addrs().Monitoring), READYZ_PATH)
+	var status int
+	var body []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(url)
+		if nil != err {
+			t.Fatalf("Could not query readiness: %s", err)
+		}
+		status = resp.StatusCode
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if status == http.StatusOK {
+			return
+		}
+	}
+	t.Fatalf("Server is not ready, %d %s", status, body)
+}
+
+func TestHealth(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir)
+	conf := testConfiguration()
+	conf.Tls = TlsConf{Enabled: true, CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	conf.Monitoring.ProbeInterval = 50 * time.Millisecond
+	server := startTestServer(t, conf, nil)
+
+	waitReady(t, server)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", loopback(server.Addrs().Monitoring), HEALTHZ_PATH))
+	if nil != err {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Liveness status %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestHealthDefaultProbeInterval(t *testing.T) {
+	conf := testConfiguration()
+	conf.Monitoring.ProbeInterval = 0
+	server := startTestServer(t, conf, nil)
+
+	waitReady(t, server)
+}
+
+func TestHealthNotReady(t *testing.T) {
+	health := NewHealth()
+	mux := http.NewServeMux()
+	health.Handlers(mux)
+
+	// steps build on each other, so they run in order
+	steps := []struct {
+		name   string
+		modify func()
+		status int
+	}{
+		{name: "unbound listeners should not be ready", modify: func() {}, status: http.StatusServiceUnavailable},
+		{name: "unprobed listeners should not be ready", modify: func() { health.setBound(true) }, status: http.StatusServiceUnavailable},
+		{name: "failed probe should not be ready", modify: func() { health.setProbe(fmt.Errorf("udp probe failed")) }, status: http.StatusServiceUnavailable},
+		{name: "successful probe should be ready", modify: func() { health.setProbe(nil) }, status: http.StatusOK},
+	}
+	for _, step := range steps {
+		step.modify()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, READYZ_PATH, nil))
+		if rec.Code != step.status {
+			t.Errorf("%s: status %d, expected %d", step.name, rec.Code, step.status)
+		}
+	}
+}
+
+func TestQueryMappedAddress(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir)
+	conf := testConfiguration()
+	conf.Tls = TlsConf{Enabled: true, CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	server := startTestServer(t, conf, nil)
+	addrs := server.Addrs()
+
+	targets := map[string]string{
+		TRANSPORT_UDP: loopback(addrs.Udp),
+		TRANSPORT_TCP: loopback(addrs.Tcp),
+		TRANSPORT_TLS: loopback(addrs.Tls),
+	}
+	for transport, addr := range targets {
+		ip, port, err := QueryMappedAddress(context.Background(), transport, addr, &tls.Config{InsecureSkipVerify: true})
+		if nil != err {
+			t.Errorf("%s: %s", transport, err)
+			continue
+		}
+		if !ip.IsLoopback() || port == 0 {
+			t.Errorf("%s: mapped address %s:%d is not the loopback client", transport, ip, port)
+		}
+	}
+}
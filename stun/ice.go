@@ -0,0 +1,291 @@
+package stun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// roles of ICE agents, RFC 8445 section 6.1.1
+const (
+	ICE_ROLE_CONTROLLING = "controlling"
+	ICE_ROLE_CONTROLLED  = "controlled"
+)
+
+var ErrBadICE = errors.New("malformed ICE attribute")
+
+// ICE holds the ICE attributes of a connectivity check, RFC 8445 section 7.1.1
+type ICE struct {
+	Priority     uint32
+	UseCandidate bool
+	// Role is claimed by the sending agent with ICE-CONTROLLING or ICE-CONTROLLED, empty if neither
+	Role       string
+	TieBreaker uint64
+}
+
+// ParseICE returns the ICE attributes of msg, nil if it carries none
+func ParseICE(msg *Message) (*ICE, error) {
+	ice := &ICE{}
+	found := false
+	if value, ok := msg.Get(PRIORITY); ok {
+		if len(value) != 4 {
+			return nil, fmt.Errorf("%w: PRIORITY is %d bytes", ErrBadICE, len(value))
+		}
+		ice.Priority = binary.BigEndian.Uint32(value)
+		found = true
+	}
+	if value, ok := msg.Get(USE_CANDIDATE); ok {
+		if len(value) != 0 {
+			return nil, fmt.Errorf("%w: USE-CANDIDATE is %d bytes", ErrBadICE, len(value))
+		}
+		ice.UseCandidate = true
+		found = true
+	}
+
+	for _, attr := range []uint16{ICE_CONTROLLING, ICE_CONTROLLED} {
+		value, ok := msg.Get(attr)
+		if !ok {
+			continue
+		}
+		if ice.Role != "" {
+			return nil, fmt.Errorf("%w: both ICE-CONTROLLING and ICE-CONTROLLED are present", ErrBadICE)
+		}
+		if len(value) != 8 {
+			return nil, fmt.Errorf("%w: tie-breaker is %d bytes", ErrBadICE, len(value))
+		}
+		ice.Role = ICE_ROLE_CONTROLLING
+		if attr == ICE_CONTROLLED {
+			ice.Role = ICE_ROLE_CONTROLLED
+		}
+		ice.TieBreaker = binary.BigEndian.Uint64(value)
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return ice, nil
+}
+
+// PriorityValue returns the value of a PRIORITY attribute
+func PriorityValue(priority uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, priority)
+}
+
+// TieBreakerValue returns the value of an ICE-CONTROLLING or ICE-CONTROLLED attribute
+func TieBreakerValue(tieBreaker uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, tieBreaker)
+}
+
+// TieBreaker returns the role of the local agent in the ICE session of r and its tie-breaker,
+// an empty role if r belongs to no session
+type TieBreaker func(r *Request) (string, uint64)
+
+// RoleConflict resolves conflicting roles of connectivity checks, RFC 8445 section 7.3.1.1. The
+// agent with the larger tie-breaker gets the controlling role: if the local agent keeps its
+// role, 487 Role Conflict is answered, otherwise switchRole is called with its new role and the
+// check is served.
+func RoleConflict(tieBreaker TieBreaker, switchRole func(r *Request, role string)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			if r.Message.Class() != CLASS_REQUEST {
+				next.ServeSTUN(w, r)
+				return
+			}
+			ice, err := r.ICE()
+			if nil != err {
+				w.Write(NewErrorResponse(r.Message, CODE_BAD_REQUEST, REASON_BAD_REQUEST))
+				return
+			}
+			if nil == ice || ice.Role == "" {
+				next.ServeSTUN(w, r)
+				return
+			}
+
+			role, local := tieBreaker(r)
+			if role != ice.Role {
+				next.ServeSTUN(w, r)
+				return
+			}
+			keep := local >= ice.TieBreaker
+			other := ICE_ROLE_CONTROLLED
+			if role == ICE_ROLE_CONTROLLED {
+				keep = local < ice.TieBreaker
+				other = ICE_ROLE_CONTROLLING
+			}
+			if keep {
+				w.Write(NewErrorResponse(r.Message, CODE_ROLE_CONFLICT, REASON_ROLE_CONFLICT))
+				return
+			}
+			switchRole(r, other)
+			next.ServeSTUN(w, r)
+		})
+	}
+}
+
+// IceSession is an ICE session of an IceLite agent, found by the username fragment of its local
+// candidates
+type IceSession struct {
+	LocalUfrag    string
+	LocalPassword string
+	// OnNominated is called when the controlling agent nominates the candidate pair with remote
+	OnNominated func(remote net.Addr)
+
+	mu        sync.Mutex
+	role      string
+	nominated net.Addr
+}
+
+// Role returns the role of the local agent, controlled unless a role conflict switched it
+func (self *IceSession) Role() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.role == "" {
+		return ICE_ROLE_CONTROLLED
+	}
+	return self.role
+}
+
+// Nominated returns the remote address of the nominated candidate pair, nil before nomination
+func (self *IceSession) Nominated() net.Addr {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.nominated
+}
+
+func (self *IceSession) setRole(role string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.role = role
+}
+
+func (self *IceSession) nominate(remote net.Addr) {
+	self.mu.Lock()
+	self.nominated = remote
+	self.mu.Unlock()
+	if nil != self.OnNominated {
+		self.OnNominated(remote)
+	}
+}
+
+type iceSessionKey struct{}
+
+// IceLite is an ICE-lite agent, RFC 8445 section 2.5. It gathers no candidates and sends no
+// checks, it answers the connectivity checks of its sessions authenticated with their short-term
+// credentials, and the controlling agent nominates the pairs. Serve it with Start, or as the
+// handler of a Server.
+type IceLite struct {
+	tieBreaker uint64
+
+	mu       sync.RWMutex
+	sessions map[string]*IceSession
+}
+
+func NewIceLite() (*IceLite, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); nil != err {
+		return nil, fmt.Errorf("tie-breaker generation failed: %w", err)
+	}
+	return &IceLite{tieBreaker: binary.BigEndian.Uint64(buf[:]), sessions: map[string]*IceSession{}}, nil
+}
+
+// AddSession starts answering the checks of session
+func (self *IceLite) AddSession(session *IceSession) error {
+	if session.LocalUfrag == "" || strings.Contains(session.LocalUfrag, ":") {
+		return fmt.Errorf("ufrag %q should be non empty without colons", session.LocalUfrag)
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.sessions[session.LocalUfrag]; ok {
+		return fmt.Errorf("ufrag %q is already used", session.LocalUfrag)
+	}
+	self.sessions[session.LocalUfrag] = session
+	return nil
+}
+
+// RemoveSession stops answering the checks of the session with ufrag
+func (self *IceLite) RemoveSession(ufrag string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.sessions, ufrag)
+}
+
+// session returns the session of a check username, LFRAG:RFRAG with the local ufrag first
+func (self *IceLite) session(username string) *IceSession {
+	ufrag, _, _ := strings.Cut(username, ":")
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.sessions[ufrag]
+}
+
+// authenticate applies the short-term credential mechanism of RFC 5389 section 10.1 to checks,
+// the session of authenticated ones is passed in the request context
+func (self *IceLite) authenticate(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		req := r.Message
+		if req.Class() != CLASS_REQUEST {
+			// binding indications are keepalives, they are not authenticated
+			next.ServeSTUN(w, r)
+			return
+		}
+		username, hasUsername := req.Get(USERNAME)
+		_, hasIntegrity := req.Get(MESSAGE_INTEGRITY)
+		if !hasUsername || !hasIntegrity {
+			w.Write(NewErrorResponse(req, CODE_BAD_REQUEST, REASON_BAD_REQUEST))
+			return
+		}
+		session := self.session(string(username))
+		if nil == session || nil != req.CheckMessageIntegrity([]byte(session.LocalPassword)) {
+			w.Write(NewErrorResponse(req, CODE_UNAUTHORIZED, REASON_UNAUTHORIZED))
+			return
+		}
+
+		ctx := withIdentity(r.Context(), &Identity{Username: string(username), Mechanism: MECHANISM_SHORT_TERM})
+		ctx = context.WithValue(ctx, iceSessionKey{}, session)
+		next.ServeSTUN(&integrityWriter{ResponseWriter: w, key: []byte(session.LocalPassword)}, r.WithContext(ctx))
+	})
+}
+
+func (self *IceLite) role(r *Request) (string, uint64) {
+	if session, ok := r.Context().Value(iceSessionKey{}).(*IceSession); ok {
+		return session.Role(), self.tieBreaker
+	}
+	return "", self.tieBreaker
+}
+
+func (self *IceLite) switchRole(r *Request, role string) {
+	if session, ok := r.Context().Value(iceSessionKey{}).(*IceSession); ok {
+		session.setRole(role)
+	}
+}
+
+// nominate marks the pair of a successful check carrying USE-CANDIDATE as nominated
+func (self *IceLite) nominate(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		rw := &resultWriter{ResponseWriter: w}
+		next.ServeSTUN(rw, r)
+
+		session, ok := r.Context().Value(iceSessionKey{}).(*IceSession)
+		if !ok || nil == rw.res || rw.res.Class() != CLASS_SUCCESS || session.Role() != ICE_ROLE_CONTROLLED {
+			return
+		}
+		if ice, _ := r.ICE(); nil != ice && ice.UseCandidate {
+			session.nominate(r.RemoteAddr)
+		}
+	})
+}
+
+// Handler answers connectivity checks of the sessions with binding responses
+func (self *IceLite) Handler() Handler {
+	return Chain(BindingHandler(), self.authenticate, RoleConflict(self.role, self.switchRole), self.nominate)
+}
+
+// Start answers the connectivity checks arriving on conn, until sup stops
+func (self *IceLite) Start(sup *Supervisor, conn net.PacketConn, metrics *Metrics) {
+	UdpStart(sup, conn, self.Handler(), metrics, nil, nil, nil)
+}
@@ -0,0 +1,230 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseICE(t *testing.T) {
+	tests := map[string]struct {
+		attrs map[uint16][]byte
+		ice   *ICE
+		err   bool
+	}{
+		"no ice attributes": {attrs: map[uint16][]byte{SOFTWARE: []byte("test")}},
+		"controlling check": {
+			attrs: map[uint16][]byte{PRIORITY: PriorityValue(0x6e0001ff), USE_CANDIDATE: nil, ICE_CONTROLLING: TieBreakerValue(0x0102030405060708)},
+			ice:   &ICE{Priority: 0x6e0001ff, UseCandidate: true, Role: ICE_ROLE_CONTROLLING, TieBreaker: 0x0102030405060708},
+		},
+		"controlled check": {
+			attrs: map[uint16][]byte{PRIORITY: PriorityValue(1), ICE_CONTROLLED: TieBreakerValue(42)},
+			ice:   &ICE{Priority: 1, Role: ICE_ROLE_CONTROLLED, TieBreaker: 42},
+		},
+		"both roles":               {attrs: map[uint16][]byte{ICE_CONTROLLING: TieBreakerValue(1), ICE_CONTROLLED: TieBreakerValue(2)}, err: true},
+		"short priority":           {attrs: map[uint16][]byte{PRIORITY: {1, 2}}, err: true},
+		"use candidate with value": {attrs: map[uint16][]byte{USE_CANDIDATE: {1, 2, 3, 4}}, err: true},
+		"short tie-breaker":        {attrs: map[uint16][]byte{ICE_CONTROLLED: {1, 2, 3, 4}}, err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			msg := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}
+			for attr, value := range test.attrs {
+				msg.Add(attr, value)
+			}
+			ice, err := ParseICE(msg)
+			if test.err {
+				if !errors.Is(err, ErrBadICE) {
+					t.Errorf("error %v is not %v", err, ErrBadICE)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatal(err)
+			}
+			if (nil == ice) != (nil == test.ice) || (nil != ice && *ice != *test.ice) {
+				t.Errorf("parsed %+v, expected %+v", ice, test.ice)
+			}
+		})
+	}
+}
+
+func TestRoleConflict(t *testing.T) {
+	tests := map[string]struct {
+		local    string
+		remote   string
+		tie      uint64
+		switched string
+		code     int
+	}{
+		"no conflict": {local: ICE_ROLE_CONTROLLED, remote: ICE_ROLE_CONTROLLING, tie: 1},
+		"no session":  {local: "", remote: ICE_ROLE_CONTROLLING, tie: 1},
+		"controlling with larger tie-breaker keeps":     {local: ICE_ROLE_CONTROLLING, remote: ICE_ROLE_CONTROLLING, tie: 10, code: CODE_ROLE_CONFLICT},
+		"controlling with equal tie-breaker keeps":      {local: ICE_ROLE_CONTROLLING, remote: ICE_ROLE_CONTROLLING, tie: 100, code: CODE_ROLE_CONFLICT},
+		"controlling with smaller tie-breaker switches": {local: ICE_ROLE_CONTROLLING, remote: ICE_ROLE_CONTROLLING, tie: 1000, switched: ICE_ROLE_CONTROLLED},
+		"controlled with larger tie-breaker switches":   {local: ICE_ROLE_CONTROLLED, remote: ICE_ROLE_CONTROLLED, tie: 10, switched: ICE_ROLE_CONTROLLING},
+		"controlled with smaller tie-breaker keeps":     {local: ICE_ROLE_CONTROLLED, remote: ICE_ROLE_CONTROLLED, tie: 1000, code: CODE_ROLE_CONFLICT},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			switched := ""
+			served := false
+			handler := RoleConflict(
+				func(r *Request) (string, uint64) { return test.local, 100 },
+				func(r *Request, role string) { switched = role },
+			)(HandlerFunc(func(w ResponseWriter, r *Request) { served = true }))
+
+			req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}
+			attr := uint16(ICE_CONTROLLING)
+			if test.remote == ICE_ROLE_CONTROLLED {
+				attr = ICE_CONTROLLED
+			}
+			req.Add(attr, TieBreakerValue(test.tie))
+			w := &recordingWriter{}
+			handler.ServeSTUN(w, &Request{Message: req, Transport: TRANSPORT_UDP})
+
+			if switched != test.switched {
+				t.Errorf("switched to %q, expected %q", switched, test.switched)
+			}
+			if test.code == 0 {
+				if !served || len(w.messages) != 0 {
+					t.Errorf("check served %t with %d responses", served, len(w.messages))
+				}
+				return
+			}
+			if served || len(w.messages) != 1 {
+				t.Fatalf("check served %t with %d responses", served, len(w.messages))
+			}
+			value, _ := w.messages[0].Get(ERROR_CODE)
+			if code, _, _ := ParseErrorCode(value); code != test.code {
+				t.Errorf("error code %d, expected %d", code, test.code)
+			}
+		})
+	}
+}
+
+func TestIceLite(t *testing.T) {
+	agent, err := NewIceLite()
+	if nil != err {
+		t.Fatal(err)
+	}
+	agent.tieBreaker = 100
+	nominated := make(chan net.Addr, 1)
+	session := &IceSession{LocalUfrag: "lite", LocalPassword: "lite-password-0123456789", OnNominated: func(remote net.Addr) { nominated <- remote }}
+	if err := agent.AddSession(session); nil != err {
+		t.Fatal(err)
+	}
+	if err := agent.AddSession(&IceSession{LocalUfrag: "lite"}); nil == err {
+		t.Error("used ufrag should be rejected")
+	}
+	if err := agent.AddSession(&IceSession{LocalUfrag: "li:te"}); nil == err {
+		t.Error("ufrag with colon should be rejected")
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sup := NewSupervisor(ctx)
+	agent.Start(sup, conn, nil)
+	defer func() {
+		cancel()
+		sup.Wait()
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	check := func(username string, password string, attrs map[uint16][]byte) *Message {
+		t.Helper()
+		req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{byte(len(attrs)), 1}}
+		req.Add(USERNAME, []byte(username))
+		for _, attr := range []uint16{PRIORITY, USE_CANDIDATE, ICE_CONTROLLING, ICE_CONTROLLED} {
+			if value, ok := attrs[attr]; ok {
+				req.Add(attr, value)
+			}
+		}
+		if password != "" {
+			req.AddMessageIntegrity([]byte(password))
+		}
+		req.AddFingerprint()
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := client.Write(req.Encode()); nil != err {
+			t.Fatal(err)
+		}
+		buf := make([]byte, UDP_BUFF_SIZE)
+		n, err := client.Read(buf)
+		if nil != err {
+			t.Fatal(err)
+		}
+		res, err := DecodeMessage(buf[:n])
+		if nil != err {
+			t.Fatal(err)
+		}
+		return res
+	}
+	errorCode := func(res *Message) int {
+		value, _ := res.Get(ERROR_CODE)
+		code, _, _ := ParseErrorCode(value)
+		return code
+	}
+
+	if code := errorCode(check("lite:full", "", nil)); code != CODE_BAD_REQUEST {
+		t.Errorf("check without integrity answered %d", code)
+	}
+	if code := errorCode(check("other:full", "lite-password-0123456789", nil)); code != CODE_UNAUTHORIZED {
+		t.Errorf("check of unknown session answered %d", code)
+	}
+	if code := errorCode(check("lite:full", "guess", nil)); code != CODE_UNAUTHORIZED {
+		t.Errorf("check with wrong password answered %d", code)
+	}
+
+	res := check("lite:full", session.LocalPassword, map[uint16][]byte{PRIORITY: PriorityValue(1), ICE_CONTROLLING: TieBreakerValue(1)})
+	if res.Class() != CLASS_SUCCESS {
+		t.Fatalf("check answered %d", errorCode(res))
+	}
+	if err := res.CheckMessageIntegrity([]byte(session.LocalPassword)); nil != err {
+		t.Errorf("response integrity check failed with error: %s", err)
+	}
+	if _, ok := res.Get(FINGERPRINT); !ok {
+		t.Error("response has no fingerprint")
+	}
+	value, _ := res.Get(XOR_MAPPED_ADDRESS)
+	if _, port, err := ParseXorAddress(value, res.Cookie, res.ID); nil != err || int(port) != client.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("xor mapped port %d with error %v", port, err)
+	}
+	if nil != session.Nominated() {
+		t.Error("pair is nominated without USE-CANDIDATE")
+	}
+
+	res = check("lite:full", session.LocalPassword, map[uint16][]byte{PRIORITY: PriorityValue(1), USE_CANDIDATE: nil, ICE_CONTROLLING: TieBreakerValue(1)})
+	if res.Class() != CLASS_SUCCESS {
+		t.Fatalf("nominating check answered %d", errorCode(res))
+	}
+	select {
+	case remote := <-nominated:
+		if remote.String() != client.LocalAddr().String() {
+			t.Errorf("nominated %s, expected %s", remote, client.LocalAddr())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pair is not nominated")
+	}
+
+	if code := errorCode(check("lite:full", session.LocalPassword, map[uint16][]byte{ICE_CONTROLLED: TieBreakerValue(1000)})); code != CODE_ROLE_CONFLICT {
+		t.Errorf("controlled check with larger tie-breaker answered %d", code)
+	}
+	res = check("lite:full", session.LocalPassword, map[uint16][]byte{ICE_CONTROLLED: TieBreakerValue(1)})
+	if res.Class() != CLASS_SUCCESS || session.Role() != ICE_ROLE_CONTROLLING {
+		t.Errorf("controlled check with smaller tie-breaker answered %d, role %s", errorCode(res), session.Role())
+	}
+
+	agent.RemoveSession("lite")
+	if code := errorCode(check("lite:full", session.LocalPassword, nil)); code != CODE_UNAUTHORIZED {
+		t.Errorf("check of removed session answered %d", code)
+	}
+}
@@ -1,7 +1,7 @@
 package stun
 
 import (
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"time"
@@ -24,13 +24,12 @@ var (
 func getItfcs() {
 	addrs, err := net.InterfaceAddrs()
 	if nil != err {
-		log.Println("error getting interfaces: ", err)
+		slog.Warn("Getting interfaces failed", "error", err)
 		return
 	}
 
-	log.Println("System Interfaces")
 	for _, v := range addrs {
-		log.Println("net: ", v.Network(), " addrs: ", v.String())
+		slog.Info("System interface", "net", v.Network(), "addr", v.String())
 	}
 }
 
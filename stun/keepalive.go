@@ -0,0 +1,304 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// KEEPALIVE_MAX_CLIENTS bounds the clients whose keepalives are tracked
+	KEEPALIVE_MAX_CLIENTS = 4096
+	// KEEPALIVE_IDLE is how long a silent client stays tracked once room is needed for others
+	KEEPALIVE_IDLE = 10 * time.Minute
+	// LIFETIME_CONFIRM is how soon after a delayed response the next request of a client should
+	// arrive, proving the response got through the binding
+	LIFETIME_CONFIRM = 5 * time.Second
+)
+
+var ErrResponseDropped = errors.New("delayed response dropped as keepalives are closed")
+
+type LifetimeConf struct {
+	// Allow lists client networks taking part in the binding lifetime experiment, it is disabled
+	// when empty
+	Allow []string
+	// Schedule are the increasing delays the responses of successive requests are sent after
+	Schedule []time.Duration
+}
+
+func (self LifetimeConf) String() string {
+	return fmt.Sprintf("{Allow: %v, Schedule: %v}", self.Allow, self.Schedule)
+}
+
+func (self LifetimeConf) Enabled() bool {
+	return len(self.Allow) > 0
+}
+
+type KeepaliveConf struct {
+	Lifetime LifetimeConf
+}
+
+func (self KeepaliveConf) String() string {
+	return fmt.Sprintf("{Lifetime: %s}", self.Lifetime.String())
+}
+
+// ClientKeepalive describes the binding indications of a client, and its binding lifetime
+// experiment if it takes part in one
+type ClientKeepalive struct {
+	Transport   string    `json:"transport"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Indications uint64    `json:"indications"`
+	LastSeen    time.Time `json:"last_seen"`
+	// Step is the number of steps of the schedule the client took
+	Step int `json:"step,omitempty"`
+	// Survived is the longest delay the binding outlived, Expired the delay it did not
+	Survived string `json:"survived,omitempty"`
+	Expired  string `json:"expired,omitempty"`
+}
+
+type keepaliveClient struct {
+	transport   string
+	remoteAddr  string
+	indications uint64
+	lastSeen    time.Time
+
+	step     int
+	pending  bool
+	sentAt   time.Time
+	survived time.Duration
+	expired  time.Duration
+}
+
+// Keepalives accepts binding indications silently and counts them per client. Clients of the
+// lifetime experiment, RFC 5780 section 4.6, get the responses of their binding requests over udp
+// after the delays of the schedule, one step per request, each holding a udp worker while it
+// waits. A client coming back from the same
+// address soon after a delayed response shows its NAT binding outlived the delay, coming back
+// later shows it expired and ends the experiment of the client.
+type Keepalives struct {
+	allow    []*net.IPNet
+	schedule []time.Duration
+	confirm  time.Duration
+
+	mu      sync.Mutex
+	closed  bool
+	done    chan struct{}
+	clients map[string]*keepaliveClient
+}
+
+func NewKeepalives(conf KeepaliveConf) (*Keepalives, error) {
+	allow, err := parseNets(conf.Lifetime.Allow)
+	if nil != err {
+		return nil, err
+	}
+	return &Keepalives{
+		allow:    allow,
+		schedule: conf.Lifetime.Schedule,
+		confirm:  LIFETIME_CONFIRM,
+		done:     make(chan struct{}),
+		clients:  map[string]*keepaliveClient{},
+	}, nil
+}
+
+// client returns the tracked client of addr, nil when there is no room for it. Called with lock
+// held.
+func (self *Keepalives) client(transport string, addr net.Addr, now time.Time) *keepaliveClient {
+	key := transport + "/" + addr.String()
+	if client, ok := self.clients[key]; ok {
+		return client
+	}
+	if len(self.clients) >= KEEPALIVE_MAX_CLIENTS {
+		for other, client := range self.clients {
+			if !client.pending && now.Sub(client.lastSeen) > KEEPALIVE_IDLE {
+				delete(self.clients, other)
+			}
+		}
+		if len(self.clients) >= KEEPALIVE_MAX_CLIENTS {
+			return nil
+		}
+	}
+	client := &keepaliveClient{transport: transport, remoteAddr: addr.String()}
+	self.clients[key] = client
+	return client
+}
+
+// experiment returns the delay the response of a binding request is sent after, and whether the
+// request should be dropped as a delayed response of the client is pending
+func (self *Keepalives) experiment(r *Request, now time.Time) (*keepaliveClient, time.Duration, bool) {
+	if len(self.allow) == 0 || r.Transport != TRANSPORT_UDP || r.Message.Type != BINDING_REQUEST {
+		return nil, 0, false
+	}
+	ip, _ := r.RemoteIP()
+	if !containsIP(self.allow, ip) {
+		return nil, 0, false
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	client := self.client(r.Transport, r.RemoteAddr, now)
+	if nil == client {
+		return nil, 0, false
+	}
+	client.lastSeen = now
+	// a retransmission would refresh the binding under test, the delayed response answers it
+	if client.pending {
+		return nil, 0, true
+	}
+	if !client.sentAt.IsZero() && client.expired == 0 {
+		delay := self.schedule[client.step-1]
+		if now.Sub(client.sentAt) <= self.confirm {
+			client.survived = delay
+		} else {
+			client.expired = delay
+			slog.Info("Nat binding expired", "remote_addr", r.RemoteAddr, "survived", client.survived, "expired", delay)
+		}
+	}
+	if client.expired != 0 || client.step >= len(self.schedule) {
+		return nil, 0, false
+	}
+	delay := self.schedule[client.step]
+	client.step++
+	client.pending = true
+	return client, delay, false
+}
+
+type responseDelayKey struct{}
+
+// responseDelay holds back the response of a datagram request. The keepalives set the delay on
+// the way down the middleware chain, and the transport waits for it before writing, so the
+// response is still written from within the chain.
+type responseDelay struct {
+	delay  time.Duration
+	cancel <-chan struct{}
+	sentAt time.Time
+}
+
+func withResponseDelay(ctx context.Context, delay *responseDelay) context.Context {
+	return context.WithValue(ctx, responseDelayKey{}, delay)
+}
+
+// responseDelayFromContext returns the delay of a request whose transport honours one
+func responseDelayFromContext(ctx context.Context) (*responseDelay, bool) {
+	delay, ok := ctx.Value(responseDelayKey{}).(*responseDelay)
+	return delay, ok
+}
+
+// wait blocks for the delay, it fails when the response is dropped meanwhile
+func (self *responseDelay) wait() error {
+	if nil == self || self.delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(self.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-self.cancel:
+		return ErrResponseDropped
+	}
+}
+
+// sent records when the response was written
+func (self *responseDelay) sent() {
+	if nil != self {
+		self.sentAt = time.Now()
+	}
+}
+
+// Middleware counts binding indications of clients, and delays the responses of clients in the
+// lifetime experiment
+func (self *Keepalives) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			now := time.Now()
+			if r.Message.Type == BINDING_INDICATION {
+				self.mu.Lock()
+				if client := self.client(r.Transport, r.RemoteAddr, now); nil != client {
+					client.indications++
+					client.lastSeen = now
+				}
+				self.mu.Unlock()
+				next.ServeSTUN(w, r)
+				return
+			}
+
+			// only transports honouring a delay take part in the experiment
+			delay, ok := responseDelayFromContext(r.Context())
+			if !ok {
+				next.ServeSTUN(w, r)
+				return
+			}
+			client, after, drop := self.experiment(r, now)
+			if drop {
+				slog.Debug("Request dropped while its response is delayed", "remote_addr", r.RemoteAddr)
+				return
+			}
+			if nil == client {
+				next.ServeSTUN(w, r)
+				return
+			}
+			delay.delay = after
+			delay.cancel = self.done
+			next.ServeSTUN(w, r)
+			self.mu.Lock()
+			client.pending = false
+			if !delay.sentAt.IsZero() {
+				client.sentAt = delay.sentAt
+			}
+			self.mu.Unlock()
+		})
+	}
+}
+
+// List returns the tracked clients, most recently seen first
+func (self *Keepalives) List() []ClientKeepalive {
+	list := []ClientKeepalive{}
+	if nil == self {
+		return list
+	}
+
+	self.mu.Lock()
+	for _, client := range self.clients {
+		info := ClientKeepalive{
+			Transport:   client.transport,
+			RemoteAddr:  client.remoteAddr,
+			Indications: client.indications,
+			LastSeen:    client.lastSeen,
+			Step:        client.step,
+		}
+		if client.survived != 0 {
+			info.Survived = client.survived.String()
+		}
+		if client.expired != 0 {
+			info.Expired = client.expired.String()
+		}
+		list = append(list, info)
+	}
+	self.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+// Close drops the delayed responses not sent yet
+func (self *Keepalives) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if !self.closed {
+		self.closed = true
+		close(self.done)
+	}
+	return nil
+}
+
+func (self *Keepalives) run(sup *Supervisor) {
+	sup.Go("keepalives", func(ctx context.Context) error {
+		<-ctx.Done()
+		return self.Close()
+	})
+}
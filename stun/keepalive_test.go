@@ -0,0 +1,258 @@
+package stun
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chanWriter passes the responses written to a channel, holding them back for the delay of the
+// request as the udp transport does
+type chanWriter struct {
+	responses chan *Message
+	delay     *responseDelay
+}
+
+func (self *chanWriter) Write(res *Message) error {
+	if err := self.delay.wait(); nil != err {
+		return err
+	}
+	self.delay.sent()
+	self.responses <- res
+	return nil
+}
+
+// serveDelayed serves req in the background, as the response may be held back
+func serveDelayed(handler Handler, req *Request) *chanWriter {
+	w := &chanWriter{responses: make(chan *Message, 1), delay: &responseDelay{}}
+	go handler.ServeSTUN(w, req.WithContext(withResponseDelay(context.Background(), w.delay)))
+	return w
+}
+
+func TestKeepalivesIndications(t *testing.T) {
+	keepalives, err := NewKeepalives(KeepaliveConf{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	handler := Chain(BindingHandler(), keepalives.Middleware())
+
+	first := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	second := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	w := &recordingWriter{}
+	for i, addr := range []net.Addr{first, first, first, second} {
+		indication := &Message{Type: BINDING_INDICATION, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{byte(i)}}
+		handler.ServeSTUN(w, &Request{Message: indication, Transport: TRANSPORT_UDP, RemoteAddr: addr})
+	}
+	if len(w.messages) != 0 {
+		t.Errorf("Indications should not be answered, got %v", w.messages)
+	}
+
+	list := keepalives.List()
+	counts := map[string]uint64{}
+	for _, client := range list {
+		counts[client.RemoteAddr] = client.Indications
+	}
+	if len(list) != 2 || counts[first.String()] != 3 || counts[second.String()] != 1 {
+		t.Errorf("Clients %+v, expected 3 indications of %s and 1 of %s", list, first, second)
+	}
+	if list[0].RemoteAddr != second.String() {
+		t.Errorf("Most recently seen client %s should be listed first", second)
+	}
+}
+
+func TestLifetimeExperiment(t *testing.T) {
+	schedule := []time.Duration{20 * time.Millisecond, 60 * time.Millisecond, 100 * time.Millisecond}
+	keepalives, err := NewKeepalives(KeepaliveConf{Lifetime: LifetimeConf{Allow: []string{"192.0.2.0/24"}, Schedule: schedule}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	keepalives.confirm = 50 * time.Millisecond
+	defer keepalives.Close()
+	handler := Chain(BindingHandler(), keepalives.Middleware())
+
+	id := byte(0)
+	request := func(transport string, addr net.Addr) (*chanWriter, time.Time) {
+		id++
+		req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{id}}
+		start := time.Now()
+		w := serveDelayed(handler, &Request{Message: req, Transport: transport, RemoteAddr: addr})
+		// the requests of a client arrive in order
+		time.Sleep(5 * time.Millisecond)
+		return w, start
+	}
+	// await returns how long after start the response arrived
+	await := func(w *chanWriter, start time.Time) time.Duration {
+		t.Helper()
+		select {
+		case res := <-w.responses:
+			if res.Type != BINDING_SUCCESS_RESPONSE {
+				t.Errorf("Unexpected response %v", res)
+			}
+			return time.Since(start)
+		case <-time.After(time.Second):
+			t.Fatal("No response")
+		}
+		return 0
+	}
+
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	w, start := request(TRANSPORT_UDP, client)
+	// requests while a response is delayed are dropped, they would refresh the binding
+	dropped, _ := request(TRANSPORT_UDP, client)
+	if elapsed := await(w, start); elapsed < schedule[0] {
+		t.Errorf("First response came after %s, expected %s", elapsed, schedule[0])
+	}
+	select {
+	case res := <-dropped.responses:
+		t.Errorf("Request while a response was delayed got %v", res)
+	default:
+	}
+
+	// coming back promptly shows the binding survived the first delay
+	w, start = request(TRANSPORT_UDP, client)
+	if elapsed := await(w, start); elapsed < schedule[1] {
+		t.Errorf("Second response came after %s, expected %s", elapsed, schedule[1])
+	}
+
+	// other clients, and other transports, are answered at once
+	for transport, addr := range map[string]net.Addr{
+		TRANSPORT_UDP: &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 40000},
+		TRANSPORT_TCP: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+	} {
+		w, start := request(transport, addr)
+		if elapsed := await(w, start); elapsed >= schedule[0] {
+			t.Errorf("%s request of %s was delayed for %s", transport, addr, elapsed)
+		}
+	}
+
+	// coming back late shows the binding expired, which ends the experiment
+	time.Sleep(2 * keepalives.confirm)
+	w, start = request(TRANSPORT_UDP, client)
+	if elapsed := await(w, start); elapsed >= schedule[0] {
+		t.Errorf("Request after the experiment ended was delayed for %s", elapsed)
+	}
+
+	for _, info := range keepalives.List() {
+		if info.RemoteAddr != client.String() || info.Transport != TRANSPORT_UDP {
+			continue
+		}
+		if info.Step != 2 || info.Survived != schedule[0].String() || info.Expired != schedule[1].String() {
+			t.Errorf("Client %+v, expected step 2 surviving %s and expiring at %s", info, schedule[0], schedule[1])
+		}
+		return
+	}
+	t.Errorf("Client %s is not listed", client)
+}
+
+func TestLifetimeExperimentClose(t *testing.T) {
+	keepalives, err := NewKeepalives(KeepaliveConf{Lifetime: LifetimeConf{Allow: []string{"192.0.2.0/24"}, Schedule: []time.Duration{50 * time.Millisecond}}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}
+	w := serveDelayed(Chain(BindingHandler(), keepalives.Middleware()), &Request{
+		Message:    req,
+		Transport:  TRANSPORT_UDP,
+		RemoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+	})
+	time.Sleep(5 * time.Millisecond)
+	keepalives.Close()
+	select {
+	case res := <-w.responses:
+		t.Errorf("Delayed response %v was sent after close", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// lockedBuffer collects the log output of the server goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (self *lockedBuffer) Write(p []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *lockedBuffer) String() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.buf.String()
+}
+
+func TestLifetimeExperimentServer(t *testing.T) {
+	// delayed responses go through the logger and metrics of the whole chain
+	logs := &lockedBuffer{}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	delay := 50 * time.Millisecond
+	conf := testConfiguration()
+	conf.Keepalive.Lifetime = LifetimeConf{Allow: []string{"127.0.0.0/8"}, Schedule: []time.Duration{delay}}
+	server := startTestServer(t, conf, nil)
+	waitReady(t, server)
+	before := scrape(t, server)
+
+	conn, err := net.Dial("udp", loopback(server.Addrs().Udp))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{4, 9}}
+	start := time.Now()
+	if _, err := conn.Write(req.Encode()); nil != err {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if nil != err {
+		t.Fatalf("No response: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Response came after %s, expected %s", elapsed, delay)
+	}
+	if res, err := DecodeMessage(buf[:n]); nil != err || res.Type != BINDING_SUCCESS_RESPONSE {
+		t.Fatalf("Unexpected response %v, %v", res, err)
+	}
+
+	logged := fmt.Sprintf(`"transaction_id":"%s"`, hex.EncodeToString(req.ID[:]))
+	for deadline := time.Now().Add(time.Second); !strings.Contains(logs.String(), logged) && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	var record map[string]any
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, logged) {
+			json.Unmarshal([]byte(line), &record)
+		}
+	}
+	if record["result"] != "success" {
+		t.Errorf("Delayed response is logged as %v, expected success", record["result"])
+	}
+
+	after := scrape(t, server)
+	labels := map[string]string{"transport": TRANSPORT_UDP, "class": "success"}
+	if sent := counterValue(after, "lstun_responses_total", labels) - counterValue(before, "lstun_responses_total", labels); sent != 1 {
+		t.Errorf("%v delayed responses counted, expected 1", sent)
+	}
+	var latency float64
+	for _, m := range after["lstun_handler_duration_seconds"].GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "transport" && l.GetValue() == TRANSPORT_UDP {
+				latency += m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	if latency < delay.Seconds() {
+		t.Errorf("Udp handler latency %fs leaves out the delay of %s", latency, delay)
+	}
+}
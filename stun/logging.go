@@ -0,0 +1,138 @@
+package stun
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// log formats
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// LogLevel is the level of loggers created by NewLogger, it can be changed at runtime
+var LogLevel = new(slog.LevelVar)
+
+type LogConf struct {
+	Level  string
+	Format string
+	// DebugSampling logs one of every DebugSampling debug records, 1 logs all
+	DebugSampling int `mapstructure:"debug_sampling"`
+}
+
+func (self LogConf) String() string {
+	return fmt.Sprintf("{Level: %s, Format: %s, DebugSampling: %d}", self.Level, self.Format, self.DebugSampling)
+}
+
+// ParseLevel converts level names debug, info, warn and error to slog levels
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.ToLower(name)))
+	return level, err
+}
+
+// samplingHandler lets only one of every n debug records through, other levels are untouched
+type samplingHandler struct {
+	slog.Handler
+	n       uint64
+	counter *atomic.Uint64
+}
+
+func (self *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level <= slog.LevelDebug && self.counter.Add(1)%self.n != 0 {
+		return nil
+	}
+	return self.Handler.Handle(ctx, r)
+}
+
+func (self *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: self.Handler.WithAttrs(attrs), n: self.n, counter: self.counter}
+}
+
+func (self *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: self.Handler.WithGroup(name), n: self.n, counter: self.counter}
+}
+
+// NewLogger creates a logger writing to w as configured, and sets LogLevel
+func NewLogger(conf LogConf, w io.Writer) (*slog.Logger, error) {
+	level, err := ParseLevel(conf.Level)
+	if nil != err {
+		return nil, err
+	}
+	LogLevel.Set(level)
+
+	options := &slog.HandlerOptions{Level: LogLevel}
+	var handler slog.Handler
+	switch conf.Format {
+	case LOG_FORMAT_TEXT:
+		handler = slog.NewTextHandler(w, options)
+	case LOG_FORMAT_JSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", conf.Format)
+	}
+
+	if conf.DebugSampling > 1 {
+		handler = &samplingHandler{Handler: handler, n: uint64(conf.DebugSampling), counter: new(atomic.Uint64)}
+	}
+	return slog.New(handler), nil
+}
+
+// resultWriter remembers the response written, to be logged after the handler returns
+type resultWriter struct {
+	ResponseWriter
+	res *Message
+}
+
+func (self *resultWriter) Write(res *Message) error {
+	self.res = res
+	return self.ResponseWriter.Write(res)
+}
+
+// result describes the response for logs, e.g. success, error 420 or none
+func result(res *Message) string {
+	if nil == res {
+		return "none"
+	}
+	if res.Class() == CLASS_ERROR {
+		if value, ok := res.Get(ERROR_CODE); ok {
+			if code, _, err := ParseErrorCode(value); nil == err {
+				return fmt.Sprintf("error %d", code)
+			}
+		}
+		return "error"
+	}
+	return "success"
+}
+
+// RequestLogger logs every request at debug level with its transaction and result. Nothing is
+// done when debug is disabled so that the hot path stays free of logging.
+func RequestLogger(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			if !logger.Enabled(context.Background(), slog.LevelDebug) {
+				next.ServeSTUN(w, r)
+				return
+			}
+
+			start := time.Now()
+			rw := &resultWriter{ResponseWriter: w}
+			next.ServeSTUN(rw, r)
+			logger.Debug("Request served",
+				"transaction_id", hex.EncodeToString(r.Message.ID[:]),
+				"type", fmt.Sprintf("%#04x", r.Message.Type),
+				"transport", r.Transport,
+				"remote_addr", r.RemoteAddr.String(),
+				"result", result(rw.res),
+				"duration", time.Since(start),
+			)
+		})
+	}
+}
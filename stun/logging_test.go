@@ -0,0 +1,108 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSamplingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	inner := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	logger := slog.New(&samplingHandler{Handler: inner, n: 10, counter: new(atomic.Uint64)})
+
+	for i := 0; i < 100; i++ {
+		logger.Debug("sampled")
+		logger.Info("kept")
+	}
+
+	if sampled := strings.Count(buf.String(), "msg=sampled"); sampled != 10 {
+		t.Errorf("%d debug records logged, expected 10", sampled)
+	}
+	if kept := strings.Count(buf.String(), "msg=kept"); kept != 100 {
+		t.Errorf("%d info records logged, expected 100", kept)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	testCases := map[string]struct {
+		conf  LogConf
+		valid bool
+	}{
+		"text":           {conf: LogConf{Level: "info", Format: LOG_FORMAT_TEXT}, valid: true},
+		"json":           {conf: LogConf{Level: "DEBUG", Format: LOG_FORMAT_JSON}, valid: true},
+		"unknown level":  {conf: LogConf{Level: "verbose", Format: LOG_FORMAT_TEXT}, valid: false},
+		"unknown format": {conf: LogConf{Level: "info", Format: "xml"}, valid: false},
+	}
+
+	// NewLogger sets process wide LogLevel, so these cases can not run in parallel
+	defer LogLevel.Set(slog.LevelInfo)
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewLogger(test.conf, &bytes.Buffer{})
+			if test.valid != (nil == err) {
+				t.Errorf("Unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}
+	copy(req.ID[:], mustHex("b7 e7 a7 01 bc 34 d6 86 fa 87 df ae"))
+	request := &Request{
+		Message:    req,
+		Transport:  TRANSPORT_UDP,
+		RemoteAddr: &net.UDPAddr{IP: net.IPv4(10, 0, 4, 128), Port: 32657},
+	}
+
+	testCases := map[string]struct {
+		level  slog.Level
+		logged bool
+	}{
+		"debug level should log request fields": {level: slog.LevelDebug, logged: true},
+		"info level should not log requests":    {level: slog.LevelInfo, logged: false},
+	}
+
+	for name, test := range testCases {
+		// test := test // NOTE: uncomment for Go < 1.22, see /doc/faq#closures_and_goroutines
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: test.level}))
+			w := &recordingWriter{}
+			Chain(BindingHandler(), RequestLogger(logger)).ServeSTUN(w, request)
+
+			if len(w.messages) != 1 {
+				t.Fatalf("%d messages sent, expected 1", len(w.messages))
+			}
+			if !test.logged {
+				if buf.Len() != 0 {
+					t.Errorf("Unexpected log output %s", buf.String())
+				}
+				return
+			}
+
+			var record map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &record); nil != err {
+				t.Fatalf("Log output %q is not json: %s", buf.String(), err)
+			}
+			expected := map[string]string{
+				"transaction_id": "b7e7a701bc34d686fa87dfae",
+				"transport":      TRANSPORT_UDP,
+				"remote_addr":    "10.0.4.128:32657",
+				"result":         "success",
+			}
+			for k, v := range expected {
+				if record[k] != v {
+					t.Errorf("%s %v is not same as expected %s", k, record[k], v)
+				}
+			}
+		})
+	}
+}
@@ -105,3 +105,10 @@ func TestXorMappedAddress(t *testing.T) {
 	}
 
 }
+
+func TestMagicCookie(t *testing.T) {
+	// RFC 5389 section 6 fixes the magic cookie to 0x2112A442
+	if MESAGE_COOKIE != 0x2112a442 {
+		t.Errorf("Magic cookie is %#x, expected 0x2112a442", MESAGE_COOKIE)
+	}
+}
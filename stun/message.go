@@ -0,0 +1,382 @@
+package stun
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	ATTR_HEADER_LEN  = 4
+	MAX_MESSAGE_LEN  = 65535 + MIN_STUN_LEN
+	FINGERPRINT_XOR  = 0x5354554e
+	CLASS_MASK       = 0x0110
+	CLASS_REQUEST    = 0x0000
+	CLASS_INDICATION = 0x0010
+	CLASS_SUCCESS    = 0x0100
+	CLASS_ERROR      = 0x0110
+	METHOD_BINDING   = 0x0001
+)
+
+// message types
+const (
+	BINDING_INDICATION     = 17  // 0x0011
+	BINDING_ERROR_RESPONSE = 273 // 0x0111
+)
+
+// attribute types, comprehension required ones are below 0x8000
+const (
+	CHANGE_REQUEST     = 3     // 0x0003
+	USERNAME           = 6     // 0x0006
+	MESSAGE_INTEGRITY  = 8     // 0x0008
+	ERROR_CODE         = 9     // 0x0009
+	UNKNOWN_ATTRIBUTES = 10    // 0x000a
+	REALM              = 20    // 0x0014
+	NONCE              = 21    // 0x0015
+	ACCESS_TOKEN       = 27    // 0x001b
+	PRIORITY           = 36    // 0x0024
+	USE_CANDIDATE      = 37    // 0x0025
+	ALTERNATE_DOMAIN   = 32771 // 0x8003
+	SOFTWARE           = 32802 // 0x8022
+	ALTERNATE_SERVER   = 32803 // 0x8023
+	FINGERPRINT        = 32808 // 0x8028
+	ICE_CONTROLLED     = 32809 // 0x8029
+	ICE_CONTROLLING    = 32810 // 0x802a
+	THIRD_PARTY_AUTH   = 32814 // 0x802e
+)
+
+// address families
+const (
+	IPV6_ATTR = 2 // 0x0002
+)
+
+// error codes
+const (
+	CODE_TRY_ALTERNATE       = 300
+	CODE_BAD_REQUEST         = 400
+	CODE_UNAUTHORIZED        = 401
+	CODE_UNKNOWN_ATTRIBUTE   = 420
+	CODE_STALE_NONCE         = 438
+	CODE_ROLE_CONFLICT       = 487
+	CODE_SERVER_ERROR        = 500
+	REASON_TRY_ALTERNATE     = "Try Alternate"
+	REASON_BAD_REQUEST       = "Bad Request"
+	REASON_UNAUTHORIZED      = "Unauthorized"
+	REASON_UNKNOWN_ATTRIBUTE = "Unknown Attribute"
+	REASON_STALE_NONCE       = "Stale Nonce"
+	REASON_ROLE_CONFLICT     = "Role Conflict"
+	REASON_SERVER_ERROR      = "Server Error"
+)
+
+var (
+	ErrShortMessage   = errors.New("message is shorter than stun header")
+	ErrNotStun        = errors.New("first two bits of message are not zero")
+	ErrBadLength      = errors.New("message length does not match content")
+	ErrShortAttribute = errors.New("attribute is truncated")
+	ErrBadFingerprint = errors.New("fingerprint does not match")
+	ErrBadAddress     = errors.New("malformed address attribute")
+	ErrBadErrorCode   = errors.New("malformed error code attribute")
+	ErrNoIntegrity    = errors.New("message integrity is missing")
+	ErrBadIntegrity   = errors.New("message integrity does not match")
+)
+
+type RawAttribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// Message is a decoded stun message, attributes are kept in wire order
+type Message struct {
+	Type       uint16
+	Cookie     uint32
+	ID         [ID_LEN]byte
+	Attributes []RawAttribute
+
+	// signed holds the received bytes preceding MESSAGE-INTEGRITY, as padding is not
+	// necessarily zero on the wire
+	signed []byte
+}
+
+func (self Message) String() string {
+	return fmt.Sprintf("{type: %#04x, Cookie: %#04x, ID: %s, attributes: %d}", self.Type, self.Cookie, hex.EncodeToString(self.ID[:]), len(self.Attributes))
+}
+
+func (self *Message) Class() uint16 {
+	return self.Type & CLASS_MASK
+}
+
+func (self *Message) Method() uint16 {
+	return self.Type &^ CLASS_MASK
+}
+
+// Get returns value of the first attribute with type t
+func (self *Message) Get(t uint16) ([]byte, bool) {
+	for _, attr := range self.Attributes {
+		if attr.Type == t {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (self *Message) Add(t uint16, value []byte) {
+	self.Attributes = append(self.Attributes, RawAttribute{Type: t, Value: value})
+}
+
+func padding(n int) int {
+	return (4 - n%4) % 4
+}
+
+// Len is the wire length of attributes, as written in stun header
+func (self *Message) Len() int {
+	l := 0
+	for _, attr := range self.Attributes {
+		l += ATTR_HEADER_LEN + len(attr.Value) + padding(len(attr.Value))
+	}
+	return l
+}
+
+// Encode serializes message to wire format
+func (self *Message) Encode() []byte {
+	buf := make([]byte, MIN_STUN_LEN, MIN_STUN_LEN+self.Len())
+	binary.BigEndian.PutUint16(buf[0:2], self.Type)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(self.Len()))
+	binary.BigEndian.PutUint32(buf[4:8], self.Cookie)
+	copy(buf[8:MIN_STUN_LEN], self.ID[:])
+
+	for _, attr := range self.Attributes {
+		buf = binary.BigEndian.AppendUint16(buf, attr.Type)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(attr.Value)))
+		buf = append(buf, attr.Value...)
+		buf = append(buf, make([]byte, padding(len(attr.Value)))...)
+	}
+	return buf
+}
+
+// AddFingerprint appends FINGERPRINT attribute, it should be the last attribute added
+func (self *Message) AddFingerprint() {
+	self.Add(FINGERPRINT, make([]byte, 4))
+	buf := self.Encode()
+	crc := crc32.ChecksumIEEE(buf[:len(buf)-ATTR_HEADER_LEN-4]) ^ FINGERPRINT_XOR
+	binary.BigEndian.PutUint32(self.Attributes[len(self.Attributes)-1].Value, crc)
+}
+
+// integrity computes MESSAGE-INTEGRITY over the attributes preceding index i, with the header
+// length covering the integrity attribute as RFC 5389 requires. Received bytes are used for
+// decoded messages.
+func (self *Message) integrity(key []byte, i int) []byte {
+	var buf []byte
+	if nil != self.signed {
+		buf = bytes.Clone(self.signed)
+	} else {
+		covered := Message{Type: self.Type, Cookie: self.Cookie, ID: self.ID, Attributes: self.Attributes[:i]}
+		buf = covered.Encode()
+	}
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)-MIN_STUN_LEN+ATTR_HEADER_LEN+sha1.Size))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	return mac.Sum(nil)
+}
+
+// AddMessageIntegrity appends MESSAGE-INTEGRITY keyed with key, only FINGERPRINT may follow it
+func (self *Message) AddMessageIntegrity(key []byte) {
+	self.Add(MESSAGE_INTEGRITY, self.integrity(key, len(self.Attributes)))
+}
+
+// CheckMessageIntegrity verifies MESSAGE-INTEGRITY of the message with key
+func (self *Message) CheckMessageIntegrity(key []byte) error {
+	for i, attr := range self.Attributes {
+		if attr.Type != MESSAGE_INTEGRITY {
+			continue
+		}
+		if !hmac.Equal(attr.Value, self.integrity(key, i)) {
+			return ErrBadIntegrity
+		}
+		return nil
+	}
+	return ErrNoIntegrity
+}
+
+// DecodeMessage parses a single stun message that should fill buf completely
+func DecodeMessage(buf []byte) (*Message, error) {
+	if len(buf) < MIN_STUN_LEN {
+		return nil, ErrShortMessage
+	}
+	if buf[0]&0xc0 != 0 {
+		return nil, ErrNotStun
+	}
+	length := int(binary.BigEndian.Uint16(buf[2:4]))
+	if length%4 != 0 || MIN_STUN_LEN+length != len(buf) {
+		return nil, ErrBadLength
+	}
+
+	msg := &Message{
+		Type:   binary.BigEndian.Uint16(buf[0:2]),
+		Cookie: binary.BigEndian.Uint32(buf[4:8]),
+	}
+	copy(msg.ID[:], buf[8:MIN_STUN_LEN])
+
+	body := buf[MIN_STUN_LEN:]
+	for len(body) > 0 {
+		if len(body) < ATTR_HEADER_LEN {
+			return nil, ErrShortAttribute
+		}
+		t := binary.BigEndian.Uint16(body[0:2])
+		l := int(binary.BigEndian.Uint16(body[2:4]))
+		end := ATTR_HEADER_LEN + l + padding(l)
+		if end > len(body) {
+			return nil, ErrShortAttribute
+		}
+		value := make([]byte, l)
+		copy(value, body[ATTR_HEADER_LEN:ATTR_HEADER_LEN+l])
+		msg.Add(t, value)
+		if t == MESSAGE_INTEGRITY && nil == msg.signed {
+			msg.signed = bytes.Clone(buf[:len(buf)-len(body)])
+		}
+		body = body[end:]
+
+		if t == FINGERPRINT {
+			if l != 4 {
+				return nil, ErrBadFingerprint
+			}
+			crc := crc32.ChecksumIEEE(buf[:len(buf)-len(body)-ATTR_HEADER_LEN-4]) ^ FINGERPRINT_XOR
+			if crc != binary.BigEndian.Uint32(value) {
+				return nil, ErrBadFingerprint
+			}
+		}
+	}
+
+	return msg, nil
+}
+
+// UnknownAttributes returns comprehension required attributes that are not in known
+func (self *Message) UnknownAttributes(known map[uint16]bool) []uint16 {
+	var unknown []uint16
+	for _, attr := range self.Attributes {
+		if attr.Type < 0x8000 && !known[attr.Type] {
+			unknown = append(unknown, attr.Type)
+		}
+	}
+	return unknown
+}
+
+// NewResponse creates a response of class to msg, carrying the same transaction
+func NewResponse(msg *Message, class uint16) *Message {
+	return &Message{
+		Type:   msg.Method() | class,
+		Cookie: msg.Cookie,
+		ID:     msg.ID,
+	}
+}
+
+// NewErrorResponse creates an error response to msg with ERROR-CODE attribute
+func NewErrorResponse(msg *Message, code int, reason string) *Message {
+	res := NewResponse(msg, CLASS_ERROR)
+	res.Add(ERROR_CODE, ErrorCodeValue(code, reason))
+	return res
+}
+
+// ErrorCodeValue encodes ERROR-CODE attribute value
+func ErrorCodeValue(code int, reason string) []byte {
+	value := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	return append(value, reason...)
+}
+
+// ParseErrorCode decodes ERROR-CODE attribute value
+func ParseErrorCode(value []byte) (int, string, error) {
+	if len(value) < 4 {
+		return 0, "", ErrShortAttribute
+	}
+	// the number is the code modulo 100, larger ones would alias codes of the next classes
+	if value[3] > 99 {
+		return 0, "", ErrBadErrorCode
+	}
+	return int(value[2]&0x07)*100 + int(value[3]), string(value[4:]), nil
+}
+
+// UnknownAttributesValue encodes UNKNOWN-ATTRIBUTES attribute value
+func UnknownAttributesValue(types []uint16) []byte {
+	value := make([]byte, 0, 2*len(types))
+	for _, t := range types {
+		value = binary.BigEndian.AppendUint16(value, t)
+	}
+	return value
+}
+
+// AddressValue encodes MAPPED-ADDRESS style attribute value for ipv4 or ipv6
+func AddressValue(ip net.IP, port uint16) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if mapped, err := NewMappedAddress(port, ip); nil == err {
+		err = binary.Write(buf, binary.BigEndian, mapped.Addr)
+		return buf.Bytes(), err
+	}
+
+	ip6 := ip.To16()
+	if nil == ip6 {
+		return nil, ErrBadAddress
+	}
+	buf.Write([]byte{0, IPV6_ATTR})
+	binary.Write(buf, binary.BigEndian, port)
+	buf.Write(ip6)
+	return buf.Bytes(), nil
+}
+
+// XorAddressValue encodes XOR-MAPPED-ADDRESS style attribute value for ipv4 or ipv6
+func XorAddressValue(ip net.IP, port uint16, cookie uint32, id [ID_LEN]byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if mapped, err := NewXorMappedAddress(port, ip, cookie); nil == err {
+		err = binary.Write(buf, binary.BigEndian, mapped.Addr)
+		return buf.Bytes(), err
+	}
+
+	value, err := AddressValue(ip, port)
+	if nil != err {
+		return nil, err
+	}
+	xorAddress(value, cookie, id)
+	return value, nil
+}
+
+// xorAddress xors port and ip of an encoded address value in place
+func xorAddress(value []byte, cookie uint32, id [ID_LEN]byte) {
+	key := make([]byte, 4+ID_LEN)
+	binary.BigEndian.PutUint32(key, cookie)
+	copy(key[4:], id[:])
+
+	value[2] ^= key[0]
+	value[3] ^= key[1]
+	for i := 4; i < len(value) && i < len(key)+4; i++ {
+		value[i] ^= key[i-4]
+	}
+}
+
+// ParseAddress decodes MAPPED-ADDRESS style attribute value
+func ParseAddress(value []byte) (net.IP, uint16, error) {
+	if len(value) < 4 {
+		return nil, 0, ErrBadAddress
+	}
+	port := binary.BigEndian.Uint16(value[2:4])
+	switch {
+	case value[1] == IPV4_ATTR && len(value) == 4+net.IPv4len:
+		return net.IP(append([]byte{}, value[4:]...)).To16(), port, nil
+	case value[1] == IPV6_ATTR && len(value) == 4+net.IPv6len:
+		return net.IP(append([]byte{}, value[4:]...)), port, nil
+	}
+	return nil, 0, ErrBadAddress
+}
+
+// ParseXorAddress decodes XOR-MAPPED-ADDRESS style attribute value
+func ParseXorAddress(value []byte, cookie uint32, id [ID_LEN]byte) (net.IP, uint16, error) {
+	plain := append([]byte{}, value...)
+	if len(plain) >= 4 {
+		xorAddress(plain, cookie, id)
+	}
+	return ParseAddress(plain)
+}
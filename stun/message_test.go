@@ -0,0 +1,239 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// test vectors from RFC 5769
+var (
+	rfc5769Request = mustHex(`
+		00 01 00 58 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+		80 22 00 10 53 54 55 4e 20 74 65 73 74 20 63 6c 69 65 6e 74
+		00 24 00 04 6e 00 01 ff
+		80 29 00 08 93 2f f9 b1 51 26 3b 36
+		00 06 00 09 65 76 74 6a 3a 68 36 76 59 20 20 20
+		00 08 00 14 9a ea a7 0c bf d8 cb 56 78 1e f2 b5 b2 d3 f2 49 c1 b5 71 a2
+		80 28 00 04 e5 7a 3b cf`)
+	rfc5769IPv4Response = mustHex(`
+		01 01 00 3c 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+		80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+		00 20 00 08 00 01 a1 47 e1 12 a6 43
+		00 08 00 14 2b 91 f5 99 fd 9e 90 c3 8c 74 89 f9 2a f9 ba 53 f0 6b e7 d7
+		80 28 00 04 c0 7d 4c 96`)
+	rfc5769IPv6Response = mustHex(`
+		01 01 00 48 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+		80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+		00 20 00 14 00 02 a1 47 01 13 a9 fa a5 d3 f1 79 bc 25 f4 b5 be d2 b9 d9
+		00 08 00 14 a3 82 95 4e 4b e6 7b f1 17 84 c9 7c 82 92 c2 75 bf e3 ed 41
+		80 28 00 04 c8 fb 0b 4c`)
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if nil != err {
+		panic(err)
+	}
+	return b
+}
+
+func TestDecodeMessage(t *testing.T) {
+	testCases := map[string]struct {
+		buf        []byte
+		msgType    uint16
+		attributes int
+		ip         net.IP
+		port       uint16
+	}{
+		"rfc5769 request": {
+			buf:        rfc5769Request,
+			msgType:    BINDING_REQUEST,
+			attributes: 6,
+		},
+		"rfc5769 ipv4 response": {
+			buf:        rfc5769IPv4Response,
+			msgType:    BINDING_SUCCESS_RESPONSE,
+			attributes: 4,
+			ip:         net.ParseIP("192.0.2.1"),
+			port:       32853,
+		},
+		"rfc5769 ipv6 response": {
+			buf:        rfc5769IPv6Response,
+			msgType:    BINDING_SUCCESS_RESPONSE,
+			attributes: 4,
+			ip:         net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"),
+			port:       32853,
+		},
+	}
+
+	for name, test := range testCases {
+		// test := test // NOTE: uncomment for Go < 1.22, see /doc/faq#closures_and_goroutines
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			msg, err := DecodeMessage(test.buf)
+			if nil != err {
+				t.Fatalf("Could not decode message with error: %s", err)
+			}
+			if msg.Type != test.msgType {
+				t.Errorf("type %#04x is not same as expected %#04x", msg.Type, test.msgType)
+			}
+			if len(msg.Attributes) != test.attributes {
+				t.Errorf("%d attributes is not same as expected %d", len(msg.Attributes), test.attributes)
+			}
+			if msg.Cookie != MESAGE_COOKIE {
+				t.Errorf("cookie %#04x is not magic cookie", msg.Cookie)
+			}
+
+			if nil == test.ip {
+				return
+			}
+			value, ok := msg.Get(XOR_MAPPED_ADDRESS)
+			if !ok {
+				t.Fatal("XOR-MAPPED-ADDRESS is missing")
+			}
+			ip, port, err := ParseXorAddress(value, msg.Cookie, msg.ID)
+			if nil != err {
+				t.Fatalf("Could not parse xor address with error: %s", err)
+			}
+			if !ip.Equal(test.ip) || port != test.port {
+				t.Errorf("address %s:%d is not same as expected %s:%d", ip, port, test.ip, test.port)
+			}
+
+			encoded, err := XorAddressValue(test.ip, test.port, msg.Cookie, msg.ID)
+			if nil != err || !bytes.Equal(encoded, value) {
+				t.Errorf("encoded xor address % x is not same as expected % x", encoded, value)
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	corrupt := append([]byte{}, rfc5769Request...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	testCases := map[string]struct {
+		buf []byte
+		err error
+	}{
+		"short message":         {buf: rfc5769Request[:19], err: ErrShortMessage},
+		"not stun":              {buf: append([]byte{0xc0}, rfc5769Request[1:]...), err: ErrNotStun},
+		"length mismatch":       {buf: rfc5769Request[:len(rfc5769Request)-4], err: ErrBadLength},
+		"bad fingerprint":       {buf: corrupt, err: ErrBadFingerprint},
+		"truncated attribute":   {buf: mustHex("00 01 00 04 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae 80 22 00 10"), err: ErrShortAttribute},
+		"misaligned length":     {buf: mustHex("00 01 00 02 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae 00 00"), err: ErrBadLength},
+		"attribute header only": {buf: mustHex("00 01 00 04 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae 00 06 00 01"), err: ErrShortAttribute},
+	}
+
+	for name, test := range testCases {
+		// test := test // NOTE: uncomment for Go < 1.22, see /doc/faq#closures_and_goroutines
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := DecodeMessage(test.buf); err != test.err {
+				t.Errorf("error %v is not same as expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseErrorCode(t *testing.T) {
+	testCases := map[string]struct {
+		value  []byte
+		code   int
+		reason string
+		err    error
+	}{
+		"error code should round trip":        {value: ErrorCodeValue(CODE_UNAUTHORIZED, REASON_UNAUTHORIZED), code: CODE_UNAUTHORIZED, reason: REASON_UNAUTHORIZED},
+		"reserved bits should be ignored":     {value: []byte{0xff, 0xff, 0xfc, 20}, code: 420},
+		"short value should be rejected":      {value: []byte{0, 0, 4}, err: ErrShortAttribute},
+		"number above 99 should be rejected":  {value: []byte{0, 0, 3, 199}, err: ErrBadErrorCode},
+		"number 99 should complete the class": {value: []byte{0, 0, 6, 99}, code: 699},
+	}
+
+	for name, test := range testCases {
+		// test := test // NOTE: uncomment for Go < 1.22, see /doc/faq#closures_and_goroutines
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			code, reason, err := ParseErrorCode(test.value)
+			if err != test.err {
+				t.Fatalf("error %v is not same as expected %v", err, test.err)
+			}
+			if code != test.code || reason != test.reason {
+				t.Errorf("error code %d %q is not same as expected %d %q", code, reason, test.code, test.reason)
+			}
+		})
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	req, err := DecodeMessage(rfc5769Request)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	res := NewResponse(req, CLASS_SUCCESS)
+	xorMapped, err := XorAddressValue(net.ParseIP("192.0.2.1"), 32853, req.Cookie, req.ID)
+	if nil != err {
+		t.Fatal(err)
+	}
+	res.Add(SOFTWARE, []byte("test vector"))
+	res.Add(XOR_MAPPED_ADDRESS, xorMapped)
+	res.AddFingerprint()
+
+	decoded, err := DecodeMessage(res.Encode())
+	if nil != err {
+		t.Fatalf("Could not decode encoded message with error: %s", err)
+	}
+	if decoded.Type != BINDING_SUCCESS_RESPONSE || decoded.ID != req.ID {
+		t.Errorf("decoded %s is not a response to %s", decoded, req)
+	}
+	if !bytes.Equal(decoded.Encode(), res.Encode()) {
+		t.Error("encode(decode(x)) is not same as x")
+	}
+}
+
+func TestMessageIntegrity(t *testing.T) {
+	key := []byte("VOkJxbRl1RmTxUk/WvJxBt")
+	for name, buf := range map[string][]byte{
+		"rfc5769 request":       rfc5769Request,
+		"rfc5769 ipv4 response": rfc5769IPv4Response,
+		"rfc5769 ipv6 response": rfc5769IPv6Response,
+	} {
+		t.Run(name, func(t *testing.T) {
+			msg, err := DecodeMessage(buf)
+			if nil != err {
+				t.Fatal(err)
+			}
+			if err := msg.CheckMessageIntegrity(key); nil != err {
+				t.Errorf("integrity check failed with error: %s", err)
+			}
+			if err := msg.CheckMessageIntegrity([]byte("wrong")); err != ErrBadIntegrity {
+				t.Errorf("integrity check with wrong key returned %v", err)
+			}
+		})
+	}
+
+	req, err := DecodeMessage(rfc5769Request)
+	if nil != err {
+		t.Fatal(err)
+	}
+	res := NewResponse(req, CLASS_SUCCESS)
+	if err := res.CheckMessageIntegrity(key); err != ErrNoIntegrity {
+		t.Errorf("integrity check without attribute returned %v", err)
+	}
+	res.Add(SOFTWARE, []byte("test"))
+	res.AddMessageIntegrity(key)
+	res.AddFingerprint()
+	decoded, err := DecodeMessage(res.Encode())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err := decoded.CheckMessageIntegrity(key); nil != err {
+		t.Errorf("integrity check of added attribute failed with error: %s", err)
+	}
+}
@@ -2,73 +2,308 @@ package stun
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func registerMetrics() {
-	var (
-		BuildInfo = prometheus.NewGaugeFunc(
-			prometheus.GaugeOpts{
-				Namespace: "lstun",
-				Name:      "build_info",
-				Help:      "Information about lstun binary",
-				ConstLabels: prometheus.Labels{
-					"version":    Version,
-					"build_date": BuildDate,
-					"env":        Env,
-				},
-			},
-			func() float64 { return 1 },
-		)
-		UptimeInfo = prometheus.NewGaugeFunc(
-			prometheus.GaugeOpts{
-				Namespace: "lstun",
-				Name:      "uptime_sec",
-				Help:      "Information about binary uptime",
+const (
+	METRICS_NAMESPACE = "lstun"
+	FAMILY_IPV4       = "ipv4"
+	FAMILY_IPV6       = "ipv6"
+	// ALPN_NONE labels tls connections negotiating no application protocol
+	ALPN_NONE = "none"
+)
+
+// Metrics holds stun traffic metrics of a server on its own registry
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests  *prometheus.CounterVec
+	responses *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+	malformed *prometheus.CounterVec
+	dropped   *prometheus.CounterVec
+	bytesIn   *prometheus.CounterVec
+	bytesOut  *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+	handshake *prometheus.CounterVec
+	demux     *prometheus.CounterVec
+	keepalive *prometheus.CounterVec
+	phase     *prometheus.GaugeVec
+}
+
+// NewMetrics creates traffic, build and runtime metrics registered on a dedicated registry
+func NewMetrics() *Metrics {
+	labels := []string{"transport", "family"}
+	self := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "requests_total",
+			Help:      "Stun messages received and dispatched to handler",
+		}, labels),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "responses_total",
+			Help:      "Stun responses sent, by class",
+		}, append(labels, "class")),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "error_responses_total",
+			Help:      "Stun error responses sent, by error code",
+		}, append(labels, "code")),
+		malformed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "malformed_packets_total",
+			Help:      "Packets dropped as they could not be decoded as stun",
+		}, labels),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "dropped_packets_total",
+			Help:      "Datagrams dropped as every udp worker was busy",
+		}, labels),
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "received_bytes_total",
+			Help:      "Bytes received on stun listeners",
+		}, labels),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "sent_bytes_total",
+			Help:      "Bytes sent on stun listeners",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "handler_duration_seconds",
+			Help:      "Time spent in request handler",
+			Buckets:   []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .1},
+		}, labels),
+		handshake: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "tls_handshakes_total",
+			Help:      "Tls handshakes on stun listeners, by negotiated application protocol and result",
+		}, []string{"protocol", "result"}),
+		demux: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "demuxed_packets_total",
+			Help:      "Datagrams of other protocols passed to their handler on the udp listener, by protocol",
+		}, []string{"protocol"}),
+		keepalive: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "binding_indications_total",
+			Help:      "Binding indications received, sent by clients as keepalives",
+		}, labels),
+		phase: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "shutdown_phase",
+			Help:      "Lifecycle phase of the server, 1 for the current phase",
+		}, []string{"phase"}),
+	}
+	self.setPhase(PHASE_SERVING)
+
+	buildInfo := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "build_info",
+			Help:      "Information about lstun binary",
+			ConstLabels: prometheus.Labels{
+				"version":    Version,
+				"build_date": BuildDate,
+				"env":        Env,
 			},
-			func() float64 { return time.Since(StartDate).Truncate(time.Second).Seconds() },
-		)
+		},
+		func() float64 { return 1 },
+	)
+	uptimeInfo := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "uptime_sec",
+			Help:      "Information about binary uptime",
+		},
+		func() float64 { return time.Since(StartDate).Truncate(time.Second).Seconds() },
+	)
+
+	self.Registry.MustRegister(
+		buildInfo,
+		uptimeInfo,
+		self.requests,
+		self.responses,
+		self.errors,
+		self.malformed,
+		self.dropped,
+		self.bytesIn,
+		self.bytesOut,
+		self.latency,
+		self.handshake,
+		self.demux,
+		self.keepalive,
+		self.phase,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
+	return self
+}
+
+// addressFamily labels addr as ipv4 or ipv6
+func addressFamily(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if nil == ip.To4() {
+		return FAMILY_IPV6
+	}
+	return FAMILY_IPV4
+}
+
+// metrics methods are nil safe, so listeners can run without metrics
+
+func (self *Metrics) received(transport string, addr net.Addr, n int) {
+	if nil == self {
+		return
+	}
+	self.bytesIn.WithLabelValues(transport, addressFamily(addr)).Add(float64(n))
+}
+
+func (self *Metrics) sent(transport string, addr net.Addr, n int) {
+	if nil == self {
+		return
+	}
+	self.bytesOut.WithLabelValues(transport, addressFamily(addr)).Add(float64(n))
+}
 
-	prometheus.MustRegister(BuildInfo)
-	prometheus.MustRegister(UptimeInfo)
+func (self *Metrics) malformedPacket(transport string, addr net.Addr) {
+	if nil == self {
+		return
+	}
+	self.malformed.WithLabelValues(transport, addressFamily(addr)).Inc()
 }
 
-func MonitoringStart(ctx context.Context, conf MonitoringConf, wg *sync.WaitGroup) {
-
-	registerMetrics()
-	addr := fmt.Sprintf(":%d", conf.Port)
-	log.Println("Monitoring at: ", addr)
-	srv := http.Server{Addr: addr}
-	http.Handle(conf.Path, promhttp.Handler())
-	(*wg).Add(1)
-	go func() {
-		defer (*wg).Done()
-		log.Printf("Starting Monitoring server, listening port at %d/%s", conf.Port, conf.Path)
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			// Error starting or closing listener:
-			log.Fatalf("Monitoring server listen error: %v", err)
+func (self *Metrics) droppedPacket(transport string, addr net.Addr) {
+	if nil == self {
+		return
+	}
+	self.dropped.WithLabelValues(transport, addressFamily(addr)).Inc()
+}
+
+func (self *Metrics) tlsHandshake(protocol string, err error) {
+	if nil == self {
+		return
+	}
+	if protocol == "" {
+		protocol = ALPN_NONE
+	}
+	result := "success"
+	if nil != err {
+		result = "failure"
+	}
+	self.handshake.WithLabelValues(protocol, result).Inc()
+}
+
+func (self *Metrics) demuxed(protocol string) {
+	if nil == self {
+		return
+	}
+	self.demux.WithLabelValues(protocol).Inc()
+}
+
+func (self *Metrics) setPhase(phase string) {
+	if nil == self {
+		return
+	}
+	for _, p := range phases {
+		value := 0.0
+		if p == phase {
+			value = 1
 		}
-		log.Println("Stopped Monitoring server ...")
-	}()
+		self.phase.WithLabelValues(p).Set(value)
+	}
+}
+
+// Middleware counts requests, responses by class and error code, and measures handler latency
+func (self *Metrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			family := addressFamily(r.RemoteAddr)
+			self.requests.WithLabelValues(r.Transport, family).Inc()
+			if r.Message.Type == BINDING_INDICATION {
+				self.keepalive.WithLabelValues(r.Transport, family).Inc()
+			}
+
+			start := time.Now()
+			rw := &resultWriter{ResponseWriter: w}
+			next.ServeSTUN(rw, r)
+			self.latency.WithLabelValues(r.Transport, family).Observe(time.Since(start).Seconds())
 
-	(*wg).Add(1)
-	go func() {
-		defer (*wg).Done()
+			if nil == rw.res {
+				return
+			}
+			self.responses.WithLabelValues(r.Transport, family, className(rw.res.Class())).Inc()
+			if rw.res.Class() == CLASS_ERROR {
+				code := "unknown"
+				if value, ok := rw.res.Get(ERROR_CODE); ok {
+					if c, _, err := ParseErrorCode(value); nil == err {
+						code = strconv.Itoa(c)
+					}
+				}
+				self.errors.WithLabelValues(r.Transport, family, code).Inc()
+			}
+		})
+	}
+}
+
+func className(class uint16) string {
+	switch class {
+	case CLASS_REQUEST:
+		return "request"
+	case CLASS_INDICATION:
+		return "indication"
+	case CLASS_SUCCESS:
+		return "success"
+	}
+	return "error"
+}
+
+// MonitoringMux serves prometheus metrics of registry at configured path, with health endpoints
+func MonitoringMux(conf MonitoringConf, registry *prometheus.Registry, health *Health) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(conf.Path, promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry}))
+	health.Handlers(mux)
+	return mux
+}
+
+// MonitoringStart serves monitoring handler on an already bound listener under sup, till its context is cancelled
+func MonitoringStart(sup *Supervisor, conf MonitoringConf, handler http.Handler, listener net.Listener) {
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	srv := http.Server{Handler: handler}
+	sup.Go("monitoring", func(ctx context.Context) error {
+		slog.Info("Starting Monitoring server", "port", port, "path", conf.Path)
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			return err
+		}
+		slog.Info("Stopped Monitoring server")
+		return nil
+	})
 
+	sup.Go("monitoring shutdown", func(ctx context.Context) error {
 		<-ctx.Done()
-		log.Println("Stopping Monitoring server ...")
+		slog.Info("Stopping Monitoring server")
 
 		if err := srv.Shutdown(context.Background()); err != nil {
 			// Error from closing listeners, or context timeout:
-			log.Printf("Monitoring server shutdown error: %v", err)
+			slog.Warn("Monitoring server shutdown error", "error", err)
 		}
-	}()
+		return nil
+	})
 }
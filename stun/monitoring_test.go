@@ -0,0 +1,131 @@
+package stun
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// scrape returns metric families exposed on monitoring endpoint of server
+func scrape(t *testing.T, server *Server) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", loopback(server.Addrs().Monitoring), DEFAULT_MONITORING_PATH))
+	if nil != err {
+		t.Fatalf("Could not scrape metrics: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var parser expfmt.TextParser
+	mf, err := parser.TextToMetricFamilies(resp.Body)
+	if nil != err {
+		t.Fatalf("Could not parse metrics: %s", err)
+	}
+	return mf
+}
+
+// counterValue sums counters of family whose labels include all of labels
+func counterValue(mf map[string]*dto.MetricFamily, family string, labels map[string]string) float64 {
+	sum := 0.0
+	for _, m := range mf[family].GetMetric() {
+		matched := 0
+		for _, l := range m.GetLabel() {
+			if v, ok := labels[l.GetName()]; ok && v == l.GetValue() {
+				matched++
+			}
+		}
+		if matched == len(labels) {
+			sum += m.GetCounter().GetValue()
+		}
+	}
+	return sum
+}
+
+func TestMetrics(t *testing.T) {
+	// servers in the same process should not conflict on metric registration
+	startTestServer(t, testConfiguration(), nil)
+	server := startTestServer(t, testConfiguration(), nil)
+	addrs := server.Addrs()
+
+	// readiness probes are counted too, so only traffic after the first probe is checked
+	waitReady(t, server)
+	before := scrape(t, server)
+
+	bindingRequest(t, TRANSPORT_UDP, loopback(addrs.Udp))
+	bindingRequest(t, TRANSPORT_UDP, loopback(addrs.Udp))
+	bindingRequest(t, TRANSPORT_TCP, loopback(addrs.Tcp))
+
+	conn, err := net.Dial("udp", loopback(addrs.Udp))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(make([]byte, MIN_STUN_LEN+1)); nil != err {
+		t.Fatal(err)
+	}
+
+	// malformed packet is handled asynchronously
+	var mf map[string]*dto.MetricFamily
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mf = scrape(t, server)
+		if counterValue(mf, "lstun_malformed_packets_total", nil) > 0 {
+			break
+		}
+	}
+
+	testCases := map[string]struct {
+		family   string
+		labels   map[string]string
+		expected float64
+	}{
+		"udp requests":      {family: "lstun_requests_total", labels: map[string]string{"transport": "udp", "family": "ipv4"}, expected: 2},
+		"tcp requests":      {family: "lstun_requests_total", labels: map[string]string{"transport": "tcp", "family": "ipv4"}, expected: 1},
+		"success responses": {family: "lstun_responses_total", labels: map[string]string{"class": "success"}, expected: 3},
+		"malformed packets": {family: "lstun_malformed_packets_total", labels: map[string]string{"transport": "udp"}, expected: 1},
+	}
+	for name, test := range testCases {
+		if value := counterValue(mf, test.family, test.labels) - counterValue(before, test.family, test.labels); value != test.expected {
+			t.Errorf("%s: %s %v is %v, expected %v", name, test.family, test.labels, value, test.expected)
+		}
+	}
+
+	for _, family := range []string{"lstun_received_bytes_total", "lstun_sent_bytes_total"} {
+		if counterValue(mf, family, map[string]string{"transport": "udp"}) == 0 {
+			t.Errorf("%s should count udp traffic", family)
+		}
+	}
+	for _, family := range []string{"lstun_handler_duration_seconds", "lstun_build_info", "lstun_uptime_sec"} {
+		if _, ok := mf[family]; !ok {
+			t.Errorf("Metric %s is not present", family)
+		}
+	}
+}
+
+func TestMetricsErrorCodes(t *testing.T) {
+	metrics := NewMetrics()
+	allocate := &Message{Type: 0x0003, Cookie: MESAGE_COOKIE}
+	Chain(BindingHandler(), metrics.Middleware()).ServeSTUN(&recordingWriter{}, &Request{
+		Message:    allocate,
+		Transport:  TRANSPORT_UDP,
+		RemoteAddr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3478},
+	})
+
+	mfs, err := metrics.Registry.Gather()
+	if nil != err {
+		t.Fatal(err)
+	}
+	mf := map[string]*dto.MetricFamily{}
+	for _, f := range mfs {
+		mf[f.GetName()] = f
+	}
+
+	labels := map[string]string{"transport": "udp", "family": "ipv6", "code": "400"}
+	if value := counterValue(mf, "lstun_error_responses_total", labels); value != 1 {
+		t.Errorf("lstun_error_responses_total %v is %v, expected 1", labels, value)
+	}
+}
@@ -0,0 +1,190 @@
+package stun
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// key algorithms of RFC 7635 accepted in the key file
+const (
+	ALG_A128GCM = "A128GCM"
+	ALG_A256GCM = "A256GCM"
+)
+
+// OAUTH_MAX_SKEW is how far in the future a token timestamp is accepted
+const OAUTH_MAX_SKEW = 30 * time.Second
+
+var (
+	ErrUnknownKid   = errors.New("access token key id is unknown")
+	ErrBadToken     = errors.New("access token is malformed")
+	ErrTokenExpired = errors.New("access token is expired")
+)
+
+type OAuthConf struct {
+	// KeyFile holds the keys shared with the authorization server, oauth is disabled when empty
+	KeyFile string `mapstructure:"key_file"`
+	// ServerName is the name tokens are issued for, it authenticates the token as associated data
+	ServerName string `mapstructure:"server_name"`
+	// AuthorizationServer is sent in THIRD-PARTY-AUTHORIZATION for clients to get tokens from
+	AuthorizationServer string `mapstructure:"authorization_server"`
+}
+
+func (self OAuthConf) String() string {
+	return fmt.Sprintf("{KeyFile: %s, ServerName: %s, AuthorizationServer: %s}", self.KeyFile, self.ServerName, self.AuthorizationServer)
+}
+
+func (self OAuthConf) Enabled() bool {
+	return self.KeyFile != ""
+}
+
+// jsonWebKey is a symmetric key of a JWK set, RFC 7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`
+}
+
+// LoadOAuthKeys reads a JWK set of symmetric AES-GCM keys, by their key ids
+func LoadOAuthKeys(path string) (map[string]cipher.AEAD, error) {
+	buf, err := os.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(buf, &set); nil != err {
+		return nil, fmt.Errorf("key file %s is not a JWK set: %w", path, err)
+	}
+
+	keys := map[string]cipher.AEAD{}
+	for i, key := range set.Keys {
+		if key.Kty != "oct" || key.Kid == "" {
+			return nil, fmt.Errorf("key %d should be a symmetric key with a kid", i)
+		}
+		if _, ok := keys[key.Kid]; ok {
+			return nil, fmt.Errorf("kid %q is used more than once", key.Kid)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(key.K)
+		if nil != err {
+			return nil, fmt.Errorf("key %q is not base64url: %w", key.Kid, err)
+		}
+		size := map[string]int{ALG_A128GCM: 16, ALG_A256GCM: 32}[key.Alg]
+		if size == 0 {
+			return nil, fmt.Errorf("key %q algorithm %q should be %s or %s", key.Kid, key.Alg, ALG_A128GCM, ALG_A256GCM)
+		}
+		if len(secret) != size {
+			return nil, fmt.Errorf("key %q is %d bytes, %s needs %d", key.Kid, len(secret), key.Alg, size)
+		}
+		block, err := aes.NewCipher(secret)
+		if nil != err {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if nil != err {
+			return nil, err
+		}
+		keys[key.Kid] = aead
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key file %s has no keys", path)
+	}
+	return keys, nil
+}
+
+// AccessToken is the content of an ACCESS-TOKEN, RFC 7635 section 6.2
+type AccessToken struct {
+	MacKey    []byte
+	Timestamp time.Time
+	Lifetime  time.Duration
+}
+
+// tokenTimestamp encodes t as 48 bits of seconds and 16 bits of 1/64000 fractions
+func tokenTimestamp(t time.Time) uint64 {
+	return uint64(t.Unix())<<16 | uint64(t.Nanosecond()/int(time.Second/64000))
+}
+
+func parseTokenTimestamp(value uint64) time.Time {
+	return time.Unix(int64(value>>16), int64(value&0xffff)*int64(time.Second/64000))
+}
+
+// OAuth validates access tokens issued by an authorization server sharing its keys
+type OAuth struct {
+	serverName          string
+	authorizationServer string
+	keys                map[string]cipher.AEAD
+}
+
+func NewOAuth(conf OAuthConf) (*OAuth, error) {
+	keys, err := LoadOAuthKeys(conf.KeyFile)
+	if nil != err {
+		return nil, err
+	}
+	return &OAuth{serverName: conf.ServerName, authorizationServer: conf.AuthorizationServer, keys: keys}, nil
+}
+
+// Seal encrypts token with the key kid, as an authorization server issues it
+func (self *OAuth) Seal(kid string, token AccessToken) ([]byte, error) {
+	aead, ok := self.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKid
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); nil != err {
+		return nil, err
+	}
+
+	plain := binary.BigEndian.AppendUint16(nil, uint16(len(token.MacKey)))
+	plain = append(plain, token.MacKey...)
+	plain = binary.BigEndian.AppendUint64(plain, tokenTimestamp(token.Timestamp))
+	plain = binary.BigEndian.AppendUint32(plain, uint32(token.Lifetime/time.Second))
+
+	value := binary.BigEndian.AppendUint16(nil, uint16(len(nonce)))
+	value = append(value, nonce...)
+	return aead.Seal(value, nonce, plain, []byte(self.serverName)), nil
+}
+
+// Open decrypts an ACCESS-TOKEN value with the key kid and returns its mac key, if the token is
+// valid at now
+func (self *OAuth) Open(kid string, value []byte, now time.Time) ([]byte, error) {
+	aead, ok := self.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKid
+	}
+	if len(value) < 2 {
+		return nil, ErrBadToken
+	}
+	nonceLen := int(binary.BigEndian.Uint16(value))
+	if nonceLen != aead.NonceSize() || len(value) < 2+nonceLen {
+		return nil, ErrBadToken
+	}
+	nonce := value[2 : 2+nonceLen]
+	plain, err := aead.Open(nil, nonce, value[2+nonceLen:], []byte(self.serverName))
+	if nil != err {
+		return nil, fmt.Errorf("%w: %s", ErrBadToken, err)
+	}
+
+	if len(plain) < 2 {
+		return nil, ErrBadToken
+	}
+	keyLen := int(binary.BigEndian.Uint16(plain))
+	if len(plain) != 2+keyLen+8+4 {
+		return nil, ErrBadToken
+	}
+	macKey := plain[2 : 2+keyLen]
+	timestamp := parseTokenTimestamp(binary.BigEndian.Uint64(plain[2+keyLen:]))
+	lifetime := time.Duration(binary.BigEndian.Uint32(plain[2+keyLen+8:])) * time.Second
+	if now.After(timestamp.Add(lifetime)) || timestamp.After(now.Add(OAUTH_MAX_SKEW)) {
+		return nil, ErrTokenExpired
+	}
+	return macKey, nil
+}
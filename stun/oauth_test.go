@@ -0,0 +1,157 @@
+package stun
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testOAuthKeys = `{"keys": [
+	{"kty": "oct", "kid": "north", "alg": "A128GCM", "k": "AAECAwQFBgcICQoLDA0ODw"},
+	{"kty": "oct", "kid": "south", "alg": "A256GCM", "k": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8"}
+]}`
+
+func writeOAuthKeys(t testing.TB, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); nil != err {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testOAuth(t testing.TB, serverName string) *OAuth {
+	t.Helper()
+	oauth, err := NewOAuth(OAuthConf{KeyFile: writeOAuthKeys(t, testOAuthKeys), ServerName: serverName, AuthorizationServer: "https://as.example.org"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	return oauth
+}
+
+func TestLoadOAuthKeys(t *testing.T) {
+	keys, err := LoadOAuthKeys(writeOAuthKeys(t, testOAuthKeys))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("%d keys loaded, expected 2", len(keys))
+	}
+
+	tests := map[string]string{
+		"not json":       `keys`,
+		"no keys":        `{"keys": []}`,
+		"asymmetric key": `{"keys": [{"kty": "RSA", "kid": "a", "alg": "A128GCM", "k": "AAECAwQFBgcICQoLDA0ODw"}]}`,
+		"missing kid":    `{"keys": [{"kty": "oct", "alg": "A128GCM", "k": "AAECAwQFBgcICQoLDA0ODw"}]}`,
+		"duplicate kid":  `{"keys": [{"kty": "oct", "kid": "a", "alg": "A128GCM", "k": "AAECAwQFBgcICQoLDA0ODw"}, {"kty": "oct", "kid": "a", "alg": "A128GCM", "k": "AAECAwQFBgcICQoLDA0ODw"}]}`,
+		"not base64url":  `{"keys": [{"kty": "oct", "kid": "a", "alg": "A128GCM", "k": "AAECAwQFBgcICQoLDA0ODw=="}]}`,
+		"unknown alg":    `{"keys": [{"kty": "oct", "kid": "a", "alg": "HS256", "k": "AAECAwQFBgcICQoLDA0ODw"}]}`,
+		"wrong key size": `{"keys": [{"kty": "oct", "kid": "a", "alg": "A256GCM", "k": "AAECAwQFBgcICQoLDA0ODw"}]}`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadOAuthKeys(writeOAuthKeys(t, content)); nil == err {
+				t.Error("key file should be rejected")
+			}
+		})
+	}
+	if _, err := LoadOAuthKeys(filepath.Join(t.TempDir(), "missing.json")); nil == err {
+		t.Error("missing key file should be rejected")
+	}
+}
+
+func TestTokenTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, int64(500*time.Millisecond))
+	value := tokenTimestamp(now)
+	if value>>16 != 1700000000 || value&0xffff != 32000 {
+		t.Errorf("timestamp of %s encoded as %x", now, value)
+	}
+	if parsed := parseTokenTimestamp(value); !parsed.Equal(now) {
+		t.Errorf("timestamp %x parsed as %s, expected %s", value, parsed, now)
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	oauth := testOAuth(t, "stun.example.org")
+	now := time.Now()
+	macKey := bytes.Repeat([]byte{0x5a}, 20)
+
+	tests := map[string]struct {
+		kid    string
+		token  AccessToken
+		opener *OAuth
+		openAs string
+		err    error
+	}{
+		"valid token": {
+			kid:   "north",
+			token: AccessToken{MacKey: macKey, Timestamp: now, Lifetime: time.Hour},
+		},
+		"valid token with 256 bit key": {
+			kid:   "south",
+			token: AccessToken{MacKey: macKey, Timestamp: now.Add(-time.Minute), Lifetime: time.Hour},
+		},
+		"expired token": {
+			kid:   "north",
+			token: AccessToken{MacKey: macKey, Timestamp: now.Add(-2 * time.Hour), Lifetime: time.Hour},
+			err:   ErrTokenExpired,
+		},
+		"token from the future": {
+			kid:   "north",
+			token: AccessToken{MacKey: macKey, Timestamp: now.Add(time.Hour), Lifetime: time.Hour},
+			err:   ErrTokenExpired,
+		},
+		"token for another server": {
+			kid:    "north",
+			token:  AccessToken{MacKey: macKey, Timestamp: now, Lifetime: time.Hour},
+			opener: testOAuth(t, "turn.example.org"),
+			err:    ErrBadToken,
+		},
+		"token opened with another key": {
+			kid:    "north",
+			token:  AccessToken{MacKey: macKey, Timestamp: now, Lifetime: time.Hour},
+			openAs: "south",
+			err:    ErrBadToken,
+		},
+		"unknown kid": {
+			kid:    "north",
+			token:  AccessToken{MacKey: macKey, Timestamp: now, Lifetime: time.Hour},
+			openAs: "east",
+			err:    ErrUnknownKid,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			value, err := oauth.Seal(test.kid, test.token)
+			if nil != err {
+				t.Fatal(err)
+			}
+			opener, kid := oauth, test.kid
+			if nil != test.opener {
+				opener = test.opener
+			}
+			if test.openAs != "" {
+				kid = test.openAs
+			}
+			key, err := opener.Open(kid, value, now)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("open returned %v, expected %v", err, test.err)
+			}
+			if nil == test.err && !bytes.Equal(key, macKey) {
+				t.Errorf("mac key %x opened, expected %x", key, macKey)
+			}
+		})
+	}
+
+	if _, err := oauth.Seal("east", AccessToken{MacKey: macKey}); err != ErrUnknownKid {
+		t.Errorf("seal with unknown kid returned %v", err)
+	}
+	for _, value := range [][]byte{nil, {0}, {0, 12, 1, 2}} {
+		if _, err := oauth.Open("north", value, now); !errors.Is(err, ErrBadToken) {
+			t.Errorf("open of %x returned %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package stun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	PROXY_V1_MAX_LEN    = 107
+	PROXY_V2_HEADER_LEN = 16
+)
+
+// PROXY protocol v2 fields
+const (
+	PROXY_V2_VERSION  = 0x20
+	PROXY_V2_LOCAL    = 0x00
+	PROXY_V2_PROXY    = 0x01
+	PROXY_V2_TCP4     = 0x11
+	PROXY_V2_UDP4     = 0x12
+	PROXY_V2_TCP6     = 0x21
+	PROXY_V2_UDP6     = 0x22
+	PROXY_V2_IPV4_LEN = 12
+	PROXY_V2_IPV6_LEN = 36
+	PROXY_V1_PREFIX   = "PROXY "
+	PROXY_V1_UNKNOWN  = "UNKNOWN"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	ErrNoProxyHeader  = errors.New("proxy protocol header is missing")
+	ErrBadProxyHeader = errors.New("malformed proxy protocol header")
+)
+
+type ProxyConf struct {
+	// Tcp expects a PROXY protocol v1 or v2 header on tcp and tls connections of trusted sources
+	Tcp bool
+	// Udp expects a PROXY protocol v2 header on every datagram of trusted sources
+	Udp bool
+	// Trusted lists networks of load balancers, other peers are served by their own address.
+	// Loopback should not be trusted, readiness probes do not send a header.
+	Trusted []string
+}
+
+func (self ProxyConf) String() string {
+	return fmt.Sprintf("{Tcp: %t, Udp: %t, Trusted: %v}", self.Tcp, self.Udp, self.Trusted)
+}
+
+// ProxyHeader is a decoded PROXY protocol header. Source is nil for LOCAL and UNKNOWN
+// headers, in which case the connection address is the peer.
+type ProxyHeader struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// proxyAddr builds a tcp or udp address, as the transport of the header tells
+func proxyAddr(stream bool, ip net.IP, port int) net.Addr {
+	if stream {
+		return &net.TCPAddr{IP: ip, Port: port}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+// ParseProxyHeaderV2 decodes a v2 header at the start of buf and returns it with its length
+func ParseProxyHeaderV2(buf []byte) (*ProxyHeader, int, error) {
+	if len(buf) < PROXY_V2_HEADER_LEN || !bytes.Equal(buf[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, 0, ErrNoProxyHeader
+	}
+	verCmd, family := buf[12], buf[13]
+	length := PROXY_V2_HEADER_LEN + int(binary.BigEndian.Uint16(buf[14:16]))
+	if verCmd&0xf0 != PROXY_V2_VERSION || len(buf) < length {
+		return nil, 0, ErrBadProxyHeader
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch verCmd & 0x0f {
+	case PROXY_V2_LOCAL:
+		return header, length, nil
+	case PROXY_V2_PROXY:
+	default:
+		return nil, 0, ErrBadProxyHeader
+	}
+
+	body := buf[PROXY_V2_HEADER_LEN:length]
+	var ipLen int
+	switch family {
+	case PROXY_V2_TCP4, PROXY_V2_UDP4:
+		ipLen = net.IPv4len
+	case PROXY_V2_TCP6, PROXY_V2_UDP6:
+		ipLen = net.IPv6len
+	default:
+		// unix sockets and unspecified families carry no usable address
+		return header, length, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, 0, ErrBadProxyHeader
+	}
+
+	stream := family == PROXY_V2_TCP4 || family == PROXY_V2_TCP6
+	src := net.IP(append([]byte(nil), body[:ipLen]...))
+	dst := net.IP(append([]byte(nil), body[ipLen:2*ipLen]...))
+	header.Source = proxyAddr(stream, src, int(binary.BigEndian.Uint16(body[2*ipLen:])))
+	header.Destination = proxyAddr(stream, dst, int(binary.BigEndian.Uint16(body[2*ipLen+2:])))
+	return header, length, nil
+}
+
+// parseProxyHeaderV1 decodes a v1 text header line, without the trailing CRLF
+func parseProxyHeaderV1(line string) (*ProxyHeader, error) {
+	fields := strings.Split(strings.TrimPrefix(line, PROXY_V1_PREFIX), " ")
+	header := &ProxyHeader{Version: 1}
+	if fields[0] == PROXY_V1_UNKNOWN {
+		return header, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, ErrBadProxyHeader
+	}
+
+	src, dst := net.ParseIP(fields[1]), net.ParseIP(fields[2])
+	srcPort, srcErr := strconv.ParseUint(fields[3], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[4], 10, 16)
+	if nil == src || nil == dst || nil != srcErr || nil != dstErr {
+		return nil, ErrBadProxyHeader
+	}
+	if (fields[0] == "TCP4") != (nil != src.To4()) {
+		return nil, ErrBadProxyHeader
+	}
+	header.Source = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	header.Destination = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return header, nil
+}
+
+// ReadProxyHeader reads a v1 or v2 header from the start of a stream
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if nil != err {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV2Signature) {
+		fixed, err := r.Peek(PROXY_V2_HEADER_LEN)
+		if nil != err {
+			return nil, err
+		}
+		buf := make([]byte, PROXY_V2_HEADER_LEN+int(binary.BigEndian.Uint16(fixed[14:16])))
+		if _, err := io.ReadFull(r, buf); nil != err {
+			return nil, err
+		}
+		header, _, err := ParseProxyHeaderV2(buf)
+		return header, err
+	}
+
+	if !bytes.HasPrefix(sig, []byte(PROXY_V1_PREFIX)) {
+		return nil, ErrNoProxyHeader
+	}
+	var line []byte
+	for len(line) < PROXY_V1_MAX_LEN {
+		b, err := r.ReadByte()
+		if nil != err {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			return parseProxyHeaderV1(string(line[:len(line)-2]))
+		}
+	}
+	return nil, ErrBadProxyHeader
+}
+
+// ProxyProtocol decides which peers should prefix their traffic with a PROXY protocol header.
+// Methods treat a nil receiver as PROXY protocol being disabled.
+type ProxyProtocol struct {
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocol creates a policy trusting headers of peers in the trusted networks
+func NewProxyProtocol(trusted []string) (*ProxyProtocol, error) {
+	nets, err := parseNets(trusted)
+	if nil != err {
+		return nil, err
+	}
+	return &ProxyProtocol{trusted: nets}, nil
+}
+
+// Trusted reports whether addr should send a header
+func (self *ProxyProtocol) Trusted(addr net.Addr) bool {
+	if nil == self {
+		return false
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return containsIP(self.trusted, a.IP)
+	case *net.UDPAddr:
+		return containsIP(self.trusted, a.IP)
+	}
+	return false
+}
+
+// Datagram strips the v2 header of a datagram from a trusted peer, returning the payload and
+// the address of the original client
+func (self *ProxyProtocol) Datagram(buf []byte, addr net.Addr) ([]byte, net.Addr, error) {
+	if !self.Trusted(addr) {
+		return buf, addr, nil
+	}
+	header, n, err := ParseProxyHeaderV2(buf)
+	if nil != err {
+		return nil, nil, err
+	}
+	if nil == header.Source {
+		return buf[n:], addr, nil
+	}
+	return buf[n:], header.Source, nil
+}
+
+// Listener wraps l so that connections of trusted peers read their header before any data
+func (self *ProxyProtocol) Listener(l net.Listener) net.Listener {
+	if nil == self {
+		return l
+	}
+	return &proxyListener{Listener: l, proxy: self}
+}
+
+type proxyListener struct {
+	net.Listener
+	proxy *ProxyProtocol
+}
+
+func (self *proxyListener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if nil != err || !self.proxy.Trusted(conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the header on Handshake or first Read, and reports the client in the header
+// as RemoteAddr afterwards
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	err    error
+	mu     sync.Mutex
+	remote net.Addr
+}
+
+// Handshake reads the header, callers bound it with a read deadline
+func (self *proxyConn) Handshake() error {
+	self.once.Do(func() {
+		header, err := ReadProxyHeader(self.reader)
+		if nil != err {
+			self.err = fmt.Errorf("proxy protocol: %w", err)
+			return
+		}
+		if nil != header.Source {
+			self.mu.Lock()
+			self.remote = header.Source
+			self.mu.Unlock()
+		}
+	})
+	return self.err
+}
+
+func (self *proxyConn) Read(b []byte) (int, error) {
+	if err := self.Handshake(); nil != err {
+		return 0, err
+	}
+	return self.reader.Read(b)
+}
+
+func (self *proxyConn) RemoteAddr() net.Addr {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if nil != self.remote {
+		return self.remote
+	}
+	return self.Conn.RemoteAddr()
+}
@@ -0,0 +1,187 @@
+package stun
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a v2 PROXY header for src and dst over family
+func proxyV2Header(family byte, src *net.UDPAddr, dst *net.UDPAddr) []byte {
+	var body []byte
+	if src.IP.To4() != nil {
+		body = append(append(body, src.IP.To4()...), dst.IP.To4()...)
+	} else {
+		body = append(append(body, src.IP.To16()...), dst.IP.To16()...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(src.Port))
+	body = binary.BigEndian.AppendUint16(body, uint16(dst.Port))
+
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, PROXY_V2_VERSION|PROXY_V2_PROXY, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000}
+	dst := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 3478}
+	src6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::10"), Port: 40000}
+	dst6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3478}
+	local := append(append([]byte(nil), proxyV2Signature...), PROXY_V2_VERSION|PROXY_V2_LOCAL, 0, 0, 0)
+
+	testCases := map[string]struct {
+		input   []byte
+		source  string
+		version int
+		err     bool
+	}{
+		"v1 tcp4":          {input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 40000 3478\r\n"), source: "192.0.2.10:40000", version: 1},
+		"v1 tcp6":          {input: []byte("PROXY TCP6 2001:db8::10 2001:db8::1 40000 3478\r\n"), source: "[2001:db8::10]:40000", version: 1},
+		"v1 unknown":       {input: []byte("PROXY UNKNOWN\r\n"), version: 1},
+		"v1 family clash":  {input: []byte("PROXY TCP4 2001:db8::10 2001:db8::1 40000 3478\r\n"), err: true},
+		"v1 bad port":      {input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 70000 3478\r\n"), err: true},
+		"v1 unterminated":  {input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 40000 3478" + strings.Repeat(" ", PROXY_V1_MAX_LEN)), err: true},
+		"v2 tcp4":          {input: proxyV2Header(PROXY_V2_TCP4, src, dst), source: "192.0.2.10:40000", version: 2},
+		"v2 tcp6":          {input: proxyV2Header(PROXY_V2_TCP6, src6, dst6), source: "[2001:db8::10]:40000", version: 2},
+		"v2 local":         {input: local, version: 2},
+		"v2 truncated":     {input: proxyV2Header(PROXY_V2_TCP4, src, dst)[:20], err: true},
+		"stun without one": {input: rfc5769Request, err: true},
+	}
+
+	for name, test := range testCases {
+		// test := test // NOTE: uncomment for Go < 1.22, see /doc/faq#closures_and_goroutines
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			header, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(test.input)))
+			if test.err {
+				if nil == err {
+					t.Errorf("Expected error, got header %+v", header)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatal(err)
+			}
+			if header.Version != test.version {
+				t.Errorf("Version %d, expected %d", header.Version, test.version)
+			}
+			source := ""
+			if nil != header.Source {
+				source = header.Source.String()
+			}
+			if source != test.source {
+				t.Errorf("Source %q is not same as expected %q", source, test.source)
+			}
+		})
+	}
+}
+
+// proxiedBindingRequest sends header followed by a binding request over conn and returns the
+// reported reflexive address
+func proxiedBindingRequest(t *testing.T, conn net.Conn, header []byte, stream bool) string {
+	t.Helper()
+
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}
+	copy(req.ID[:], "proxytest123")
+	if _, err := conn.Write(append(append([]byte(nil), header...), req.Encode()...)); nil != err {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	var buf []byte
+	var err error
+	if stream {
+		buf, err = readStreamMessage(conn)
+	} else {
+		buf = make([]byte, UDP_BUFF_SIZE)
+		var n int
+		n, err = conn.Read(buf)
+		buf = buf[:n]
+	}
+	if nil != err {
+		t.Fatalf("No response: %s", err)
+	}
+	res, err := DecodeMessage(buf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	value, ok := res.Get(XOR_MAPPED_ADDRESS)
+	if !ok {
+		t.Fatalf("Response %s has no XOR-MAPPED-ADDRESS", res)
+	}
+	ip, port, err := ParseXorAddress(value, res.Cookie, res.ID)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return (&net.UDPAddr{IP: ip, Port: int(port)}).String()
+}
+
+func TestProxyProtocolServer(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir)
+	conf := testConfiguration()
+	conf.Tls = TlsConf{Enabled: true, CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	conf.Proxy = ProxyConf{Tcp: true, Udp: true, Trusted: []string{"127.0.0.0/8"}}
+	server := startTestServer(t, conf, nil)
+	addrs := server.Addrs()
+
+	client := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51000}
+	dst := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 3478}
+
+	testCases := map[string]struct {
+		network string
+		addr    string
+		header  []byte
+	}{
+		"tcp v1": {network: "tcp", addr: loopback(addrs.Tcp), header: []byte("PROXY TCP4 203.0.113.7 198.51.100.1 51000 3478\r\n")},
+		"tcp v2": {network: "tcp", addr: loopback(addrs.Tcp), header: proxyV2Header(PROXY_V2_TCP4, client, dst)},
+		"udp v2": {network: "udp", addr: loopback(addrs.Udp), header: proxyV2Header(PROXY_V2_UDP4, client, dst)},
+	}
+	for name, test := range testCases {
+		conn, err := net.Dial(test.network, test.addr)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if mapped := proxiedBindingRequest(t, conn, test.header, test.network == "tcp"); mapped != client.String() {
+			t.Errorf("%s: mapped address %s is not the proxied client %s", name, mapped, client)
+		}
+		conn.Close()
+	}
+
+	// header is sent in clear, before the tls handshake
+	conn, err := net.Dial("tcp", loopback(addrs.Tls))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(proxyV2Header(PROXY_V2_TCP4, client, dst)); nil != err {
+		t.Fatal(err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if mapped := proxiedBindingRequest(t, tlsConn, nil, true); mapped != client.String() {
+		t.Errorf("tls v2: mapped address %s is not the proxied client %s", mapped, client)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	conf := testConfiguration()
+	conf.Proxy = ProxyConf{Tcp: true, Udp: true, Trusted: []string{"10.0.0.0/8"}}
+	server := startTestServer(t, conf, nil)
+
+	// peers out of trusted networks are served by their own address
+	for _, network := range []string{TRANSPORT_UDP, TRANSPORT_TCP} {
+		addr := map[string]net.Addr{TRANSPORT_UDP: server.Addrs().Udp, TRANSPORT_TCP: server.Addrs().Tcp}[network]
+		mapped := bindingRequest(t, network, loopback(addr))
+		if !mapped.IP.IsLoopback() {
+			t.Errorf("%s: mapped address %s is not loopback", network, mapped.IP)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package stun
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// REST_SEPARATOR separates the expiry from the user id in a TURN REST API username
+const REST_SEPARATOR = ":"
+
+type RestConf struct {
+	// Secrets are shared with the services handing out credentials. Any of them is accepted, so
+	// that a new secret can be added before the services switch to it and the old one removed.
+	Secrets []string
+}
+
+func (self RestConf) String() string {
+	secrets := make([]string, len(self.Secrets))
+	for i := range secrets {
+		secrets[i] = REDACTED
+	}
+	return fmt.Sprintf("{Secrets: %v}", secrets)
+}
+
+func (self RestConf) Enabled() bool {
+	return len(self.Secrets) > 0
+}
+
+// parseRestUsername returns the expiry and user id of a TURN REST API username, expiry:userid
+// or only expiry
+func parseRestUsername(username string) (time.Time, string, error) {
+	expiry, userid, _ := strings.Cut(username, REST_SEPARATOR)
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if nil != err {
+		return time.Time{}, "", fmt.Errorf("username %q does not start with an expiry timestamp", username)
+	}
+	return time.Unix(seconds, 0), userid, nil
+}
+
+// RestCredentials is a CredentialStore of time-limited credentials of the TURN REST API, as
+// issued to WebRTC apps. The password of a username is base64(HMAC-SHA1(secret, username)),
+// which lets the services sharing the secret hand out credentials without a user database.
+type RestCredentials struct {
+	secrets [][]byte
+}
+
+func NewRestCredentials(conf RestConf) *RestCredentials {
+	secrets := make([][]byte, len(conf.Secrets))
+	for i, secret := range conf.Secrets {
+		secrets[i] = []byte(secret)
+	}
+	return &RestCredentials{secrets: secrets}
+}
+
+// RestPassword returns the password of username signed with secret
+func RestPassword(secret []byte, username string) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Passwords returns the password of username for each secret, none when username is not a
+// REST API username or is expired
+func (self *RestCredentials) Passwords(ctx context.Context, username string) ([]string, error) {
+	expiry, _, err := parseRestUsername(username)
+	if nil != err || time.Now().After(expiry) {
+		return nil, nil
+	}
+	passwords := make([]string, len(self.secrets))
+	for i, secret := range self.secrets {
+		passwords[i] = RestPassword(secret, username)
+	}
+	return passwords, nil
+}
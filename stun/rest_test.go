@@ -0,0 +1,62 @@
+package stun
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRestUsername(t *testing.T) {
+	tests := map[string]struct {
+		expiry int64
+		userid string
+		err    bool
+	}{
+		"4102444800:alice":      {expiry: 4102444800, userid: "alice"},
+		"4102444800":            {expiry: 4102444800},
+		"4102444800:alice:blue": {expiry: 4102444800, userid: "alice:blue"},
+		"alice:4102444800":      {err: true},
+		"":                      {err: true},
+	}
+	for username, test := range tests {
+		expiry, userid, err := parseRestUsername(username)
+		if test.err != (nil != err) {
+			t.Errorf("%q parsed with error %v", username, err)
+			continue
+		}
+		if !test.err && (expiry.Unix() != test.expiry || userid != test.userid) {
+			t.Errorf("%q parsed as %d %q, expected %d %q", username, expiry.Unix(), userid, test.expiry, test.userid)
+		}
+	}
+}
+
+func TestRestCredentials(t *testing.T) {
+	if password := RestPassword([]byte("north-secret"), "4102444800:alice"); password != "CbNOMynzXabYSeJ9OTBU5SJlKgs=" {
+		t.Errorf("password %s is not as coturn computes it", password)
+	}
+
+	store := NewRestCredentials(RestConf{Secrets: []string{"north-secret", "south-secret"}})
+	valid := fmt.Sprintf("%d:alice", time.Now().Add(time.Hour).Unix())
+	passwords, err := store.Passwords(context.Background(), valid)
+	if nil != err {
+		t.Fatal(err)
+	}
+	expected := []string{RestPassword([]byte("north-secret"), valid), RestPassword([]byte("south-secret"), valid)}
+	if !slices.Equal(passwords, expected) {
+		t.Errorf("passwords %v, expected one per secret %v", passwords, expected)
+	}
+
+	expired := fmt.Sprintf("%d:alice", time.Now().Add(-time.Second).Unix())
+	for _, username := range []string{expired, "alice"} {
+		if passwords, err := store.Passwords(context.Background(), username); nil != err || len(passwords) != 0 {
+			t.Errorf("%s got passwords %v with error %v", username, passwords, err)
+		}
+	}
+
+	if s := (RestConf{Secrets: []string{"north-secret"}}).String(); strings.Contains(s, "north-secret") {
+		t.Errorf("secret is not redacted in %s", s)
+	}
+}
@@ -0,0 +1,367 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	pion "github.com/pion/stun/v2"
+)
+
+// testConfiguration binds every listener to an ephemeral port
+func testConfiguration() *Configuration {
+	return &Configuration{
+		Udp:        ServerConf{Enabled: true, Port: 0},
+		Tcp:        ServerConf{Enabled: true, Port: 0},
+		Monitoring: MonitoringConf{Port: 0, Path: DEFAULT_MONITORING_PATH, ProbeInterval: DEFAULT_PROBE_INTERVAL},
+	}
+}
+
+// startTestServer starts a server with handler, nil for default, and shuts it down at the end of the test
+func startTestServer(t *testing.T, conf *Configuration, handler Handler) *Server {
+	t.Helper()
+
+	server := New(conf)
+	server.Handler = handler
+	if err := server.Start(); nil != err {
+		t.Fatalf("Could not start server: %s", err)
+	}
+	t.Cleanup(func() {
+		// a spare connection dialed by the client but never used would hold up shutdown of
+		// http servers for seconds
+		http.DefaultClient.CloseIdleConnections()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); nil != err {
+			t.Errorf("Could not shutdown server: %s", err)
+		}
+	})
+
+	select {
+	case <-server.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("Server did not become ready")
+	}
+
+	return server
+}
+
+// loopback returns the loopback address for the port of a bound listener
+func loopback(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return fmt.Sprintf("127.0.0.1:%d", a.Port)
+	case *net.TCPAddr:
+		return fmt.Sprintf("127.0.0.1:%d", a.Port)
+	}
+	return addr.String()
+}
+
+// bindingRequest does a binding request with pion client and returns the xor mapped address
+func bindingRequest(t *testing.T, network string, addr string) pion.XORMappedAddress {
+	t.Helper()
+
+	var conn net.Conn
+	var err error
+	if network == TRANSPORT_TLS {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = net.Dial(network, addr)
+	}
+	if nil != err {
+		t.Fatalf("failed to dial conn: %s", err)
+	}
+
+	var options []pion.ClientOption
+	if network != TRANSPORT_UDP {
+		options = append(options, pion.WithNoRetransmit)
+	}
+	client, err := pion.NewClient(conn, options...)
+	if nil != err {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	defer client.Close()
+
+	request := pion.MustBuild(pion.BindingRequest, pion.TransactionID, pion.Fingerprint)
+
+	var xorMappedAddr pion.XORMappedAddress
+	if err := client.Do(request, func(event pion.Event) {
+		if nil != event.Error {
+			t.Errorf("Got event with error: %s", event.Error)
+			return
+		}
+		if event.Message.Type != pion.BindingSuccess {
+			t.Errorf("Unexpected response %s", event.Message)
+			return
+		}
+		if err := xorMappedAddr.GetFrom(event.Message); nil != err {
+			t.Errorf("Failed to parse xor mapped address: %s", err)
+		}
+	}); nil != err {
+		t.Fatalf("Error in stun request %s", err)
+	}
+
+	return xorMappedAddr
+}
+
+func TestServer(t *testing.T) {
+	server := startTestServer(t, testConfiguration(), nil)
+	addrs := server.Addrs()
+
+	testCases := map[string]struct {
+		network string
+		addr    net.Addr
+	}{
+		"udp server": {network: "udp", addr: addrs.Udp},
+		"tcp server": {network: "tcp", addr: addrs.Tcp},
+	}
+
+	for name, test := range testCases {
+		// test := test // NOTE: uncomment for Go < 1.22, see /doc/faq#closures_and_goroutines
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			xorMappedAddr := bindingRequest(t, test.network, loopback(test.addr))
+			if !xorMappedAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+				t.Errorf("expected ip = 127.0.0.1 != %s = mapped ip", xorMappedAddr.IP)
+			}
+		})
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", loopback(addrs.Monitoring), DEFAULT_MONITORING_PATH))
+	if nil != err {
+		t.Fatalf("Could not scrape metrics: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected monitoring status %d", resp.StatusCode)
+	}
+}
+
+func TestServerBindError(t *testing.T) {
+	occupied, err := net.Listen("tcp", ":0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	conf := testConfiguration()
+	conf.Tcp.Port = occupied.Addr().(*net.TCPAddr).Port
+
+	server := New(conf)
+	if err := server.Start(); nil == err {
+		t.Error("Expected bind error for occupied tcp port")
+	}
+
+	select {
+	case <-server.Ready():
+		t.Error("Server should not be ready after a bind error")
+	default:
+	}
+}
+
+func TestServerDisabledListener(t *testing.T) {
+	conf := testConfiguration()
+	conf.Tcp.Enabled = false
+
+	addrs := startTestServer(t, conf, nil).Addrs()
+	if nil != addrs.Tcp {
+		t.Errorf("Disabled tcp listener should not be bound, got %s", addrs.Tcp)
+	}
+	if nil == addrs.Udp {
+		t.Error("Enabled udp listener should be bound")
+	}
+}
+
+// flakyListener fails the first accepts by running out of file descriptors
+type flakyListener struct {
+	net.Listener
+	mu       sync.Mutex
+	failures int
+}
+
+func (self *flakyListener) Accept() (net.Conn, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.failures > 0 {
+		self.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return self.Listener.Accept()
+}
+
+func TestTcpAcceptRetry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sup := NewSupervisor(ctx)
+	TcpStart(sup, &flakyListener{Listener: l, failures: 3}, TRANSPORT_TCP, BindingHandler(), NewMetrics(), NewConnections())
+	defer func() {
+		cancel()
+		sup.Wait()
+	}()
+
+	xorMappedAddr := bindingRequest(t, "tcp", l.Addr().String())
+	if !xorMappedAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected ip = 127.0.0.1 != %s = mapped ip", xorMappedAddr.IP)
+	}
+	if err := sup.Err(); nil != err {
+		t.Errorf("Temporary accept errors stopped the server: %s", err)
+	}
+}
+
+// burstListener accepts pipe connections without pause once released, like a burst of clients
+// arriving while the server stops
+type burstListener struct {
+	release chan struct{}
+	mu      sync.Mutex
+	clients []net.Conn
+}
+
+func (self *burstListener) Accept() (net.Conn, error) {
+	<-self.release
+	server, client := net.Pipe()
+	self.mu.Lock()
+	self.clients = append(self.clients, client)
+	self.mu.Unlock()
+	return server, nil
+}
+
+func (self *burstListener) Close() error   { return nil }
+func (self *burstListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func TestTcpStopClosesAcceptedConnections(t *testing.T) {
+	l := &burstListener{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	sup := NewSupervisor(ctx)
+	TcpStart(sup, l, TRANSPORT_TCP, BindingHandler(), NewMetrics(), NewConnections())
+
+	cancel()
+	close(l.release)
+	stopped := make(chan error, 1)
+	go func() { stopped <- sup.Wait() }()
+	select {
+	case err := <-stopped:
+		if nil != err {
+			t.Errorf("Server failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not stop")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, client := range l.clients {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+			t.Fatalf("Connection %d of %d is not closed: %v", i, len(l.clients), err)
+		}
+	}
+}
+
+// blockingCredentials answers lookups once released, like a credential service timing out
+type blockingCredentials struct {
+	release chan struct{}
+}
+
+func (self *blockingCredentials) Passwords(ctx context.Context, username string) ([]string, error) {
+	<-self.release
+	return nil, nil
+}
+
+func TestUdpSlowRequest(t *testing.T) {
+	store := &blockingCredentials{release: make(chan struct{})}
+	auth, err := NewAuthenticator(AuthConf{Enabled: true, Realm: "lstun", NonceLifetime: time.Minute}, store)
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sup := NewSupervisor(ctx)
+	UdpStart(sup, conn, Chain(BindingHandler(), auth.Middleware()), NewMetrics(), nil, nil, nil)
+	defer func() {
+		close(store.release)
+		cancel()
+		sup.Wait()
+	}()
+	addr := conn.LocalAddr().String()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the lookup of a signed request blocks, while other requests are still answered
+	signed := authRequest(t, "alice", nil, "lstun", auth.nonces.issue(time.Now()), LongTermKey("alice", "lstun", "guess"))
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo(signed.Encode(), to); nil != err {
+		t.Fatal(err)
+	}
+	res, _ := sendRequest(t, client, addr, &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{4, 5, 6}})
+	value, _ := res.Get(ERROR_CODE)
+	if code, _, _ := ParseErrorCode(value); res.ID != [ID_LEN]byte{4, 5, 6} || code != CODE_UNAUTHORIZED {
+		t.Errorf("Unsigned request is answered with %s while a lookup is pending, expected a challenge", res)
+	}
+}
+
+func TestUdpStopAnswersQueuedDatagrams(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := Chain(BindingHandler(), func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			close(started)
+			<-release
+			next.ServeSTUN(w, r)
+		})
+	})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sup := NewSupervisor(ctx)
+	UdpStart(sup, conn, handler, NewMetrics(), nil, nil, nil)
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	req := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE, ID: [ID_LEN]byte{7, 8, 9}}
+	if _, err := client.WriteTo(req.Encode(), conn.LocalAddr()); nil != err {
+		t.Fatal(err)
+	}
+
+	// the request in flight is answered although the listener is stopping
+	<-started
+	cancel()
+	// give the read loop time to stop before the response is written
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, UDP_BUFF_SIZE)
+	if _, _, err := client.ReadFrom(buf); nil != err {
+		t.Errorf("Request in flight at stop is not answered: %s", err)
+	}
+	if err := sup.Wait(); nil != err {
+		t.Errorf("Stopping failed: %s", err)
+	}
+}
@@ -1,23 +1,26 @@
 package stun
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"os"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const (
 	MIN_STUN_LEN             = 20
 	ID_LEN                   = 12
-	MESAGE_COOKIE            = 554828866 // 0x2112a442
+	MESAGE_COOKIE            = 554869826 // 0x2112a442
 	BINDING_REQUEST          = 1         // 0x0001
 	BINDING_SUCCESS_RESPONSE = 257       // 0x0101
 	MAPPED_ADDRESS           = 1         // 0x0001
@@ -27,19 +30,17 @@ const (
 
 const (
 	NEW_CONN_BUFF_SIZE = 1000
+	// UDP_WORKERS serve datagrams off the udp read loop, so slow requests, e.g. waiting for a
+	// credential lookup, do not hold up reading. Up to UDP_QUEUE_SIZE datagrams wait for a
+	// worker, further ones are dropped.
+	UDP_WORKERS    = 64
+	UDP_QUEUE_SIZE = 1024
+	// accepting after a temporary error, like running out of file descriptors, is retried
+	// with a delay doubled from MIN_ACCEPT_DELAY up to MAX_ACCEPT_DELAY
+	MIN_ACCEPT_DELAY = 5 * time.Millisecond
+	MAX_ACCEPT_DELAY = time.Second
 )
 
-type BindRequest struct {
-	Type   uint16
-	Len    uint16
-	Cookie uint32
-	ID     [ID_LEN]byte
-}
-
-func (self BindRequest) String() string {
-	return fmt.Sprintf("{type: %#04x, length: %d, Cookie: %#04x, ID: %s}", self.Type, self.Len, self.Cookie, hex.EncodeToString(self.ID[:]))
-}
-
 type Attribute struct {
 	Type uint16
 	Len  uint16
@@ -97,205 +98,355 @@ func NewXorMappedAddress(port uint16, ip net.IP, cookie uint32) (XorMappedAddres
 	return XorMappedAddress{}, errors.New("Not an Ipv4 address")
 }
 
-type SuccessBindingResponse struct {
-	BindRequest
-	MappedAddress
-	XorMappedAddress
+const (
+	READ_TIMEOUT  = 1 * time.Second
+	UDP_BUFF_SIZE = 10000
+)
+
+// encodeResponse serializes res, adding FINGERPRINT when the request carried one
+func encodeResponse(res *Message, fingerprint bool) []byte {
+	if _, ok := res.Get(FINGERPRINT); fingerprint && !ok {
+		res.AddFingerprint()
+	}
+	return res.Encode()
 }
 
-func TcpStart(ctx context.Context, conf ServerConf, wg *sync.WaitGroup) {
-	(*wg).Add(1)
-	go func() {
-		defer (*wg).Done()
+// packetResponseWriter answers over a datagram socket
+type packetResponseWriter struct {
+	conn        net.PacketConn
+	addr        net.Addr
+	fingerprint bool
+	metrics     *Metrics
+	// delay holds the response back, nil sends it at once
+	delay *responseDelay
+}
 
-		tcpWg := &sync.WaitGroup{}
-		newConns := make(chan net.Conn, NEW_CONN_BUFF_SIZE)
+func (self *packetResponseWriter) Write(res *Message) error {
+	if err := self.delay.wait(); nil != err {
+		return err
+	}
+	buf := encodeResponse(res, self.fingerprint)
+
+	// Write back the message over UPD
+	n, err := self.conn.WriteTo(buf, self.addr)
+	self.metrics.sent(TRANSPORT_UDP, self.addr, n)
+	self.delay.sent()
+	return err
+}
+
+// streamResponseWriter answers over a tcp or tls connection
+type streamResponseWriter struct {
+	conn        net.Conn
+	transport   string
+	fingerprint bool
+	metrics     *Metrics
+}
+
+func (self *streamResponseWriter) Write(res *Message) error {
+	buf := encodeResponse(res, self.fingerprint)
+
+	// Write back the message over TCP
+	n, err := self.conn.Write(buf)
+	self.metrics.sent(self.transport, self.conn.RemoteAddr(), n)
+	return err
+}
+
+// readStreamMessage reads one stun message from a stream, framing it by the header length
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, MIN_STUN_LEN)
+	if _, err := io.ReadFull(r, header); nil != err {
+		return nil, err
+	}
+	if header[0]&0xc0 != 0 {
+		return nil, ErrNotStun
+	}
+
+	buf := make([]byte, MIN_STUN_LEN+int(binary.BigEndian.Uint16(header[2:4])))
+	copy(buf, header)
+	if _, err := io.ReadFull(r, buf[MIN_STUN_LEN:]); nil != err {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// serveStream dispatches stun messages read from a tcp or tls connection till it is idle or broken
+func serveStream(ctx context.Context, conn net.Conn, transport string, handler Handler, metrics *Metrics) {
+	defer conn.Close()
+
+	// a tls connection reads the proxy protocol header of the underlying connection on handshake
+	if proxy, ok := conn.(*proxyConn); ok {
+		if err := proxy.SetDeadline(time.Now().Add(READ_TIMEOUT)); nil != err {
+			slog.Debug("Setting deadline failed", "transport", transport, "remote_addr", conn.RemoteAddr(), "error", err)
+			return
+		}
+		if err := proxy.Handshake(); nil != err {
+			slog.Debug("Proxy protocol header read failed", "transport", transport, "remote_addr", conn.RemoteAddr(), "error", err)
+			return
+		}
+	}
+
+	var state *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.SetDeadline(time.Now().Add(READ_TIMEOUT)); nil != err {
+			slog.Debug("Setting deadline failed", "transport", transport, "remote_addr", conn.RemoteAddr(), "error", err)
+			return
+		}
+		err := tlsConn.Handshake()
+		connState := tlsConn.ConnectionState()
+		metrics.tlsHandshake(connState.NegotiatedProtocol, err)
+		if nil != err {
+			slog.Debug("Tls handshake failed", "remote_addr", conn.RemoteAddr(), "alpn", connState.NegotiatedProtocol, "error", err)
+			return
+		}
+		state = &connState
+	}
+
+	reader := bufio.NewReader(conn)
+	// once stopping, the connection is closed after the message in flight
+	for nil == ctx.Err() {
+		err := conn.SetDeadline(time.Now().Add(READ_TIMEOUT))
+		if nil != err {
+			slog.Debug("Setting deadline failed", "transport", transport, "remote_addr", conn.RemoteAddr(), "error", err)
+			return
+		}
 
-		log.Printf("Starting Stun server, listening port at %d/tcp", conf.Port)
-		listenTcpUrl := fmt.Sprintf(":%d", conf.Port)
-		tcpServer, err := net.Listen("tcp", listenTcpUrl)
+		buf, err := readStreamMessage(reader)
+		if errors.Is(err, ErrNotStun) {
+			metrics.malformedPacket(transport, conn.RemoteAddr())
+		}
 		if err != nil {
-			log.Fatal(err)
+			if !os.IsTimeout(err) && !errors.Is(err, io.EOF) {
+				slog.Debug("Stream read failed", "transport", transport, "remote_addr", conn.RemoteAddr(), "error", err)
+			}
+			return
+		}
+
+		metrics.received(transport, conn.RemoteAddr(), len(buf))
+
+		msg, err := DecodeMessage(buf)
+		if nil != err {
+			metrics.malformedPacket(transport, conn.RemoteAddr())
+			slog.Debug("Malformed message", "transport", transport, "remote_addr", conn.RemoteAddr(), "error", err)
+			continue
 		}
 
+		_, fingerprint := msg.Get(FINGERPRINT)
+		handler.ServeSTUN(&streamResponseWriter{conn: conn, transport: transport, fingerprint: fingerprint, metrics: metrics}, &Request{
+			Message:    msg,
+			Transport:  transport,
+			LocalAddr:  conn.LocalAddr(),
+			RemoteAddr: conn.RemoteAddr(),
+			TLS:        state,
+		})
+	}
+}
+
+// TcpStart serves stun requests on an already bound tcp or tls listener under sup. It stops when
+// the supervisor context is cancelled, or fails if the listener stops accepting.
+func TcpStart(sup *Supervisor, tcpServer net.Listener, transport string, handler Handler, metrics *Metrics, conns *Connections) {
+	sup.Go(transport, func(ctx context.Context) error {
+		tcpWg := &sync.WaitGroup{}
+		newConns := make(chan net.Conn, NEW_CONN_BUFF_SIZE)
+		acceptErr := make(chan error, 1)
+		accepting := make(chan struct{})
+
+		slog.Info("Starting Stun server", "transport", transport, "port", tcpServer.Addr().(*net.TCPAddr).Port)
 		defer tcpServer.Close()
 
 		// Make listen connections
-		tcpWg.Add(1)
-		go func(l net.Listener, newConns chan net.Conn, wg *sync.WaitGroup) {
-			defer (*wg).Done()
+		go func(l net.Listener, newConns chan net.Conn) {
+			defer close(accepting)
+			var delay time.Duration
 			for {
 				c, err := l.Accept()
-				log.Printf("... new connection")
 				if err != nil {
-					log.Printf("Tcp listen error: %s", err)
-					// handle error (and then for example indicate acceptor is down)
-					newConns <- nil
+					if retryAccept(err) && nil == ctx.Err() {
+						delay = min(max(2*delay, MIN_ACCEPT_DELAY), MAX_ACCEPT_DELAY)
+						slog.Warn("Accept failed, retrying", "transport", transport, "error", err, "delay", delay)
+						select {
+						case <-time.After(delay):
+							continue
+						case <-ctx.Done():
+						}
+					}
+					acceptErr <- err
 					return
 				}
+				delay = 0
 
-				newConns <- c
+				select {
+				case newConns <- c:
+				case <-ctx.Done():
+					c.Close()
+					return
+				}
 			}
-		}(tcpServer, newConns, tcpWg)
+		}(tcpServer, newConns)
 
+		var err error
 	loop:
 		for {
 			select {
 			case <-ctx.Done():
-				log.Println("Stopping tcp server ...")
+				slog.Info("Stopping server", "transport", transport)
 				tcpServer.Close()
 				break loop
-			case conn := <-newConns:
-				if nil == conn {
-					log.Println("tcp listener stopped ...")
-					close(newConns)
-					break loop
+			case err = <-acceptErr:
+				if nil != ctx.Err() {
+					err = nil
 				}
-
+				break loop
+			case conn := <-newConns:
 				tcpWg.Add(1)
+				conns.add(conn, transport)
 				go func(tcpConn net.Conn, wg *sync.WaitGroup) {
 					defer (*wg).Done()
-
-					buf := make([]byte, 10000)
-					err := tcpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
-					if nil != err {
-						log.Fatal(err)
-					}
-
-					rlen, err := tcpConn.Read(buf)
-
-					if err != nil {
-						if !os.IsTimeout(err) {
-							log.Println("error: ", err, " read length: ", rlen)
-						}
-						return
-					}
-
-					addrInTcp := tcpConn.RemoteAddr().(*net.TCPAddr)
-					// ipAddr := addrInTcp.AddrPort().Addr()
-					port := addrInTcp.Port
-
-					if rlen < MIN_STUN_LEN {
-						return
-					}
-
-					var req BindRequest
-					readBuf := bytes.NewReader(buf)
-					//
-					err = binary.Read(readBuf, binary.BigEndian, &req)
-					if nil != err {
-						log.Println(err)
-					}
-
-					var res SuccessBindingResponse
-					res.BindRequest = req
-					res.BindRequest.Type = BINDING_SUCCESS_RESPONSE
-					res.BindRequest.Len = 12 + 12
-					res.MappedAddress, _ = NewMappedAddress(uint16(port), addrInTcp.IP)
-					res.XorMappedAddress, _ = NewXorMappedAddress(uint16(port), addrInTcp.IP, req.Cookie)
-					fmt.Println(res.BindRequest)
-
-					writeBuf := new(bytes.Buffer)
-					err = binary.Write(writeBuf, binary.BigEndian, res)
-					if nil != err {
-						log.Println(err)
-					}
-
-					// Write back the message over TCP
-					wLen, err := tcpConn.Write(writeBuf.Bytes())
-
-					if nil != err {
-						log.Println(err)
-					}
-
-					fmt.Printf("% x is writen %d is send\n", writeBuf.Bytes(), wLen)
-
-					// Shut down the connection.
-					tcpConn.Close()
-
+					defer conns.remove(tcpConn)
+					serveStream(ctx, tcpConn, transport, handler, metrics)
 				}(conn, tcpWg)
 			}
 		}
 
-		log.Printf("Waiting tcp connections to drain")
-		tcpWg.Wait()
+		// connections accepted but not served yet are closed
+		tcpServer.Close()
+		<-accepting
 		close(newConns)
-		log.Printf("Tcp connections... drained")
-	}()
-}
+		for conn := range newConns {
+			conn.Close()
+		}
 
-func UdpStart(ctx context.Context, conf ServerConf, wg *sync.WaitGroup) {
-	(*wg).Add(1)
-	go func() {
-		defer (*wg).Done()
+		slog.Info("Waiting connections to drain", "transport", transport)
+		tcpWg.Wait()
+		slog.Info("Connections drained", "transport", transport)
 
-		log.Printf("Starting Stun server, listening port at %d/udp", conf.Port)
-		listenUrl := fmt.Sprintf(":%d", conf.Port)
-		udpServer, err := net.ListenPacket("udp", listenUrl)
-		if err != nil {
-			log.Fatal(err)
+		if nil != err {
+			return fmt.Errorf("accept failed: %w", err)
 		}
+		return nil
+	})
+}
 
+// retryAccept reports whether accepting may succeed again after err, e.g. once file
+// descriptors are released
+func retryAccept(err error) bool {
+	var ne net.Error
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// UdpStart serves stun requests on an already bound udp socket under sup, and requests forwarded
+// by cluster peers when cluster is not nil. It stops when the supervisor context is cancelled, or
+// fails if the socket can not be read anymore.
+func UdpStart(sup *Supervisor, udpServer net.PacketConn, handler Handler, metrics *Metrics, proxy *ProxyProtocol, cluster *Cluster, demux *Demux) {
+	sup.Go(TRANSPORT_UDP, func(ctx context.Context) error {
+		slog.Info("Starting Stun server", "transport", TRANSPORT_UDP, "port", udpServer.LocalAddr().(*net.UDPAddr).Port)
 		defer udpServer.Close()
 
-		for {
-			select {
-			case <-ctx.Done():
-				log.Println("Stopping udp server ...")
-				return
-			default:
-				buf := make([]byte, 10000)
-				err := udpServer.SetReadDeadline(time.Now().Add(1 * time.Second))
-				if nil != err {
-					log.Fatal(err)
+		// an expired deadline unblocks a pending read, so stopping does not wait for the timeout.
+		// The socket is closed only once workers answered the datagrams queued till then.
+		stop := context.AfterFunc(ctx, func() { udpServer.SetReadDeadline(time.Now()) })
+		defer stop()
+
+		queue := make(chan datagram, UDP_QUEUE_SIZE)
+		workers := &sync.WaitGroup{}
+		for i := 0; i < UDP_WORKERS; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for d := range queue {
+					serveDatagram(udpServer, d.buf, d.addr, handler, metrics, proxy, cluster, demux)
 				}
-				rlen, rAddr, err := udpServer.ReadFrom(buf)
+			}()
+		}
+		defer workers.Wait()
+		defer close(queue)
 
-				if err != nil {
-					if !os.IsTimeout(err) {
-						log.Println("error: ", err, " read length: ", rlen)
-					}
+		buf := make([]byte, UDP_BUFF_SIZE)
+		for {
+			if nil != ctx.Err() {
+				slog.Info("Stopping server", "transport", TRANSPORT_UDP)
+				return nil
+			}
+
+			err := udpServer.SetReadDeadline(time.Now().Add(READ_TIMEOUT))
+			if nil != err {
+				if nil != ctx.Err() {
 					continue
 				}
+				return fmt.Errorf("setting read deadline failed: %w", err)
+			}
+			// stopping may have expired the deadline before it was extended above
+			if nil != ctx.Err() {
+				continue
+			}
+			rlen, rAddr, err := udpServer.ReadFrom(buf)
 
-				addrInUdp := rAddr.(*net.UDPAddr)
-				port := addrInUdp.Port
-
-				if rlen < MIN_STUN_LEN {
+			if err != nil {
+				if nil != ctx.Err() || os.IsTimeout(err) {
 					continue
 				}
-
-				var req BindRequest
-				readBuf := bytes.NewReader(buf)
-				//
-				err = binary.Read(readBuf, binary.BigEndian, &req)
-				if nil != err {
-					log.Println(err)
+				if errors.Is(err, net.ErrClosed) {
+					return fmt.Errorf("read failed: %w", err)
 				}
+				slog.Warn("Udp read failed", "error", err)
+				continue
+			}
 
-				var res SuccessBindingResponse
-				res.BindRequest = req
-				res.BindRequest.Type = BINDING_SUCCESS_RESPONSE
-				res.BindRequest.Len = 12 + 12
-				res.MappedAddress, _ = NewMappedAddress(uint16(port), addrInUdp.IP)
-				res.XorMappedAddress, _ = NewXorMappedAddress(uint16(port), addrInUdp.IP, req.Cookie)
-				fmt.Println(res.BindRequest)
-
-				writeBuf := new(bytes.Buffer)
-				err = binary.Write(writeBuf, binary.BigEndian, res)
-				if nil != err {
-					log.Println(err)
-				}
+			select {
+			case queue <- datagram{buf: bytes.Clone(buf[:rlen]), addr: rAddr}:
+			default:
+				metrics.droppedPacket(TRANSPORT_UDP, rAddr)
+				slog.Debug("Udp workers are busy, datagram dropped", "remote_addr", rAddr)
+			}
+		}
+	})
+}
 
-				// Write back the message over UPD
-				wLen, err := udpServer.WriteTo(writeBuf.Bytes(), rAddr)
+// datagram is read from the udp listener, waiting for a worker to serve it
+type datagram struct {
+	buf  []byte
+	addr net.Addr
+}
 
-				if nil != err {
-					log.Println(err)
-				}
+// serveDatagram dispatches a datagram read from the udp listener
+func serveDatagram(conn net.PacketConn, buf []byte, rAddr net.Addr, handler Handler, metrics *Metrics, proxy *ProxyProtocol, cluster *Cluster, demux *Demux) {
+	// peers send their frames directly, never through a balancer
+	if cluster.isFrame(buf) {
+		metrics.received(TRANSPORT_UDP, rAddr, len(buf))
+		cluster.serve(handler, metrics, buf, rAddr)
+		return
+	}
 
-				fmt.Printf("% x is writen %d is send\n", writeBuf.Bytes(), wLen)
-			}
-		}
-	}()
+	// datagrams of trusted balancers carry the client address in a proxy protocol header
+	payload, client, err := proxy.Datagram(buf, rAddr)
+	if nil != err {
+		metrics.malformedPacket(TRANSPORT_UDP, rAddr)
+		slog.Debug("Proxy protocol header read failed", "transport", TRANSPORT_UDP, "remote_addr", rAddr, "error", err)
+		return
+	}
+
+	metrics.received(TRANSPORT_UDP, client, len(buf))
+
+	// other protocols sharing the port are told apart by their first byte, RFC 7983
+	if Classify(payload) != PROTOCOL_STUN && demux.serve(conn, payload, rAddr, metrics) {
+		return
+	}
+
+	msg, err := DecodeMessage(payload)
+	if nil != err {
+		metrics.malformedPacket(TRANSPORT_UDP, client)
+		// not a stun message, drop it
+		slog.Debug("Malformed message", "transport", TRANSPORT_UDP, "remote_addr", client, "error", err)
+		return
+	}
+
+	// responses go back to the sender, which is the balancer for proxied datagrams
+	_, fingerprint := msg.Get(FINGERPRINT)
+	delay := &responseDelay{}
+	request := &Request{
+		Message:    msg,
+		Transport:  TRANSPORT_UDP,
+		LocalAddr:  conn.LocalAddr(),
+		RemoteAddr: client,
+	}
+	handler.ServeSTUN(&packetResponseWriter{conn: conn, addr: rAddr, fingerprint: fingerprint, metrics: metrics, delay: delay}, request.WithContext(withResponseDelay(request.Context(), delay)))
 }
@@ -2,12 +2,462 @@ package stun
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
 	"sync"
+	"time"
 )
 
-func Start(conf *Configuration, ctx context.Context, wg *sync.WaitGroup) {
+// Addrs holds the addresses listeners are actually bound to, nil for disabled listeners
+type Addrs struct {
+	Udp        net.Addr
+	Tcp        net.Addr
+	Tls        net.Addr
+	Monitoring net.Addr
+	Admin      net.Addr
+}
+
+func (self Addrs) String() string {
+	return fmt.Sprintf("{Udp: %v, Tcp: %v, Tls: %v, Monitoring: %v, Admin: %v}", self.Udp, self.Tcp, self.Tls, self.Monitoring, self.Admin)
+}
+
+// Server is an embeddable stun server. Create with New, then Start and Shutdown once.
+type Server struct {
+	// Handler answers requests of all listeners, DefaultHandler is used when nil.
+	// It should be set before Start.
+	Handler Handler
+	// Sockets are pre-opened sockets by listener name, one of udp, tcp, tls, monitoring and
+	// admin, used instead of binding the configured ports, see ListenFds. They should be set
+	// before Start, which takes their ownership.
+	Sockets map[string]*os.File
+	// Demux passes datagrams of other protocols sharing the udp listener to their handlers, RFC
+	// 7983. Forwarders to the upstreams of the mux configuration are added to it, or to a new one
+	// when nil. It should be set before Start.
+	Demux *Demux
+
+	conf       Configuration
+	health     *Health
+	conns      *Connections
+	acl        *ACL
+	keepalives *Keepalives
+
+	mu      sync.Mutex
+	started bool
+	addrs   Addrs
+	metrics *Metrics
+	ready   chan struct{}
+	done    chan struct{}
+	cancel  context.CancelFunc
+	sup     *Supervisor
+	sockets map[string]*os.File
+	bound   map[string]any
+}
+
+// New creates a server for the given configuration. Configuration is not validated, so
+// port 0 can be used to bind ephemeral ports, see Addrs. Invalid acl entries are reported
+// by Start.
+func New(conf *Configuration) *Server {
+	return &Server{
+		conf:   *conf,
+		health: NewHealth(),
+		conns:  NewConnections(),
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start binds all enabled listeners and starts serving. It returns once every listener is
+// bound, or with the first bind error in which case nothing is left running.
+func (self *Server) Start() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.started {
+		return errors.New("server already started")
+	}
+
 	InitInfo()
-	MonitoringStart(ctx, conf.Monitoring, wg)
-	UdpStart(ctx, conf.Udp, wg)
-	TcpStart(ctx, conf.Tcp, wg)
+
+	// sockets not turned into listeners yet are closed on failure, as Start owns them
+	self.sockets = maps.Clone(self.Sockets)
+	self.bound = map[string]any{}
+	var udpConn net.PacketConn
+	var listeners []net.Listener
+	var auth *Authenticator
+	closeAll := func() {
+		if nil != udpConn {
+			udpConn.Close()
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, file := range self.sockets {
+			file.Close()
+		}
+		if nil != auth {
+			auth.Close()
+		}
+	}
+
+	acl, err := NewACL(self.conf.Acl)
+	if nil != err {
+		closeAll()
+		return fmt.Errorf("acl is invalid: %w", err)
+	}
+	self.acl = acl
+
+	keepalives, err := NewKeepalives(self.conf.Keepalive)
+	if nil != err {
+		closeAll()
+		return fmt.Errorf("lifetime experiment networks are invalid: %w", err)
+	}
+	self.keepalives = keepalives
+
+	var tcpProxy, udpProxy *ProxyProtocol
+	if self.conf.Proxy.Tcp || self.conf.Proxy.Udp {
+		proxy, err := NewProxyProtocol(self.conf.Proxy.Trusted)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("proxy protocol trusted sources are invalid: %w", err)
+		}
+		if self.conf.Proxy.Tcp {
+			tcpProxy = proxy
+		}
+		if self.conf.Proxy.Udp {
+			udpProxy = proxy
+		}
+	}
+
+	if self.conf.Udp.Enabled {
+		conn, err := bind(self.conf.Bind, TRANSPORT_UDP, func() (net.PacketConn, error) {
+			if file, ok := self.sockets[TRANSPORT_UDP]; ok {
+				delete(self.sockets, TRANSPORT_UDP)
+				return inheritedPacketConn(file)
+			}
+			return net.ListenPacket("udp", fmt.Sprintf(":%d", self.conf.Udp.Port))
+		})
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("udp listener bind failed: %w", err)
+		}
+		udpConn = conn
+		self.addrs.Udp = conn.LocalAddr()
+		self.bound[TRANSPORT_UDP] = conn
+	}
+
+	var tcpListener net.Listener
+	if self.conf.Tcp.Enabled {
+		l, err := self.listen(TRANSPORT_TCP, self.conf.Tcp.Port)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("tcp listener bind failed: %w", err)
+		}
+		tcpListener = tcpProxy.Listener(l)
+		listeners = append(listeners, l)
+		self.addrs.Tcp = l.Addr()
+		self.bound[TRANSPORT_TCP] = l
+	}
+
+	var tlsListener net.Listener
+	if self.conf.Tls.Enabled {
+		cert, err := tls.LoadX509KeyPair(self.conf.Tls.CertFile, self.conf.Tls.KeyFile)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("tls certificate load failed: %w", err)
+		}
+		l, err := self.listen(TRANSPORT_TLS, self.conf.Tls.Port)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("tls listener bind failed: %w", err)
+		}
+		// proxy protocol header precedes the tls handshake
+		tlsListener = tls.NewListener(tcpProxy.Listener(l), tlsConfig(self.conf.Tls, cert))
+		listeners = append(listeners, l)
+		self.addrs.Tls = l.Addr()
+		self.bound[TRANSPORT_TLS] = l
+	}
+
+	monitoringListener, err := self.listen(LISTENER_MONITORING, self.conf.Monitoring.Port)
+	if nil != err {
+		closeAll()
+		return fmt.Errorf("monitoring listener bind failed: %w", err)
+	}
+	listeners = append(listeners, monitoringListener)
+	self.addrs.Monitoring = monitoringListener.Addr()
+	self.bound[LISTENER_MONITORING] = monitoringListener
+
+	var adminListener net.Listener
+	if self.conf.Admin.Enabled {
+		l, err := self.listen(LISTENER_ADMIN, self.conf.Admin.Port)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("admin listener bind failed: %w", err)
+		}
+		adminListener = l
+		listeners = append(listeners, l)
+		self.addrs.Admin = l.Addr()
+		self.bound[LISTENER_ADMIN] = l
+	}
+
+	for name, file := range self.sockets {
+		slog.Warn("Inherited socket matches no enabled listener, closing it", "name", name)
+		file.Close()
+	}
+	self.sockets = nil
+
+	handler := self.Handler
+	if nil == handler {
+		handler = DefaultHandler
+	}
+	metrics := NewMetrics()
+	self.metrics = metrics
+	middlewares := []Middleware{RequestLogger(slog.Default()), metrics.Middleware(), self.acl.Middleware()}
+	if self.conf.Auth.Enabled {
+		auth, err = NewAuthenticator(self.conf.Auth)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("auth setup failed: %w", err)
+		}
+		middlewares = append(middlewares, auth.Middleware())
+	}
+	if self.conf.Alternate.Enabled() {
+		redirector, err := NewRedirector(self.conf.Alternate, self.health.Draining)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("alternate server configuration is invalid: %w", err)
+		}
+		middlewares = append(middlewares, redirector.Middleware())
+	}
+	var cluster *Cluster
+	if self.conf.Cluster.Enabled {
+		if nil == udpConn {
+			closeAll()
+			return errors.New("cluster needs the udp listener")
+		}
+		cluster, err = NewCluster(self.conf.Cluster, udpConn)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("cluster configuration is invalid: %w", err)
+		}
+		middlewares = append(middlewares, cluster.Middleware())
+	}
+	// innermost, so the responses delayed are the final ones
+	middlewares = append(middlewares, keepalives.Middleware())
+	handler = Chain(handler, middlewares...)
+
+	demux := self.Demux
+	var forwarders []*Forwarder
+	for protocol, upstream := range self.conf.Mux.Upstreams() {
+		forwarder, err := NewForwarder(upstream, self.conf.Mux.IdleTimeout)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("%s forwarding setup failed: %w", protocol, err)
+		}
+		if nil == demux {
+			demux = NewDemux()
+		}
+		if err := demux.Handle(protocol, forwarder); nil != err {
+			closeAll()
+			return fmt.Errorf("%s forwarding setup failed: %w", protocol, err)
+		}
+		forwarders = append(forwarders, forwarder)
+	}
+
+	var telemetry *Telemetry
+	if self.conf.Telemetry.Enabled {
+		telemetry, err = NewTelemetry(context.Background(), self.conf.Telemetry, metrics.Registry)
+		if nil != err {
+			closeAll()
+			return fmt.Errorf("telemetry setup failed: %w", err)
+		}
+		handler = Chain(handler, telemetry.Middleware())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	self.cancel = cancel
+	self.started = true
+	self.sup = NewSupervisor(ctx)
+
+	MonitoringStart(self.sup, self.conf.Monitoring, MonitoringMux(self.conf.Monitoring, metrics.Registry, self.health), monitoringListener)
+	if nil != adminListener {
+		AdminStart(self.sup, self.AdminHandler(), adminListener)
+	}
+	if nil != udpConn {
+		UdpStart(self.sup, udpConn, handler, metrics, udpProxy, cluster, demux)
+	}
+	if nil != tcpListener {
+		TcpStart(self.sup, tcpListener, TRANSPORT_TCP, handler, metrics, self.conns)
+	}
+	if nil != tlsListener {
+		TcpStart(self.sup, tlsListener, TRANSPORT_TLS, handler, metrics, self.conns)
+	}
+
+	if nil != auth {
+		auth.run(self.sup)
+	}
+	if nil != cluster {
+		cluster.discover(self.sup)
+	}
+	for _, forwarder := range forwarders {
+		forwarder.run(self.sup)
+	}
+	keepalives.run(self.sup)
+
+	if nil != telemetry {
+		self.sup.Go("telemetry", func(ctx context.Context) error {
+			<-ctx.Done()
+			flushCtx, cancel := context.WithTimeout(context.Background(), TELEMETRY_SHUTDOWN_TIMEOUT)
+			defer cancel()
+			if err := telemetry.Shutdown(flushCtx); nil != err {
+				slog.Warn("Telemetry flush failed", "error", err)
+			}
+			return nil
+		})
+	}
+
+	uris := []string{}
+	for _, u := range advertisedURIs(self.conf.Advertise.Host, self.addrs) {
+		uris = append(uris, u.String())
+	}
+	slog.Info("Advertised URIs", "uris", uris)
+
+	self.health.setBound(true)
+	self.health.probeLoop(self.sup, self.addrs, self.conf.Monitoring.ProbeInterval)
+
+	go func() {
+		self.sup.Wait()
+		// requests in flight are authenticated till every listener stopped
+		if nil != auth {
+			if err := auth.Close(); nil != err {
+				slog.Warn("Closing credential stores failed", "error", err)
+			}
+		}
+		close(self.done)
+	}()
+
+	close(self.ready)
+	return nil
+}
+
+// listen binds a tcp listener on port as the bind policy allows, unless a socket named name
+// is inherited
+func (self *Server) listen(name string, port int) (net.Listener, error) {
+	return bind(self.conf.Bind, name, func() (net.Listener, error) {
+		if file, ok := self.sockets[name]; ok {
+			delete(self.sockets, name)
+			return inheritedListener(file)
+		}
+		return net.Listen("tcp", fmt.Sprintf(":%d", port))
+	})
+}
+
+// Addrs returns the bound listener addresses, valid after Start returns without error
+func (self *Server) Addrs() Addrs {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.addrs
+}
+
+// Ready returns a channel that is closed once all listeners are bound and serving
+func (self *Server) Ready() <-chan struct{} {
+	return self.ready
+}
+
+func (self *Server) setPhase(phase string) {
+	slog.Info("Shutdown phase", "phase", phase)
+	self.mu.Lock()
+	metrics := self.metrics
+	self.mu.Unlock()
+	metrics.setPhase(phase)
+}
+
+// Done returns a channel that is closed once every listener stopped, either by Shutdown or
+// by a failure, see Err
+func (self *Server) Done() <-chan struct{} {
+	return self.done
+}
+
+// Err returns the failure that stopped the server, nil if it is running or was shut down
+func (self *Server) Err() error {
+	self.mu.Lock()
+	sup := self.sup
+	self.mu.Unlock()
+
+	if nil == sup {
+		return nil
+	}
+	return sup.Err()
+}
+
+// Serving returns nil while listeners answer readiness probes, also while draining, otherwise
+// the reason of not serving
+func (self *Server) Serving() error {
+	return self.health.Serving()
+}
+
+// Drain marks the server not ready so that load balancers stop sending new clients, while
+// requests are still served
+func (self *Server) Drain() {
+	if self.health.setDraining() {
+		self.setPhase(PHASE_DRAINING)
+	}
+}
+
+// Shutdown drains the server for the configured grace period, then stops accepting and waits
+// for in flight connections. Connections still open after the configured deadline are closed.
+// It returns early with the error of ctx if ctx expires first.
+func (self *Server) Shutdown(ctx context.Context) error {
+	self.mu.Lock()
+	cancel := self.cancel
+	self.mu.Unlock()
+
+	if nil == cancel {
+		return errors.New("server not started")
+	}
+
+	// a server that already failed has nothing to drain
+	self.Drain()
+	if self.conf.Shutdown.GracePeriod > 0 {
+		select {
+		case <-time.After(self.conf.Shutdown.GracePeriod):
+		case <-self.done:
+		case <-ctx.Done():
+		}
+	}
+
+	self.setPhase(PHASE_STOPPING)
+	cancel()
+
+	var deadline <-chan time.Time
+	if self.conf.Shutdown.Deadline > 0 {
+		timer := time.NewTimer(self.conf.Shutdown.Deadline)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-self.done:
+		self.setPhase(PHASE_STOPPED)
+		return nil
+	case <-deadline:
+		slog.Warn("Shutdown deadline reached, closing connections", "open", len(self.conns.List()))
+		self.conns.closeAll()
+	case <-ctx.Done():
+		self.conns.closeAll()
+		return ctx.Err()
+	}
+
+	select {
+	case <-self.done:
+		self.setPhase(PHASE_STOPPED)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
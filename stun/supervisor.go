@@ -0,0 +1,110 @@
+package stun
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// bind policies
+const (
+	BIND_FAIL_FAST = "fail_fast"
+	BIND_RETRY     = "retry"
+)
+
+type BindConf struct {
+	// Policy is fail_fast to give up on the first bind error, or retry to retry with backoff
+	Policy string
+	// Attempts is the number of binds tried per listener with retry policy
+	Attempts int
+	// Backoff is the wait before the first retry, doubled on every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+}
+
+func (self BindConf) String() string {
+	return fmt.Sprintf("{Policy: %s, Attempts: %d, Backoff: %s, MaxBackoff: %s}", self.Policy, self.Attempts, self.Backoff, self.MaxBackoff)
+}
+
+// bind calls listen as the policy of conf allows, returning the last error if all attempts fail
+func bind[T any](conf BindConf, name string, listen func() (T, error)) (T, error) {
+	attempts := 1
+	if conf.Policy == BIND_RETRY && conf.Attempts > 1 {
+		attempts = conf.Attempts
+	}
+
+	backoff := conf.Backoff
+	for attempt := 1; ; attempt++ {
+		l, err := listen()
+		if nil == err || attempt >= attempts {
+			return l, err
+		}
+
+		slog.Warn("Bind failed, retrying", "listener", name, "attempt", attempt, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if conf.MaxBackoff > 0 && backoff > conf.MaxBackoff {
+			backoff = conf.MaxBackoff
+		}
+	}
+}
+
+// Supervisor runs the goroutines of a server like an errgroup. The first goroutine to return an
+// error cancels the context of the others, and the error is kept to be reported by Wait.
+type Supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewSupervisor creates a supervisor whose goroutines stop when ctx is cancelled
+func NewSupervisor(ctx context.Context) *Supervisor {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Supervisor{ctx: ctx, cancel: cancel}
+}
+
+// Context is cancelled when the parent context is cancelled or a goroutine fails
+func (self *Supervisor) Context() context.Context {
+	return self.ctx
+}
+
+// Go runs fn in a goroutine, name identifies it in logs and in the returned error
+func (self *Supervisor) Go(name string, fn func(ctx context.Context) error) {
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+
+		err := fn(self.ctx)
+		if nil == err {
+			return
+		}
+
+		self.mu.Lock()
+		if nil == self.err {
+			slog.Error("Server component failed, stopping", "component", name, "error", err)
+			self.err = fmt.Errorf("%s: %w", name, err)
+		}
+		self.mu.Unlock()
+		self.cancel()
+	}()
+}
+
+// Err returns the error of the first failed goroutine, nil if none failed
+func (self *Supervisor) Err() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.err
+}
+
+// Wait blocks till every goroutine returns, and returns the first error
+func (self *Supervisor) Wait() error {
+	self.wg.Wait()
+	self.cancel()
+	return self.Err()
+}
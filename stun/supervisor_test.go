@@ -0,0 +1,94 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSupervisor(t *testing.T) {
+	sup := NewSupervisor(context.Background())
+	failure := errors.New("listener broke")
+
+	stopped := make(chan struct{})
+	sup.Go("waiter", func(ctx context.Context) error {
+		<-ctx.Done()
+		close(stopped)
+		return nil
+	})
+	sup.Go("failing", func(ctx context.Context) error {
+		return failure
+	})
+	sup.Go("late", func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.New("should not be reported")
+	})
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Failure did not stop other goroutines")
+	}
+
+	err := sup.Wait()
+	if !errors.Is(err, failure) {
+		t.Errorf("Wait returned %v, expected %v", err, failure)
+	}
+	if sup.Err() != err {
+		t.Errorf("Err %v is not same as Wait %v", sup.Err(), err)
+	}
+}
+
+func TestSupervisorCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sup := NewSupervisor(ctx)
+	sup.Go("waiter", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	cancel()
+	if err := sup.Wait(); nil != err {
+		t.Errorf("Cancelled supervisor returned %v, expected nil", err)
+	}
+}
+
+func TestBindPolicy(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	addr := busy.Addr().String()
+	listen := func() (net.Listener, error) { return net.Listen("tcp", addr) }
+
+	if _, err := bind(BindConf{Policy: BIND_FAIL_FAST, Attempts: 5, Backoff: time.Millisecond}, "tcp", listen); nil == err {
+		t.Fatal("Fail fast bind on a busy port should fail")
+	}
+
+	attempts := 0
+	conf := BindConf{Policy: BIND_RETRY, Attempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+	l, err := bind(conf, "tcp", func() (net.Listener, error) {
+		attempts++
+		if attempts == 3 {
+			busy.Close()
+		}
+		return listen()
+	})
+	if nil != err {
+		t.Fatalf("Retried bind failed: %s", err)
+	}
+	l.Close()
+	if attempts != 3 {
+		t.Errorf("Bind took %d attempts, expected 3", attempts)
+	}
+
+	attempts = 0
+	if _, err := bind(BindConf{Policy: BIND_RETRY, Attempts: 2, Backoff: time.Millisecond}, "tcp", func() (net.Listener, error) {
+		attempts++
+		return nil, errors.New("address in use")
+	}); nil == err || attempts != 2 {
+		t.Errorf("Bind returned %v after %d attempts, expected failure after 2", err, attempts)
+	}
+}
@@ -0,0 +1,158 @@
+package stun
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SD_LISTEN_FDS_START is the first file descriptor passed by systemd socket activation
+const SD_LISTEN_FDS_START = 3
+
+// states sent to the service manager with Notify
+const (
+	SD_READY    = "READY=1"
+	SD_STOPPING = "STOPPING=1"
+	SD_WATCHDOG = "WATCHDOG=1"
+)
+
+// listener names to match with FileDescriptorName= of socket units
+const (
+	LISTENER_MONITORING = "monitoring"
+	LISTENER_ADMIN      = "admin"
+)
+
+// parseListenEnv returns the names of sockets passed to process pid, by the values of
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES. No sockets are passed when listenPid is empty.
+func parseListenEnv(pid int, listenPid string, listenFds string, fdNames string) ([]string, error) {
+	if listenPid == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(listenPid); nil != err || p != pid {
+		// sockets are passed to another process, e.g. a parent shell
+		return nil, nil
+	}
+	n, err := strconv.Atoi(listenFds)
+	if nil != err || n < 0 {
+		return nil, fmt.Errorf("LISTEN_FDS %q is not a count", listenFds)
+	}
+
+	names := make([]string, n)
+	if fdNames != "" {
+		given := strings.Split(fdNames, ":")
+		if len(given) != n {
+			return nil, fmt.Errorf("LISTEN_FDNAMES has %d names for %d sockets", len(given), n)
+		}
+		copy(names, given)
+	}
+	return names, nil
+}
+
+// ListenFds returns sockets passed by systemd socket activation by their names, empty when the
+// process is not socket activated. The environment is unset so children do not inherit it.
+func ListenFds() (map[string]*os.File, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	names, err := parseListenEnv(os.Getpid(), os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+	if nil != err {
+		return nil, err
+	}
+
+	files := map[string]*os.File{}
+	for i, name := range names {
+		fd := SD_LISTEN_FDS_START + i
+		if name == "" {
+			return nil, fmt.Errorf("socket %d has no name, set FileDescriptorName= in the socket unit", fd)
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("socket name %q is used more than once", name)
+		}
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+	return files, nil
+}
+
+// inheritedListener turns an inherited socket into a listener, the file is closed as the
+// listener holds its own descriptor
+func inheritedListener(file *os.File) (net.Listener, error) {
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// inheritedPacketConn turns an inherited socket into a packet conn, the file is closed as the
+// conn holds its own descriptor
+func inheritedPacketConn(file *os.File) (net.PacketConn, error) {
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
+
+// Notify sends state to the service manager at NOTIFY_SOCKET. It returns false without error
+// when the process is not run by a service manager supporting notifications.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	// abstract namespace sockets are written with a leading @
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if nil != err {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); nil != err {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the watchdog timeout the service manager expects pings within, 0
+// when the watchdog is not enabled for this process
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if nil != err || n <= 0 {
+		return 0, fmt.Errorf("WATCHDOG_USEC %q is not a positive count", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// Watchdog pings the service manager at half of interval till done is closed. Pings are skipped
+// while serving returns an error, so that a server whose listeners stopped answering is restarted.
+func Watchdog(done <-chan struct{}, interval time.Duration, serving func() error) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := serving(); nil != err {
+				slog.Warn("Watchdog ping skipped, server is not serving", "error", err)
+				continue
+			}
+			if _, err := Notify(SD_WATCHDOG); nil != err {
+				slog.Warn("Watchdog ping failed", "error", err)
+			}
+		}
+	}
+}
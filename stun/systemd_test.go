@@ -0,0 +1,218 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseListenEnv(t *testing.T) {
+	pid := 1234
+	testCases := map[string]struct {
+		listenPid string
+		listenFds string
+		fdNames   string
+		names     []string
+		fails     bool
+	}{
+		"not socket activated should pass nothing":  {},
+		"sockets of another process should be left": {listenPid: "1", listenFds: "2", fdNames: "udp:tcp"},
+		"named sockets should be listed in order":   {listenPid: "1234", listenFds: "2", fdNames: "udp:tcp", names: []string{"udp", "tcp"}},
+		"unnamed sockets should have empty names":   {listenPid: "1234", listenFds: "1", names: []string{""}},
+		"name count mismatch should fail":           {listenPid: "1234", listenFds: "2", fdNames: "udp", fails: true},
+		"invalid count should fail":                 {listenPid: "1234", listenFds: "two", fails: true},
+	}
+	for name, test := range testCases {
+		names, err := parseListenEnv(pid, test.listenPid, test.listenFds, test.fdNames)
+		if (nil != err) != test.fails {
+			t.Errorf("%s: error is %v", name, err)
+			continue
+		}
+		if len(names) != len(test.names) {
+			t.Errorf("%s: names are %q, expected %q", name, names, test.names)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.names[i] {
+				t.Errorf("%s: names are %q, expected %q", name, names, test.names)
+			}
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify(SD_READY); sent || nil != err {
+		t.Fatalf("Notify without socket sent %t with error %v", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	if sent, err := Notify(SD_READY); !sent || nil != err {
+		t.Fatalf("Notify sent %t with error %v", sent, err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != SD_READY {
+		t.Errorf("Service manager got %q, expected %q", buf[:n], SD_READY)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	testCases := map[string]struct {
+		usec     string
+		pid      string
+		interval time.Duration
+		fails    bool
+	}{
+		"disabled watchdog should be 0":           {},
+		"interval should be read in usec":         {usec: "3000000", interval: 3 * time.Second},
+		"watchdog of this process should be set":  {usec: "3000000", pid: strconv.Itoa(os.Getpid()), interval: 3 * time.Second},
+		"watchdog of another process should be 0": {usec: "3000000", pid: "1"},
+		"invalid interval should fail":            {usec: "soon", fails: true},
+	}
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", test.usec)
+			t.Setenv("WATCHDOG_PID", test.pid)
+			interval, err := WatchdogInterval()
+			if (nil != err) != test.fails || interval != test.interval {
+				t.Errorf("Interval is %s with error %v, expected %s", interval, err, test.interval)
+			}
+		})
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	var mu sync.Mutex
+	servingErr := errors.New("udp probe failed")
+	serving := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return servingErr
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go Watchdog(done, 20*time.Millisecond, serving)
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); nil == err {
+		t.Fatalf("Service manager got %q while not serving", buf[:n])
+	}
+
+	mu.Lock()
+	servingErr = nil
+	mu.Unlock()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if nil != err {
+		t.Fatalf("No ping while serving: %s", err)
+	}
+	if string(buf[:n]) != SD_WATCHDOG {
+		t.Errorf("Service manager got %q, expected %q", buf[:n], SD_WATCHDOG)
+	}
+}
+
+func TestServerStartFailureClosesSockets(t *testing.T) {
+	occupied, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	testCases := map[string]struct {
+		modify func(*Configuration)
+	}{
+		"udp bind failure should close sockets": {modify: func(c *Configuration) { c.Udp.Port = occupied.LocalAddr().(*net.UDPAddr).Port }},
+		"invalid acl should close sockets":      {modify: func(c *Configuration) { c.Acl.Allow = []string{"any"} }},
+	}
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if nil != err {
+				t.Fatal(err)
+			}
+			defer tcpListener.Close()
+			tcpFile, err := tcpListener.(*net.TCPListener).File()
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			conf := testConfiguration()
+			test.modify(conf)
+			server := New(conf)
+			server.Sockets = map[string]*os.File{TRANSPORT_TCP: tcpFile}
+			if err := server.Start(); nil == err {
+				t.Fatal("Start should fail")
+			}
+			if err := tcpFile.Close(); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Passed socket is left open, closing it returned %v", err)
+			}
+		})
+	}
+}
+
+func TestServerInheritedSockets(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	udpFile, err := udpConn.(*net.UDPConn).File()
+	if nil != err {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	tcpFile, err := tcpListener.(*net.TCPListener).File()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	conf := testConfiguration()
+	server := New(conf)
+	server.Sockets = map[string]*os.File{TRANSPORT_UDP: udpFile, TRANSPORT_TCP: tcpFile}
+	if err := server.Start(); nil != err {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	addrs := server.Addrs()
+	if addrs.Udp.String() != udpConn.LocalAddr().String() || addrs.Tcp.String() != tcpListener.Addr().String() {
+		t.Fatalf("Server bound %s, expected inherited sockets", addrs)
+	}
+	bindingRequest(t, TRANSPORT_UDP, addrs.Udp.String())
+	bindingRequest(t, TRANSPORT_TCP, addrs.Tcp.String())
+}
@@ -0,0 +1,157 @@
+package stun
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promBridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME                = "github.com/sifaserdarozen/stun"
+	TELEMETRY_SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+// authentication kinds reported on spans
+const (
+	AUTH_NONE       = "none"
+	AUTH_SHORT_TERM = "short-term"
+	AUTH_LONG_TERM  = "long-term"
+)
+
+type TelemetryConf struct {
+	Enabled bool
+	// Endpoint is host:port of an OTLP/HTTP collector
+	Endpoint string
+	// Insecure sends to the collector over plain http
+	Insecure    bool
+	ServiceName string `mapstructure:"service_name"`
+	// SampleRatio is the fraction of requests traced, 1 traces all
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+	// ExportInterval is the period metrics are pushed to the collector
+	ExportInterval time.Duration `mapstructure:"export_interval"`
+}
+
+func (self TelemetryConf) String() string {
+	return fmt.Sprintf("{enabled: %t, Endpoint: %s, Insecure: %t, ServiceName: %s, SampleRatio: %g, ExportInterval: %s}", self.Enabled, self.Endpoint, self.Insecure, self.ServiceName, self.SampleRatio, self.ExportInterval)
+}
+
+// Telemetry traces requests and pushes metrics gathered from a prometheus registry over OTLP
+type Telemetry struct {
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	tracer         trace.Tracer
+}
+
+// NewTelemetry creates OTLP/HTTP trace and metric exporters. Metrics are the ones of gatherer,
+// so prometheus and OTLP report the same counters.
+func NewTelemetry(ctx context.Context, conf TelemetryConf, gatherer prometheus.Gatherer) (*Telemetry, error) {
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(conf.ServiceName),
+		semconv.ServiceVersion(Version),
+		semconv.DeploymentEnvironment(Env),
+	)
+
+	traceOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Endpoint)}
+	metricOptions := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(conf.Endpoint)}
+	if conf.Insecure {
+		traceOptions = append(traceOptions, otlptracehttp.WithInsecure())
+		metricOptions = append(metricOptions, otlpmetrichttp.WithInsecure())
+	}
+
+	traceExporter, err := otlptracehttp.New(ctx, traceOptions...)
+	if nil != err {
+		return nil, fmt.Errorf("trace exporter creation failed: %w", err)
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx, metricOptions...)
+	if nil != err {
+		return nil, fmt.Errorf("metric exporter creation failed: %w", err)
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter,
+			sdkmetric.WithInterval(conf.ExportInterval),
+			sdkmetric.WithProducer(promBridge.NewMetricProducer(promBridge.WithGatherer(gatherer))),
+		)),
+	)
+
+	return &Telemetry{
+		tracerProvider: tracerProvider,
+		meterProvider:  meterProvider,
+		tracer:         tracerProvider.Tracer(TRACER_NAME, trace.WithInstrumentationVersion(Version)),
+	}, nil
+}
+
+// Shutdown flushes pending spans and metrics to the collector
+func (self *Telemetry) Shutdown(ctx context.Context) error {
+	return errors.Join(self.tracerProvider.Shutdown(ctx), self.meterProvider.Shutdown(ctx))
+}
+
+// authKind tells the stun authentication mechanism a message uses
+func authKind(msg *Message) string {
+	if _, ok := msg.Get(MESSAGE_INTEGRITY); !ok {
+		return AUTH_NONE
+	}
+	if _, ok := msg.Get(REALM); ok {
+		return AUTH_LONG_TERM
+	}
+	return AUTH_SHORT_TERM
+}
+
+// methodName names stun methods for spans
+func methodName(method uint16) string {
+	if method == METHOD_BINDING {
+		return "binding"
+	}
+	return fmt.Sprintf("%#04x", method)
+}
+
+// Middleware starts a span per request with transport, method, result and auth attributes.
+// The span is in the context of the request passed to next.
+func (self *Telemetry) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			method := methodName(r.Message.Method())
+			ctx, span := self.tracer.Start(r.Context(), "stun "+method,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("stun.transport", r.Transport),
+					attribute.String("stun.method", method),
+					attribute.String("stun.class", className(r.Message.Class())),
+					attribute.String("stun.transaction_id", hex.EncodeToString(r.Message.ID[:])),
+					attribute.String("stun.auth", authKind(r.Message)),
+					attribute.String("client.address", r.RemoteAddr.String()),
+				),
+			)
+			defer span.End()
+
+			rw := &resultWriter{ResponseWriter: w}
+			next.ServeSTUN(rw, r.WithContext(ctx))
+
+			res := result(rw.res)
+			span.SetAttributes(attribute.String("stun.result", res))
+			if nil != rw.res && rw.res.Class() == CLASS_ERROR {
+				span.SetStatus(codes.Error, res)
+			}
+		})
+	}
+}
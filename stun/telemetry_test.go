@@ -0,0 +1,162 @@
+package stun
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectorStub is an in process OTLP/HTTP collector keeping what it receives
+type collectorStub struct {
+	mu      sync.Mutex
+	traces  []*tracepb.ExportTraceServiceRequest
+	metrics []*metricpb.ExportMetricsServiceRequest
+}
+
+func (self *collectorStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/v1/traces":
+		req := &tracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); nil != err {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		self.traces = append(self.traces, req)
+		body, _ = proto.Marshal(&tracepb.ExportTraceServiceResponse{})
+	case "/v1/metrics":
+		req := &metricpb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, req); nil != err {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		self.metrics = append(self.metrics, req)
+		body, _ = proto.Marshal(&metricpb.ExportMetricsServiceResponse{})
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(body)
+}
+
+// spanAttributes returns string attributes of spans named name
+func (self *collectorStub) spanAttributes(name string) []map[string]string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	var spans []map[string]string
+	for _, req := range self.traces {
+		for _, rs := range req.GetResourceSpans() {
+			for _, ss := range rs.GetScopeSpans() {
+				for _, span := range ss.GetSpans() {
+					if span.GetName() != name {
+						continue
+					}
+					attrs := map[string]string{}
+					for _, kv := range span.GetAttributes() {
+						attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+					}
+					spans = append(spans, attrs)
+				}
+			}
+		}
+	}
+	return spans
+}
+
+func (self *collectorStub) hasMetric(name string) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for _, req := range self.metrics {
+		for _, rm := range req.GetResourceMetrics() {
+			for _, sm := range rm.GetScopeMetrics() {
+				for _, m := range sm.GetMetrics() {
+					if m.GetName() == name {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+func TestTelemetry(t *testing.T) {
+	collector := &collectorStub{}
+	stub := httptest.NewServer(collector)
+	defer stub.Close()
+
+	conf := testConfiguration()
+	conf.Telemetry = TelemetryConf{
+		Enabled:        true,
+		Endpoint:       strings.TrimPrefix(stub.URL, "http://"),
+		Insecure:       true,
+		ServiceName:    DEFAULT_OTEL_SERVICE,
+		SampleRatio:    1,
+		ExportInterval: time.Hour,
+	}
+	server := New(conf)
+	if err := server.Start(); nil != err {
+		t.Fatal(err)
+	}
+	bindingRequest(t, TRANSPORT_UDP, loopback(server.Addrs().Udp))
+
+	// shutdown flushes spans and metrics
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); nil != err {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, attrs := range collector.spanAttributes("stun binding") {
+		if attrs["stun.transport"] == TRANSPORT_UDP && attrs["stun.result"] == "success" && attrs["stun.auth"] == AUTH_NONE {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("No udp binding span with success result among %v", collector.spanAttributes("stun binding"))
+	}
+	if !collector.hasMetric("lstun_requests_total") {
+		t.Error("lstun_requests_total is not exported over OTLP")
+	}
+}
+
+func TestAuthKind(t *testing.T) {
+	testCases := map[string]struct {
+		attrs    []uint16
+		expected string
+	}{
+		"no integrity":            {attrs: []uint16{USERNAME}, expected: AUTH_NONE},
+		"integrity without realm": {attrs: []uint16{USERNAME, MESSAGE_INTEGRITY}, expected: AUTH_SHORT_TERM},
+		"integrity with realm":    {attrs: []uint16{USERNAME, REALM, MESSAGE_INTEGRITY}, expected: AUTH_LONG_TERM},
+	}
+	for name, test := range testCases {
+		msg := &Message{Type: BINDING_REQUEST, Cookie: MESAGE_COOKIE}
+		for _, attr := range test.attrs {
+			msg.Add(attr, []byte{0, 0, 0, 0})
+		}
+		if kind := authKind(msg); kind != test.expected {
+			t.Errorf("%s: auth kind %s, expected %s", name, kind, test.expected)
+		}
+	}
+}
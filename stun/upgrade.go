@@ -0,0 +1,73 @@
+package stun
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// environment a new binary is started with on upgrade
+const (
+	// ENV_UPGRADE_FDS lists the names of listener sockets passed from descriptor 3 on
+	ENV_UPGRADE_FDS = "LSTN_UPGRADE_FDS"
+	// ENV_UPGRADE_READY is the descriptor the new binary reports readiness on
+	ENV_UPGRADE_READY = "LSTN_UPGRADE_READY_FD"
+)
+
+// UPGRADE_READY is written by the new binary once it serves
+const UPGRADE_READY = "ready\n"
+
+// UpgradeSockets returns the sockets passed by the binary being upgraded by their names, empty
+// when the process is not started by Upgrade. The environment is unset.
+func UpgradeSockets() (map[string]*os.File, error) {
+	value, ok := os.LookupEnv(ENV_UPGRADE_FDS)
+	if !ok {
+		return map[string]*os.File{}, nil
+	}
+	os.Unsetenv(ENV_UPGRADE_FDS)
+
+	files := map[string]*os.File{}
+	if value == "" {
+		return files, nil
+	}
+	for i, name := range strings.Split(value, ":") {
+		files[name] = os.NewFile(uintptr(SD_LISTEN_FDS_START+i), name)
+	}
+	return files, nil
+}
+
+// InheritedSockets returns sockets passed by Upgrade, or else by systemd socket activation
+func InheritedSockets() (map[string]*os.File, error) {
+	if _, ok := os.LookupEnv(ENV_UPGRADE_FDS); ok {
+		return UpgradeSockets()
+	}
+	return ListenFds()
+}
+
+// Upgraded reports whether the process is started by Upgrade and has not reported ready yet
+func Upgraded() bool {
+	_, ok := os.LookupEnv(ENV_UPGRADE_READY)
+	return ok
+}
+
+// UpgradeReady tells the binary being upgraded that this process serves, so that it can stop.
+// It does nothing when the process is not started by Upgrade.
+func UpgradeReady() error {
+	value, ok := os.LookupEnv(ENV_UPGRADE_READY)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(ENV_UPGRADE_READY)
+
+	fd, err := strconv.Atoi(value)
+	if nil != err {
+		return fmt.Errorf("%s %q is not a descriptor", ENV_UPGRADE_READY, value)
+	}
+	file := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer file.Close()
+	if _, err := file.WriteString(UPGRADE_READY); nil != err {
+		return fmt.Errorf("readiness report failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build !windows
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// upgradeSignals start a binary upgrade, see Server.Upgrade
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// rawConner is a listener or packet conn whose socket can be duplicated
+type rawConner interface {
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// listenerFds duplicates the sockets of bound listeners, names are sorted for a stable order.
+// Raw descriptors are used as os.File.Fd would switch the shared sockets to blocking mode.
+func (self *Server) listenerFds() ([]string, []int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	var names []string
+	for name := range self.bound {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var fds []int
+	for _, name := range names {
+		fd, err := dupSocket(self.bound[name])
+		if nil != err {
+			closeFds(fds)
+			return nil, nil, fmt.Errorf("%s listener socket duplication failed: %w", name, err)
+		}
+		fds = append(fds, fd)
+	}
+	return names, fds, nil
+}
+
+func dupSocket(l any) (int, error) {
+	conn, ok := l.(rawConner)
+	if !ok {
+		return -1, errors.New("socket can not be passed")
+	}
+	raw, err := conn.SyscallConn()
+	if nil != err {
+		return -1, err
+	}
+	fd := -1
+	var dupErr error
+	if err := raw.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	}); nil != err {
+		return -1, err
+	}
+	return fd, dupErr
+}
+
+// upgradeEnviron returns environ for the new binary. WATCHDOG_PID names this process, the new
+// binary would take the watchdog for another process and stop pinging it, so it is dropped.
+func upgradeEnviron(environ []string) []string {
+	var env []string
+	for _, v := range environ {
+		if !strings.HasPrefix(v, "WATCHDOG_PID=") {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+// Upgrade starts the binary at path with args, passing it the sockets of every listener, and
+// waits till it reports serving with UpgradeReady. The new process is returned running, the
+// caller is expected to shut this server down. If the new binary exits or ctx expires before
+// it is ready, it is killed and the error is returned, this server keeps serving then.
+func (self *Server) Upgrade(ctx context.Context, path string, args []string) (*os.Process, error) {
+	names, fds, err := self.listenerFds()
+	if nil != err {
+		return nil, err
+	}
+	defer closeFds(fds)
+
+	ready, readyWriter, err := os.Pipe()
+	if nil != err {
+		return nil, fmt.Errorf("readiness pipe creation failed: %w", err)
+	}
+	defer ready.Close()
+
+	// passed descriptors are numbered from 3 on in the new process, after stdio
+	files := []uintptr{0, 1, 2}
+	for _, fd := range fds {
+		files = append(files, uintptr(fd))
+	}
+	files = append(files, readyWriter.Fd())
+	env := append(upgradeEnviron(os.Environ()),
+		ENV_UPGRADE_FDS+"="+strings.Join(names, ":"),
+		ENV_UPGRADE_READY+"="+strconv.Itoa(SD_LISTEN_FDS_START+len(fds)),
+	)
+	pid, err := syscall.ForkExec(path, append([]string{path}, args...), &syscall.ProcAttr{Env: env, Files: files})
+	readyWriter.Close()
+	if nil != err {
+		return nil, fmt.Errorf("starting %s failed: %w", path, err)
+	}
+	process, err := os.FindProcess(pid)
+	if nil != err {
+		return nil, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, len(UPGRADE_READY))
+		if _, err := io.ReadFull(ready, buf); nil != err || string(buf) != UPGRADE_READY {
+			result <- errors.New("new binary exited before it was ready")
+			return
+		}
+		result <- nil
+	}()
+
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = fmt.Errorf("new binary was not ready in time: %w", ctx.Err())
+	}
+	if nil != err {
+		process.Kill()
+		process.Wait()
+		return nil, err
+	}
+	return process, nil
+}
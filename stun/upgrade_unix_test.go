@@ -0,0 +1,113 @@
+//go:build !windows
+
+package stun
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// ENV_TEST_UPGRADE_CHILD makes the test binary act as the new binary of an upgrade
+const ENV_TEST_UPGRADE_CHILD = "LSTN_TEST_UPGRADE_CHILD"
+
+// TestUpgradeChild serves on inherited sockets when run by TestServerUpgrade
+func TestUpgradeChild(t *testing.T) {
+	if os.Getenv(ENV_TEST_UPGRADE_CHILD) == "" {
+		t.Skip("only run as the new binary of an upgrade")
+	}
+
+	sockets, err := InheritedSockets()
+	if nil != err {
+		t.Fatal(err)
+	}
+	conf := testConfiguration()
+	// probes answered by the stopping old binary may fail, the watchdog waits for a passing one
+	conf.Monitoring.ProbeInterval = 50 * time.Millisecond
+	server := New(conf)
+	server.Sockets = sockets
+	if err := server.Start(); nil != err {
+		t.Fatal(err)
+	}
+	if err := UpgradeReady(); nil != err {
+		t.Fatal(err)
+	}
+	interval, err := WatchdogInterval()
+	if nil != err {
+		t.Fatal(err)
+	}
+	go Watchdog(server.Done(), interval, server.Serving)
+	// the parent test kills this process once done
+	select {
+	case <-server.Done():
+	case <-time.After(10 * time.Second):
+	}
+}
+
+func TestServerUpgrade(t *testing.T) {
+	server := New(testConfiguration())
+	if err := server.Start(); nil != err {
+		t.Fatal(err)
+	}
+	addrs := server.Addrs()
+
+	// the watchdog of this process moves to the new binary
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	notifications, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer notifications.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "200000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	t.Setenv(ENV_TEST_UPGRADE_CHILD, "1")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	process, err := server.Upgrade(ctx, os.Args[0], []string{"-test.run=^TestUpgradeChild$"})
+	if nil != err {
+		t.Fatalf("Upgrade failed: %s", err)
+	}
+	defer func() {
+		process.Kill()
+		process.Wait()
+	}()
+
+	// the old server stops, the new one keeps serving on the same sockets
+	if err := server.Shutdown(ctx); nil != err {
+		t.Fatal(err)
+	}
+	bindingRequest(t, TRANSPORT_UDP, loopback(addrs.Udp))
+	bindingRequest(t, TRANSPORT_TCP, loopback(addrs.Tcp))
+
+	buf := make([]byte, 64)
+	notifications.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := notifications.Read(buf)
+	if nil != err {
+		t.Fatalf("New binary did not ping the watchdog: %s", err)
+	}
+	if string(buf[:n]) != SD_WATCHDOG {
+		t.Errorf("Service manager got %q, expected %q", buf[:n], SD_WATCHDOG)
+	}
+}
+
+func TestServerUpgradeFailure(t *testing.T) {
+	server := startTestServer(t, testConfiguration(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	path, err := exec.LookPath("true")
+	if nil != err {
+		t.Skip("no binary exiting at once is found")
+	}
+	if _, err := server.Upgrade(ctx, path, nil); nil == err {
+		t.Fatal("Upgrade to a binary exiting without being ready should fail")
+	}
+	bindingRequest(t, TRANSPORT_UDP, loopback(server.Addrs().Udp))
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// upgradeSignals is empty as sockets can not be passed to a new binary on windows
+var upgradeSignals = []os.Signal{}
+
+// Upgrade is not supported on windows
+func (self *Server) Upgrade(ctx context.Context, path string, args []string) (*os.Process, error) {
+	return nil, errors.New("binary upgrade is not supported on windows")
+}
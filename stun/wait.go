@@ -1,34 +1,64 @@
 package stun
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
-func WaitTillInterrupt() {
+// WaitTillInterrupt blocks till a soft kill signal is received or done is closed. On an upgrade
+// signal, SIGUSR2 where supported, upgrade is called when not nil, and it returns once upgrade
+// succeeds so that the old binary can drain and stop.
+func WaitTillInterrupt(done <-chan struct{}, upgrade func() error) {
 	signalChan := make(chan os.Signal, 1)
 	// register os generic os.Interrupt / os.Kill. Refer https://pkg.go.dev/os#Signal
 	signal.Notify(signalChan, os.Interrupt)
 	// register os specific syscall.SIGTERM, syscall.SIGHUP, etc
 	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGHUP)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(signalChan, upgradeSignals...)
+	}
 	defer signal.Stop(signalChan)
 
 loop:
 	for {
-		switch s := <-signalChan; s {
-		case os.Interrupt:
-			log.Println("Stoping due to soft kill (kill -SIGINT <pid>)")
-			break loop
-		case syscall.SIGTERM:
-			log.Println("Stoping due to soft kill (kill -SIGTERM <pid>)")
+		select {
+		case <-done:
+			slog.Warn("Server stopped by itself")
 			break loop
-		default:
-			// Implement SIGHUP for configuration reread
-			log.Printf("Ignoring registered but unimplemented signal %T, %v", s, s)
+		case s := <-signalChan:
+			switch s {
+			case os.Interrupt:
+				slog.Info("Stopping due to soft kill (kill -SIGINT <pid>)")
+				break loop
+			case syscall.SIGTERM:
+				slog.Info("Stopping due to soft kill (kill -SIGTERM <pid>)")
+				break loop
+			default:
+				if isUpgradeSignal(s) && nil != upgrade {
+					slog.Info("Upgrading binary (kill -SIGUSR2 <pid>)")
+					if err := upgrade(); nil != err {
+						slog.Error("Upgrade failed, serving on", "error", err)
+						continue
+					}
+					slog.Info("Upgraded binary is serving, stopping")
+					break loop
+				}
+				// Implement SIGHUP for configuration reread
+				slog.Warn("Ignoring registered but unimplemented signal", "signal", s.String())
+			}
 		}
 	}
 
-	log.Println("Stopping threads ...")
+	slog.Info("Stopping threads")
+}
+
+func isUpgradeSignal(s os.Signal) bool {
+	for _, upgrade := range upgradeSignals {
+		if s == upgrade {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,227 @@
+// Package uri parses and formats stun and turn URIs of RFC 7064 and RFC 7065, and resolves them to
+// server addresses
+package uri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// schemes, the secure ones run over tls or dtls
+const (
+	SCHEME_STUN  = "stun"
+	SCHEME_STUNS = "stuns"
+	SCHEME_TURN  = "turn"
+	SCHEME_TURNS = "turns"
+)
+
+// transports of the transport query of turn URIs
+const (
+	TRANSPORT_UDP = "udp"
+	TRANSPORT_TCP = "tcp"
+)
+
+// default ports of RFC 5389 section 9
+const (
+	DEFAULT_PORT     = 3478
+	DEFAULT_TLS_PORT = 5349
+)
+
+var ErrNoHost = errors.New("uri has no host")
+
+// URI is a stun or turn URI
+type URI struct {
+	Scheme string
+	// Host is a domain name or an ip address, without brackets for ipv6
+	Host string
+	// Port is 0 when the URI has none, see DefaultPort
+	Port int
+	// Transport is the transport query of turn URIs, empty when the URI has none
+	Transport string
+}
+
+// Parse parses a stun, stuns, turn or turns URI. Schemes are case insensitive, hosts are
+// lowercased.
+func Parse(s string) (*URI, error) {
+	u, err := url.Parse(s)
+	if nil != err {
+		return nil, err
+	}
+	self := &URI{Scheme: strings.ToLower(u.Scheme)}
+	switch self.Scheme {
+	case SCHEME_STUN, SCHEME_STUNS, SCHEME_TURN, SCHEME_TURNS:
+	default:
+		return nil, fmt.Errorf("%q is not a stun or turn uri", s)
+	}
+	if u.Opaque == "" {
+		// scheme://host and scheme: both end up here
+		return nil, fmt.Errorf("%q should be %s:host[:port], without //", s, self.Scheme)
+	}
+	if u.Fragment != "" || u.User != nil {
+		return nil, fmt.Errorf("%q should have no fragment or user info", s)
+	}
+
+	host, port, err := splitHostPort(u.Opaque)
+	if nil != err {
+		return nil, fmt.Errorf("%q: %w", s, err)
+	}
+	self.Host, self.Port = strings.ToLower(host), port
+
+	if u.RawQuery != "" {
+		if !self.Turn() {
+			return nil, fmt.Errorf("%q should have no query, only turn uris have a transport", s)
+		}
+		query, err := url.ParseQuery(u.RawQuery)
+		if nil != err {
+			return nil, fmt.Errorf("%q has a malformed query: %w", s, err)
+		}
+		for key, values := range query {
+			if key != "transport" || len(values) != 1 || values[0] == "" {
+				return nil, fmt.Errorf("%q should have one transport in its query", s)
+			}
+		}
+		self.Transport = strings.ToLower(query.Get("transport"))
+	}
+	return self, nil
+}
+
+// splitHostPort splits host[:port], where host is a name, an ipv4 address or a bracketed
+// ipv6 address
+func splitHostPort(hostport string) (string, int, error) {
+	host, portString, hasPort := hostport, "", false
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.Index(hostport, "]")
+		if end < 0 {
+			return "", 0, errors.New("ipv6 address has no closing bracket")
+		}
+		host = hostport[1:end]
+		if ip := net.ParseIP(host); nil == ip || nil != ip.To4() {
+			return "", 0, fmt.Errorf("%q is not an ipv6 address", host)
+		}
+		rest := hostport[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", 0, fmt.Errorf("%q follows the ipv6 address", rest)
+			}
+			portString, hasPort = rest[1:], true
+		}
+	} else if i := strings.LastIndex(hostport, ":"); i >= 0 {
+		host, portString, hasPort = hostport[:i], hostport[i+1:], true
+		if strings.Contains(host, ":") {
+			return "", 0, errors.New("ipv6 address should be in brackets")
+		}
+	}
+	if host == "" {
+		return "", 0, ErrNoHost
+	}
+	port := 0
+	if hasPort {
+		var err error
+		port, err = strconv.Atoi(portString)
+		if nil != err || port < 1 || port > 65535 {
+			return "", 0, fmt.Errorf("port %q is out of range [1, 65535]", portString)
+		}
+	}
+	return host, port, nil
+}
+
+// String formats the URI, bracketing ipv6 hosts
+func (self URI) String() string {
+	s := self.Scheme + ":" + self.Host
+	if strings.Contains(self.Host, ":") {
+		s = self.Scheme + ":[" + self.Host + "]"
+	}
+	if self.Port != 0 {
+		s += ":" + strconv.Itoa(self.Port)
+	}
+	if self.Transport != "" {
+		s += "?transport=" + self.Transport
+	}
+	return s
+}
+
+// Secure reports whether the URI is of stuns or turns, run over tls or dtls
+func (self URI) Secure() bool {
+	return self.Scheme == SCHEME_STUNS || self.Scheme == SCHEME_TURNS
+}
+
+// Turn reports whether the URI is of turn or turns
+func (self URI) Turn() bool {
+	return self.Scheme == SCHEME_TURN || self.Scheme == SCHEME_TURNS
+}
+
+// DefaultPort returns the port used when the URI has none
+func (self URI) DefaultPort() int {
+	if self.Secure() {
+		return DEFAULT_TLS_PORT
+	}
+	return DEFAULT_PORT
+}
+
+// Network returns the transport the server is reached with, the given one for turn URIs,
+// otherwise udp for plain and tcp for secure schemes
+func (self URI) Network() string {
+	if self.Transport != "" {
+		return self.Transport
+	}
+	if self.Secure() {
+		return TRANSPORT_TCP
+	}
+	return TRANSPORT_UDP
+}
+
+// Addr returns host:port of the server, with the default port when the URI has none
+func (self URI) Addr() string {
+	port := self.Port
+	if port == 0 {
+		port = self.DefaultPort()
+	}
+	return net.JoinHostPort(self.Host, strconv.Itoa(port))
+}
+
+// Srv returns the service and protocol of the SRV records of the URI, e.g. _stun._udp or
+// _turns._tcp, RFC 5389 section 9 and RFC 5766 section 6
+func (self URI) Srv() (string, string) {
+	return self.Scheme, self.Network()
+}
+
+// Resolver looks up SRV records, a *net.Resolver
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Resolve returns the addresses to try for the URI in order. A URI with a port or an ip
+// address is its own address, otherwise SRV records of the host are looked up and the default
+// port of the host is used when it has none.
+func Resolve(ctx context.Context, resolver Resolver, u URI) ([]string, error) {
+	if u.Port != 0 || nil != net.ParseIP(u.Host) {
+		return []string{u.Addr()}, nil
+	}
+	service, proto := u.Srv()
+	_, records, err := resolver.LookupSRV(ctx, service, proto, u.Host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return []string{u.Addr()}, nil
+	}
+	if nil != err {
+		return nil, fmt.Errorf("srv lookup of %s failed: %w", u, err)
+	}
+
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		// a single "." target means the service is not available at the domain, RFC 2782
+		if record.Target == "." {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s is not available at %s", service, u.Host)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,140 @@
+package uri
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		uri    URI
+		format string
+		err    bool
+	}{
+		"stun:example.org":                             {uri: URI{Scheme: SCHEME_STUN, Host: "example.org"}},
+		"STUN:Example.ORG:3478":                        {uri: URI{Scheme: SCHEME_STUN, Host: "example.org", Port: 3478}, format: "stun:example.org:3478"},
+		"stuns:192.0.2.1:5349":                         {uri: URI{Scheme: SCHEME_STUNS, Host: "192.0.2.1", Port: 5349}},
+		"stun:[2001:db8::1]:3478":                      {uri: URI{Scheme: SCHEME_STUN, Host: "2001:db8::1", Port: 3478}},
+		"stun:[2001:db8::1]":                           {uri: URI{Scheme: SCHEME_STUN, Host: "2001:db8::1"}},
+		"turn:example.org?transport=udp":               {uri: URI{Scheme: SCHEME_TURN, Host: "example.org", Transport: TRANSPORT_UDP}},
+		"turns:example.org:443?transport=TCP":          {uri: URI{Scheme: SCHEME_TURNS, Host: "example.org", Port: 443, Transport: TRANSPORT_TCP}, format: "turns:example.org:443?transport=tcp"},
+		"turn:example.org":                             {uri: URI{Scheme: SCHEME_TURN, Host: "example.org"}},
+		"http:example.org":                             {err: true},
+		"stun://example.org":                           {err: true},
+		"stun:":                                        {err: true},
+		"stun::3478":                                   {err: true},
+		"stun:example.org:":                            {err: true},
+		"stun:example.org:0":                           {err: true},
+		"stun:example.org:65536":                       {err: true},
+		"stun:2001:db8::1":                             {err: true},
+		"stun:[192.0.2.1]":                             {err: true},
+		"stun:[2001:db8::1":                            {err: true},
+		"stun:[2001:db8::1]3478":                       {err: true},
+		"stun:example.org?transport=udp":               {err: true},
+		"turn:example.org?transport=":                  {err: true},
+		"turn:example.org?proto=udp":                   {err: true},
+		"turn:example.org?transport=udp&transport=tcp": {err: true},
+		"stun:example.org#fragment":                    {err: true},
+	}
+	for s, test := range tests {
+		t.Run(s, func(t *testing.T) {
+			u, err := Parse(s)
+			if test.err {
+				if nil == err {
+					t.Errorf("parsed as %+v, expected an error", u)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatal(err)
+			}
+			if *u != test.uri {
+				t.Errorf("parsed as %+v, expected %+v", *u, test.uri)
+			}
+			format := test.format
+			if format == "" {
+				format = s
+			}
+			if u.String() != format {
+				t.Errorf("formatted as %s, expected %s", u, format)
+			}
+		})
+	}
+}
+
+func TestURIDefaults(t *testing.T) {
+	tests := []struct {
+		uri     URI
+		network string
+		addr    string
+	}{
+		{uri: URI{Scheme: SCHEME_STUN, Host: "example.org"}, network: TRANSPORT_UDP, addr: "example.org:3478"},
+		{uri: URI{Scheme: SCHEME_STUNS, Host: "example.org"}, network: TRANSPORT_TCP, addr: "example.org:5349"},
+		{uri: URI{Scheme: SCHEME_TURN, Host: "example.org", Transport: TRANSPORT_TCP}, network: TRANSPORT_TCP, addr: "example.org:3478"},
+		{uri: URI{Scheme: SCHEME_TURNS, Host: "2001:db8::1", Port: 443}, network: TRANSPORT_TCP, addr: "[2001:db8::1]:443"},
+	}
+	for _, test := range tests {
+		if network := test.uri.Network(); network != test.network {
+			t.Errorf("%s network %s, expected %s", test.uri, network, test.network)
+		}
+		if addr := test.uri.Addr(); addr != test.addr {
+			t.Errorf("%s address %s, expected %s", test.uri, addr, test.addr)
+		}
+	}
+}
+
+// testResolver answers SRV lookups from records by _service._proto.name
+type testResolver struct {
+	records map[string][]*net.SRV
+	lookups []string
+}
+
+func (self *testResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	key := "_" + service + "._" + proto + "." + name
+	self.lookups = append(self.lookups, key)
+	records, ok := self.records[key]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: key, IsNotFound: true}
+	}
+	return key, records, nil
+}
+
+func TestResolve(t *testing.T) {
+	resolver := &testResolver{records: map[string][]*net.SRV{
+		"_stun._udp.example.org":  {{Target: "a.example.org.", Port: 3478}, {Target: "b.example.org.", Port: 3479}},
+		"_stuns._tcp.example.org": {{Target: "tls.example.org.", Port: 443}},
+		"_stun._udp.empty.org":    {{Target: ".", Port: 0}},
+	}}
+	tests := []struct {
+		uri    string
+		addrs  []string
+		lookup string
+		err    bool
+	}{
+		{uri: "stun:example.org", addrs: []string{"a.example.org:3478", "b.example.org:3479"}, lookup: "_stun._udp.example.org"},
+		{uri: "stuns:example.org", addrs: []string{"tls.example.org:443"}, lookup: "_stuns._tcp.example.org"},
+		{uri: "turn:example.org?transport=tcp", addrs: []string{"example.org:3478"}, lookup: "_turn._tcp.example.org"},
+		{uri: "stun:example.org:3479", addrs: []string{"example.org:3479"}},
+		{uri: "stun:192.0.2.1", addrs: []string{"192.0.2.1:3478"}},
+		{uri: "stun:empty.org", lookup: "_stun._udp.empty.org", err: true},
+	}
+	for _, test := range tests {
+		u, err := Parse(test.uri)
+		if nil != err {
+			t.Fatal(err)
+		}
+		resolver.lookups = nil
+		addrs, err := Resolve(context.Background(), resolver, *u)
+		if test.err != (nil != err) {
+			t.Errorf("%s resolved with error %v", test.uri, err)
+		}
+		if !slices.Equal(addrs, test.addrs) {
+			t.Errorf("%s resolved to %v, expected %v", test.uri, addrs, test.addrs)
+		}
+		if (test.lookup == "") != (len(resolver.lookups) == 0) || (test.lookup != "" && resolver.lookups[0] != test.lookup) {
+			t.Errorf("%s looked up %v, expected %s", test.uri, resolver.lookups, test.lookup)
+		}
+	}
+}